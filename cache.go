@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -11,41 +12,143 @@ import (
 	"github.com/andreimerlescu/sema"
 )
 
+// coreCacheFiles are the files of every cache, including those written before the index container;
+// when one of them is missing or fails its checksum the cache is rebuilt from -dir
+var coreCacheFiles = []string{cacheFile, cacheIndexFile, wordIndexFile, gemIndexFile}
+
+// derivedIndexFiles are the indexes that later versions added to the base segment, which
+// buildMissingIndexes can build from the cached pages of an older cache
+var derivedIndexFiles = []string{positionIndexFile, fieldIndexFile, frequencyIndexFile}
+
+// openCache loads the cache in the cache directory for searching, rebuilding it from dir when it is
+// missing or damaged. A cache written by an older version is upgraded in place instead: its word and
+// gematria indexes are migrated to the index container (or refused, see loadIndexFile) and the indexes
+// it lacks are built from its pages.
+func openCache(dir string) error {
+	cacheDir := *cfigs.String(kCacheDir)
+	cacheValid := true
+	for _, file := range coreCacheFiles {
+		filePath := filepath.Join(cacheDir, file)
+		if !verifyChecksum(filePath, filePath+".sha256") {
+			cacheValid = false
+			break
+		}
+	}
+
+	if !cacheValid {
+		log.Println("Cache invalid or missing, rebuilding...")
+		if err := buildCache(dir); err != nil {
+			return fmt.Errorf("cache initialization failed: %w", err)
+		}
+		log.Println("Cache initialized successfully")
+		// Generate checksums after build
+		for _, file := range append(coreCacheFiles, derivedIndexFiles...) {
+			if err := generateChecksum(filepath.Join(cacheDir, file)); err != nil {
+				errorLogger.Printf("Failed to generate checksum for %s: %v", file, err)
+			}
+		}
+		return loadSearchData()
+	}
+
+	log.Println("Cache files validated, loading search data...")
+	for _, name := range []string{wordIndexFile, gemIndexFile} {
+		if err := loadIndexFile(filepath.Join(cacheDir, name), name == gemIndexFile); err != nil {
+			return fmt.Errorf("failed to load %s: %w", name, err)
+		}
+	}
+	var missing []string
+	for _, file := range derivedIndexFiles {
+		filePath := filepath.Join(cacheDir, file)
+		if !verifyChecksum(filePath, filePath+".sha256") {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("Building %s from the cached pages...", strings.Join(missing, ", "))
+		if err := buildMissingIndexes(missing); err != nil {
+			return fmt.Errorf("failed to build missing indexes: %w", err)
+		}
+	}
+	return loadSearchData()
+}
+
 func buildCache(dir string) (err error) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
+	indexGeneration.Add(1) // merges that are running write segments this rebuild replaces
+
+	// The registry must be read before cache_index.txt is truncated, see loadPageIDRegistry.
+	registry, err := loadPageIDRegistry()
+	if err != nil {
+		return fmt.Errorf("loading the page ID registry failed: %v", err)
+	}
 
 	// Define file paths for cache and indexes.
 	theCacheFilePath := filepath.Join(*cfigs.String(kCacheDir), cacheFile)
 	theCacheIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), cacheIndexFile)
 	theWordPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "word_postings.txt")
 	theGematriaPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "gematria_postings.txt")
+	thePositionPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "position_postings.txt")
+	theFieldPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "field_postings.txt")
+	theFrequencyPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "frequency_postings.txt")
+	theLengthPostingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "length_postings.txt")
+	thePageSourcesFilePath := filepath.Join(*cfigs.String(kCacheDir), pageSourcesFile)
 
 	// Open files for writing (create mode).
-	cacheWriter, cachedFile, err := FileAppender(theCacheFilePath, os.O_CREATE|os.O_WRONLY)
+	cacheWriter, cachedFile, err := FileAppender(theCacheFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return fmt.Errorf("the FileAppender(%s) failed with: %v", theCacheFilePath, err)
 	}
 	defer cachedFile.Close()
 
-	idxWriter, idxFile, err := FileAppender(theCacheIndexFilePath, os.O_CREATE|os.O_WRONLY)
+	idxWriter, idxFile, err := FileAppender(theCacheIndexFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return fmt.Errorf("the FileAppender(%s) failed with: %v", theCacheIndexFilePath, err)
 	}
 	defer idxFile.Close()
 
-	wordWriter, wordFile, err := FileAppender(theWordPostingsFilePath, os.O_CREATE|os.O_WRONLY)
+	wordWriter, wordFile, err := FileAppender(theWordPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return fmt.Errorf("the FileAppender(%s) failed with: %v", theWordPostingsFilePath, err)
 	}
 	defer wordFile.Close()
 
-	gemWriter, gemFile, err := FileAppender(theGematriaPostingsFilePath, os.O_CREATE|os.O_WRONLY)
+	gemWriter, gemFile, err := FileAppender(theGematriaPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return fmt.Errorf("the FileAppender(%s) failed with: %v", theGematriaPostingsFilePath, err)
 	}
 	defer gemFile.Close()
 
+	posWriter, posFile, err := FileAppender(thePositionPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("the FileAppender(%s) failed with: %v", thePositionPostingsFilePath, err)
+	}
+	defer posFile.Close()
+
+	fieldWriter, fieldFile, err := FileAppender(theFieldPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("the FileAppender(%s) failed with: %v", theFieldPostingsFilePath, err)
+	}
+	defer fieldFile.Close()
+
+	freqWriter, freqFile, err := FileAppender(theFrequencyPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("the FileAppender(%s) failed with: %v", theFrequencyPostingsFilePath, err)
+	}
+	defer freqFile.Close()
+
+	lengthWriter, lengthFile, err := FileAppender(theLengthPostingsFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("the FileAppender(%s) failed with: %v", theLengthPostingsFilePath, err)
+	}
+	defer lengthFile.Close()
+
+	sourcesWriter, sourcesFile, err := FileAppender(thePageSourcesFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("the FileAppender(%s) failed with: %v", thePageSourcesFilePath, err)
+	}
+	defer sourcesFile.Close()
+
 	// Step 1: Collect all OCR file paths to process.
 	var ocrFiles []string
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
@@ -76,13 +179,53 @@ func buildCache(dir string) (err error) {
 	}
 	semaphore := sema.New(workerLimit)
 
+	// Step 3: Read the identifier of every page concurrently, then hand out the registry's IDs in walk
+	// order so that new pages are numbered the same way on every run.
+	identifiers := make([]string, len(ocrFiles))
+	identifierErrs := make([]error, len(ocrFiles))
+	var wg sync.WaitGroup
+	for i, path := range ocrFiles {
+		if !strings.HasSuffix(filepath.Dir(path), "pages") {
+			continue // Skip if not in 'pages' directory.
+		}
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			semaphore.Acquire()
+			defer semaphore.Release()
+			identifiers[i], identifierErrs[i] = readPageIdentifier(path)
+		}(i, path)
+	}
+	wg.Wait()
+	pageIDsByFile := make([]int, len(ocrFiles))
+	assigned := make(map[string]string, len(ocrFiles))
+	for i, identifier := range identifiers {
+		if identifierErrs[i] != nil {
+			return fmt.Errorf("reading the page identifier of %s failed: %v", ocrFiles[i], identifierErrs[i])
+		}
+		if identifier == "" {
+			pageIDsByFile[i] = -1
+			continue
+		}
+		if previous, ok := assigned[identifier]; ok {
+			// two files claim one page, the earlier one keeps the ID of the identifier
+			errorLogger.Printf("Page identifier %s of %s is also the identifier of %s", identifier, ocrFiles[i], previous)
+			pageIDsByFile[i] = registry.assign(duplicateKey(identifier, sourcePath(ocrFiles[i])))
+			continue
+		}
+		pageIDsByFile[i] = registry.assign(identifier)
+		assigned[identifier] = ocrFiles[i]
+	}
+
 	// Channel to collect results from goroutines.
 	resultsChan := make(chan processResult, len(ocrFiles))
-	var wg sync.WaitGroup
 
-	// Step 3: Process each OCR file in a goroutine.
-	pageID := 0
-	for _, path := range ocrFiles {
+	// Step 4: Process each OCR file in a goroutine.
+	for i, path := range ocrFiles {
+		pageID := pageIDsByFile[i]
+		if pageID < 0 {
+			continue
+		}
 		wg.Add(1)
 		go func(path string, pageID int) {
 			defer wg.Done()
@@ -92,7 +235,7 @@ func buildCache(dir string) (err error) {
 			defer semaphore.Release()
 
 			// Process the OCR file.
-			pageData, wordPostings, gemPostings, err := ProcessOCRFile(path, pageID)
+			pageData, wordPostings, gemPostings, posPostings, err := ProcessOCRFile(path, pageID)
 			if err != nil {
 				resultsChan <- processResult{pageID: pageID, err: err}
 				return
@@ -106,21 +249,22 @@ func buildCache(dir string) (err error) {
 			// Send the result to the channel.
 			resultsChan <- processResult{
 				pageID:       pageID,
+				path:         path,
 				pageData:     pageData,
 				wordPostings: wordPostings,
 				gemPostings:  gemPostings,
+				posPostings:  posPostings,
 			}
 		}(path, pageID)
-		pageID++
 	}
 
-	// Step 4: Close the results channel once all goroutines are done.
+	// Step 5: Close the results channel once all goroutines are done.
 	go func() {
 		wg.Wait()
 		close(resultsChan)
 	}()
 
-	// Step 5: Collect results and write to cache files in order.
+	// Step 6: Collect results and write to cache files in order.
 	// We write sequentially to avoid race conditions on file writes.
 	for result := range resultsChan {
 		if result.err != nil {
@@ -131,9 +275,12 @@ func buildCache(dir string) (err error) {
 		}
 
 		// Append to cache and index.
-		if err := AppendToCache(cacheWriter, idxWriter, result.pageData, result.pageID, cachedFile); err != nil {
+		if _, err := AppendToCache(cacheWriter, idxWriter, result.pageData, result.pageID, cachedFile); err != nil {
 			return fmt.Errorf("AppendToCache for page %d failed: %v", result.pageID, err)
 		}
+		if err := writePageSource(sourcesWriter, result.pageID, result.path); err != nil {
+			return fmt.Errorf("writing page source for page %d failed: %v", result.pageID, err)
+		}
 
 		// Write word postings.
 		for _, posting := range result.wordPostings {
@@ -150,9 +297,37 @@ func buildCache(dir string) (err error) {
 				return fmt.Errorf("writing gematria posting for page %d failed: %v", result.pageID, err)
 			}
 		}
+
+		// Write position postings.
+		for _, posting := range result.posPostings {
+			_, err = posWriter.WriteString(posting + "\n")
+			if err != nil {
+				return fmt.Errorf("writing position posting for page %d failed: %v", result.pageID, err)
+			}
+		}
+
+		// Write field postings.
+		for _, posting := range generateFieldPostings(result.pageData, result.pageID) {
+			_, err = fieldWriter.WriteString(posting + "\n")
+			if err != nil {
+				return fmt.Errorf("writing field posting for page %d failed: %v", result.pageID, err)
+			}
+		}
+
+		// Write term frequency and page length postings.
+		for _, posting := range generateFrequencyPostings(result.pageData.Textee, result.pageID) {
+			_, err = freqWriter.WriteString(posting + "\n")
+			if err != nil {
+				return fmt.Errorf("writing frequency posting for page %d failed: %v", result.pageID, err)
+			}
+		}
+		_, err = lengthWriter.WriteString(generateLengthPosting(result.pageData.Textee, result.pageID) + "\n")
+		if err != nil {
+			return fmt.Errorf("writing length posting for page %d failed: %v", result.pageID, err)
+		}
 	}
 
-	// Step 6: Flush all writers to ensure data is written to disk.
+	// Step 7: Flush all writers to ensure data is written to disk.
 	if err = cacheWriter.Flush(); err != nil {
 		return fmt.Errorf("flushing cache writer failed: %v", err)
 	}
@@ -165,18 +340,59 @@ func buildCache(dir string) (err error) {
 	if err = gemWriter.Flush(); err != nil {
 		return fmt.Errorf("flushing gematria writer failed: %v", err)
 	}
+	if err = posWriter.Flush(); err != nil {
+		return fmt.Errorf("flushing position writer failed: %v", err)
+	}
+	if err = fieldWriter.Flush(); err != nil {
+		return fmt.Errorf("flushing field writer failed: %v", err)
+	}
+	if err = freqWriter.Flush(); err != nil {
+		return fmt.Errorf("flushing frequency writer failed: %v", err)
+	}
+	if err = lengthWriter.Flush(); err != nil {
+		return fmt.Errorf("flushing length writer failed: %v", err)
+	}
+	if err = sourcesWriter.Flush(); err != nil {
+		return fmt.Errorf("flushing page sources writer failed: %v", err)
+	}
 
-	// Step 7: Build the indexes (this part remains sequential for now).
+	// Step 8: Build the indexes (this part remains sequential for now).
 	postingsFilePath := filepath.Join(*cfigs.String(kCacheDir), "word_postings.txt")
 	wordIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), wordIndexFile)
-	if err = buildIndex(postingsFilePath, wordIndexFilePath); err != nil {
+	if err = buildIndex(postingsFilePath, wordIndexFilePath, fuzzySection); err != nil {
 		return fmt.Errorf("building word index failed: %v", err)
 	}
 	gematriasFilePath := filepath.Join(*cfigs.String(kCacheDir), "gematria_postings.txt")
 	gemIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), gemIndexFile)
-	if err = buildIndex(gematriasFilePath, gemIndexFilePath); err != nil {
+	if err = buildGematriaIndex(gematriasFilePath, gemIndexFilePath); err != nil {
 		return fmt.Errorf("building gematria index failed: %v", err)
 	}
+	positionIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), positionIndexFile)
+	if err = buildPositionIndex(thePositionPostingsFilePath, positionIndexFilePath); err != nil {
+		return fmt.Errorf("building position index failed: %v", err)
+	}
+	fieldIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), fieldIndexFile)
+	if err = buildIndex(theFieldPostingsFilePath, fieldIndexFilePath); err != nil {
+		return fmt.Errorf("building field index failed: %v", err)
+	}
+	frequencyIndexFilePath := filepath.Join(*cfigs.String(kCacheDir), frequencyIndexFile)
+	if err = buildFrequencyIndex(theFrequencyPostingsFilePath, theLengthPostingsFilePath, frequencyIndexFilePath); err != nil {
+		return fmt.Errorf("building frequency index failed: %v", err)
+	}
+
+	if err = registry.save(); err != nil {
+		return fmt.Errorf("saving the page ID registry failed: %v", err)
+	}
+	pageIDs = registry
+
+	// Step 9: The base segment now holds every page and no deleted one, so the incremental segments
+	// and the tombstones are obsolete.
+	if err = os.RemoveAll(segmentsDir()); err != nil {
+		return fmt.Errorf("removing incremental segments failed: %v", err)
+	}
+	if err = os.Remove(filepath.Join(*cfigs.String(kCacheDir), tombstonesFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing tombstones failed: %v", err)
+	}
 
 	return nil
 }
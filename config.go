@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -43,6 +44,34 @@ func init() {
 	cfigs.NewInt(kWagnerFisherDCost, 1, "delete cost ; when removing a char to find a match ; increase the score by this number ; default = 1")
 	cfigs.NewInt(kWagnerFisherMaxSubs, 2, "maximum number of substitutions allowed for a word to be considered a match ; higher value = lower accurate ; lower value = higher accuracy ; min = 0; default = 2")
 	cfigs.NewInt(kHammingMaxSubs, 2, "maximum number of substitutions allowed for a word to be considered a match ; higher value = lower accuracy ; min = 1 ; default = 2")
+	cfigs.NewFloat64(kJaroThresholdFloor, 0.6, "lowest jaro threshold a request may override with ?jaro= ; keeps clients from matching the whole vocabulary")
+	cfigs.NewFloat64(kJaroThresholdCeiling, 1.0, "highest jaro threshold a request may override with ?jaro=")
+	cfigs.NewFloat64(kJaroWinklerThresholdFloor, 0.6, "lowest jaro-winkler threshold a request may override with ?jaro_winkler=")
+	cfigs.NewFloat64(kJaroWinklerThresholdCeiling, 1.0, "highest jaro-winkler threshold a request may override with ?jaro_winkler=")
+	cfigs.NewInt(kHammingMaxSubsFloor, 0, "lowest hamming max subs a request may override with ?hamming_max_subs=")
+	cfigs.NewInt(kHammingMaxSubsCeiling, 3, "highest hamming max subs a request may override with ?hamming_max_subs=")
+	cfigs.NewInt(kUkkonenMaxSubsFloor, 0, "lowest ukkonen max subs a request may override with ?ukkonen_max_subs=")
+	cfigs.NewInt(kUkkonenMaxSubsCeiling, 4, "highest ukkonen max subs a request may override with ?ukkonen_max_subs=")
+	cfigs.NewInt(kWagnerFisherMaxSubsFloor, 0, "lowest wagner-fisher max subs a request may override with ?wagner_fisher_max_subs=")
+	cfigs.NewInt(kWagnerFisherMaxSubsCeiling, 4, "highest wagner-fisher max subs a request may override with ?wagner_fisher_max_subs=")
+	cfigs.NewInt(kWildcardMaxTerms, 1024, "maximum number of vocabulary terms a single prefix or wildcard term (assassinat*, commun?st) may expand to before the query is rejected")
+	cfigs.NewInt(kRegexMaxTerms, 1024, "maximum number of vocabulary terms a /regex/ term may expand to before the query is rejected")
+	cfigs.NewString(kMetadataFields, "title,agency,date,collection,source_url", "Comma separated list of record.json fields to index for filters such as agency:cia and for facet counts")
+	cfigs.NewInt(kRegexTimeoutMs, 250, "milliseconds a /regex/ term may spend scanning the vocabulary before the query is rejected")
+	cfigs.NewBool(kMigrateIndexes, true, "rewrite index files written before the versioned index container when loading them; when disabled such files are refused and the cache must be rebuilt")
+	cfigs.NewBool(kVerifyIndexData, true, "verify the checksum of the bitmap data of every index file when loading it; dictionaries are always verified")
+	cfigs.NewInt(kSegmentMergeFactor, 4, "number of incremental index segments of about the same size the background merger combines into one; below 2 disables merging")
+	cfigs.NewFloat64(kBaseRewriteRatio, 0.2, "share of the pages in the base index that may be deleted before the background merger rewrites it without them, between 0 and 1; 0 leaves deleted pages in it until the next full rebuild")
+	cfigs.NewFloat64(kBM25K1, 1.2, "BM25 term frequency saturation for sort=bm25, a request may override it with ?k1=")
+	cfigs.NewFloat64(kBM25B, 0.75, "BM25 page length normalization for sort=bm25 between 0 and 1, a request may override it with ?b=")
+	cfigs.NewFloat64(kBM25CategoryBoost, 0, "score added per match category a page hit for sort=bm25, 0 ranks by BM25 alone; a request may override it with ?category_boost=")
+	cfigs.NewInt(kSearchTimeoutMs, 10000, "milliseconds a query may run once it holds a search slot before it returns the pages confirmed so far, flagged partial; 0 lets it run to completion")
+	cfigs.NewInt(kSearchLimit, 100, "pages a /search response holds when the request does not set ?limit=")
+	cfigs.NewInt(kSearchMaxLimit, 1000, "most pages a request may ask one /search response for with ?limit=")
+	cfigs.NewInt(kGroupBestPages, 3, "best scoring pages group=document lists for every document")
+	cfigs.NewFloat64(kGroupPageDecay, 0.5, "what each page of a document counts for in its group=document score relative to the better page before it, between 0 and 1; 0 scores a document by its best page and 1 adds up all of them")
+	cfigs.NewInt(kSnippetChars, 80, "characters of page text kept on either side of a match in its snippet, widened to whole words")
+	cfigs.NewString(kCategoryWeights, "", "Comma separated weights sort=ranked scores a match in each category by, e.g. exact/textee=10,fuzzy/jaro-winkler=3,gematria/*=0.5; unlisted categories weigh 1 and a request may override entries with ?weights=")
 
 	// CSP
 	cfigs.NewBool(kCSPEnabled, false, "Enable Content Security Policy (CSP) Enforcement")
@@ -131,5 +160,20 @@ check:
 	if len(*cfigs.String(kReaderDomain)) == 0 {
 		return errors.New("cannot omit the reader-domain configurable")
 	}
+	if _, err := configuredCategoryWeights(); err != nil {
+		return err
+	}
+	if limit, maximum := *cfigs.Int(kSearchLimit), *cfigs.Int(kSearchMaxLimit); limit < 1 || limit > maximum {
+		return fmt.Errorf("%s must be between 1 and %s (%d)", kSearchLimit, kSearchMaxLimit, maximum)
+	}
+	if bestPages := *cfigs.Int(kGroupBestPages); bestPages < 1 {
+		return fmt.Errorf("%s must be at least 1", kGroupBestPages)
+	}
+	if decay := *cfigs.Float64(kGroupPageDecay); !(decay >= 0 && decay <= 1) {
+		return fmt.Errorf("%s must be between 0 and 1", kGroupPageDecay)
+	}
+	if ratio := *cfigs.Float64(kBaseRewriteRatio); !(ratio >= 0 && ratio <= 1) {
+		return fmt.Errorf("%s must be between 0 and 1", kBaseRewriteRatio)
+	}
 	return nil
 }
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// Every index file (word_index.bin, gematria_index.bin, position_index.bin, field_index.bin) is an
+// index container. All integers are little endian.
+//
+//	offset  size  field
+//	0       4     magic "APIX"
+//	4       2     format version, currently 1
+//	6       2     reserved, zero
+//	8       4     section count n
+//	12      24*n  section table, one entry per section:
+//	                tag       4 bytes, e.g. "DATA"
+//	                offset    uint64, from the start of the file
+//	                length    uint64
+//	                checksum  uint32, CRC-32 (Castagnoli) of the section's bytes
+//	...           the sections, in the order of the table
+//
+// The sections are:
+//   - DATA: the records that a dictionary points into, Roaring Bitmaps or position blocks
+//   - DICT: the keys in ascending byte order, front coded. A uvarint count, then per key the uvarint
+//     length of the prefix it shares with the previous key, the uvarint length and bytes of the rest,
+//     and the uvarint offset (from the start of the file) and length of its record in DATA
+//   - GEMD: the gematria dictionary, a uint64 count and then per cipher and value the cipher (uint8,
+//     its position in gematriaCiphers) and the value, offset and length as uint64, see buildGematriaIndex
+//   - LENS: the length in words of every page, see encodePageLengths
+//   - FUZZ: the fuzzy candidate structures of the word index over the keys of its DICT, see
+//     encodeFuzzyIndex
+//
+// Files written before the container started with the 8-byte offset of a JSON header instead; see
+// migrateIndex.
+const (
+	containerMagic   = "APIX"
+	containerVersion = 1
+
+	containerPreambleSize = 12
+	sectionEntrySize      = 24
+
+	sectionData     = "DATA"
+	sectionDict     = "DICT"
+	sectionGematria = "GEMD"
+	sectionLengths  = "LENS"
+	sectionFuzzy    = "FUZZ"
+)
+
+// castagnoli is the CRC-32 table of the section checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errLegacyIndex is returned when an index file predates the container and needs migrateIndex
+var errLegacyIndex = errors.New("index predates the versioned container format")
+
+// containerSection is one entry of the section table
+type containerSection struct {
+	tag      string
+	offset   int64
+	length   int64
+	checksum uint32
+}
+
+// containerWriter writes the sections of an index container one after the other into a temporary
+// file, and fills in the section table and moves the file into place when it is closed
+type containerWriter struct {
+	path     string // where the container ends up, it is written to path + ".tmp" until then
+	file     *os.File
+	writer   *bufio.Writer
+	offset   int64
+	crc      hash.Hash32
+	sections []containerSection
+	count    int
+}
+
+// createContainer starts the container that Close writes to path, with room for the table of
+// sectionCount sections. Until then the file at path, which searches may still be reading, is left as
+// it is. A caller that gives up before Close calls abort.
+func createContainer(path string, sectionCount int) (*containerWriter, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create index: %w", err)
+	}
+	c := &containerWriter{path: path, file: file, writer: bufio.NewWriter(file), count: sectionCount}
+	preamble := int64(containerPreambleSize + sectionEntrySize*sectionCount)
+	if _, err := c.writer.Write(make([]byte, preamble)); err != nil {
+		c.abort()
+		return nil, fmt.Errorf("reserve section table: %w", err)
+	}
+	c.offset = preamble
+	return c, nil
+}
+
+// beginSection starts the section tag at the current offset
+func (c *containerWriter) beginSection(tag string) {
+	c.crc = crc32.New(castagnoli)
+	c.sections = append(c.sections, containerSection{tag: tag, offset: c.offset})
+}
+
+// Write appends p to the current section
+func (c *containerWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.crc.Write(p[:n])
+	c.offset += int64(n)
+	return n, err
+}
+
+// endSection records the length and checksum of the current section
+func (c *containerWriter) endSection() {
+	section := &c.sections[len(c.sections)-1]
+	section.length = c.offset - section.offset
+	section.checksum = c.crc.Sum32()
+}
+
+// abort closes and removes the temporary file of a container that won't be finished; it does nothing
+// once Close has been called
+func (c *containerWriter) abort() {
+	if c.file == nil {
+		return
+	}
+	_ = c.file.Close()
+	_ = os.Remove(c.file.Name())
+	c.file = nil
+}
+
+// Close writes the preamble and section table, syncs and closes the temporary file and renames it to
+// the path of the container. On error the temporary file is removed and the old container stays.
+func (c *containerWriter) Close() error {
+	if c.file == nil {
+		return fmt.Errorf("index %s is already closed", c.path)
+	}
+	if len(c.sections) != c.count {
+		c.abort()
+		return fmt.Errorf("wrote %d sections, reserved %d", len(c.sections), c.count)
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.abort()
+		return fmt.Errorf("flush index: %w", err)
+	}
+	preamble := make([]byte, 0, containerPreambleSize+sectionEntrySize*len(c.sections))
+	preamble = append(preamble, containerMagic...)
+	preamble = binary.LittleEndian.AppendUint16(preamble, containerVersion)
+	preamble = binary.LittleEndian.AppendUint16(preamble, 0)
+	preamble = binary.LittleEndian.AppendUint32(preamble, uint32(len(c.sections)))
+	for _, section := range c.sections {
+		preamble = append(preamble, section.tag...)
+		preamble = binary.LittleEndian.AppendUint64(preamble, uint64(section.offset))
+		preamble = binary.LittleEndian.AppendUint64(preamble, uint64(section.length))
+		preamble = binary.LittleEndian.AppendUint32(preamble, section.checksum)
+	}
+	if _, err := c.file.WriteAt(preamble, 0); err != nil {
+		c.abort()
+		return fmt.Errorf("write section table: %w", err)
+	}
+	if err := c.file.Sync(); err != nil {
+		c.abort()
+		return fmt.Errorf("sync index: %w", err)
+	}
+	file := c.file
+	c.file = nil
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("close index: %w", err)
+	}
+	if err := os.Rename(file.Name(), c.path); err != nil {
+		_ = os.Remove(file.Name())
+		return fmt.Errorf("replace index: %w", err)
+	}
+	return nil
+}
+
+// readContainer reads the section table of the index container in file. It returns errLegacyIndex
+// for a file written before the container and refuses a version newer than this build reads.
+func readContainer(file io.ReaderAt, size int64) (map[string]containerSection, error) {
+	var preamble [containerPreambleSize]byte
+	if _, err := file.ReadAt(preamble[:], 0); err != nil {
+		if size >= 8 {
+			return nil, errLegacyIndex // too short for a container but not for the 8-byte header offset
+		}
+		return nil, fmt.Errorf("read preamble: %w", err)
+	}
+	if string(preamble[:4]) != containerMagic {
+		return nil, errLegacyIndex
+	}
+	if version := binary.LittleEndian.Uint16(preamble[4:]); version != containerVersion {
+		return nil, fmt.Errorf("index format version %d is not supported, this build reads version %d; rebuild the cache", version, containerVersion)
+	}
+	count := int64(binary.LittleEndian.Uint32(preamble[8:]))
+	if containerPreambleSize+count*sectionEntrySize > size {
+		return nil, fmt.Errorf("section table of %d entries is outside of the %d byte file", count, size)
+	}
+	table := make([]byte, count*sectionEntrySize)
+	if _, err := file.ReadAt(table, containerPreambleSize); err != nil {
+		return nil, fmt.Errorf("read section table: %w", err)
+	}
+	sections := make(map[string]containerSection, count)
+	for i := int64(0); i < count; i++ {
+		entry := table[i*sectionEntrySize:]
+		section := containerSection{
+			tag:      string(entry[:4]),
+			offset:   int64(binary.LittleEndian.Uint64(entry[4:])),
+			length:   int64(binary.LittleEndian.Uint64(entry[12:])),
+			checksum: binary.LittleEndian.Uint32(entry[20:]),
+		}
+		if section.offset < 0 || section.length < 0 || section.offset+section.length > size {
+			return nil, fmt.Errorf("section %s is outside of the %d byte file", section.tag, size)
+		}
+		sections[section.tag] = section
+	}
+	return sections, nil
+}
+
+// readSection reads the section tag whole and verifies its checksum
+func readSection(file io.ReaderAt, sections map[string]containerSection, tag string) ([]byte, error) {
+	section, ok := sections[tag]
+	if !ok {
+		return nil, fmt.Errorf("index has no %s section", tag)
+	}
+	data := make([]byte, section.length)
+	if _, err := file.ReadAt(data, section.offset); err != nil {
+		return nil, fmt.Errorf("read %s section: %w", tag, err)
+	}
+	if crc32.Checksum(data, castagnoli) != section.checksum {
+		return nil, fmt.Errorf("%s section fails its checksum", tag)
+	}
+	return data, nil
+}
+
+// verifySection streams the section tag through its checksum without holding it in memory
+func verifySection(file io.ReaderAt, sections map[string]containerSection, tag string) error {
+	section, ok := sections[tag]
+	if !ok {
+		return fmt.Errorf("index has no %s section", tag)
+	}
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(crc, io.NewSectionReader(file, section.offset, section.length)); err != nil {
+		return fmt.Errorf("read %s section: %w", tag, err)
+	}
+	if crc.Sum32() != section.checksum {
+		return fmt.Errorf("%s section fails its checksum", tag)
+	}
+	return nil
+}
+
+// rawSection is a section that is written whole: data, or when derive is set what it returns for the
+// keys of the DICT section
+type rawSection struct {
+	tag    string
+	data   []byte
+	derive func(keys []string) []byte
+}
+
+// dictEntry is one key of a DICT section and the [offset, length] of its record
+type dictEntry struct {
+	key       string
+	offsetLen [2]int64
+}
+
+// encodeDict front codes entries, which must be sorted by key, into a DICT section
+func encodeDict(entries []dictEntry) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(entries)))
+	previous := ""
+	for _, entry := range entries {
+		shared := 0
+		for shared < len(previous) && shared < len(entry.key) && previous[shared] == entry.key[shared] {
+			shared++
+		}
+		buf = binary.AppendUvarint(buf, uint64(shared))
+		buf = binary.AppendUvarint(buf, uint64(len(entry.key)-shared))
+		buf = append(buf, entry.key[shared:]...)
+		buf = binary.AppendUvarint(buf, uint64(entry.offsetLen[0]))
+		buf = binary.AppendUvarint(buf, uint64(entry.offsetLen[1]))
+		previous = entry.key
+	}
+	return buf
+}
+
+// decodeDict decodes a DICT section into a header map and the sorted list of its keys
+func decodeDict(data []byte) (map[string][2]int64, []string, error) {
+	errCorrupt := errors.New("DICT section is corrupt")
+	next := func() (uint64, bool) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, false
+		}
+		data = data[n:]
+		return value, true
+	}
+	count, ok := next()
+	if !ok || count > uint64(len(data)) {
+		return nil, nil, errCorrupt
+	}
+	header := make(map[string][2]int64, count)
+	terms := make([]string, 0, count)
+	previous := ""
+	for i := uint64(0); i < count; i++ {
+		shared, ok1 := next()
+		suffix, ok2 := next()
+		if !ok1 || !ok2 || shared > uint64(len(previous)) || suffix > uint64(len(data)) {
+			return nil, nil, errCorrupt
+		}
+		key := previous[:shared] + string(data[:suffix])
+		data = data[suffix:]
+		offset, ok1 := next()
+		length, ok2 := next()
+		if !ok1 || !ok2 {
+			return nil, nil, errCorrupt
+		}
+		if i > 0 && key <= previous {
+			return nil, nil, fmt.Errorf("DICT section is not sorted at %q", key)
+		}
+		header[key] = [2]int64{int64(offset), int64(length)}
+		terms = append(terms, key)
+		previous = key
+	}
+	return header, terms, nil
+}
+
+// writeRecordIndex writes an index container whose DATA section holds the record of every key in keys,
+// produced by record, and whose DICT section points at them; a key whose record is nil is left out.
+// The extra sections follow DICT. buildIndex, buildIndexUnlimited, buildPositionIndex and
+// buildFrequencyIndex all write through it, so every keyed index shares one layout.
+func writeRecordIndex(indexFile string, keys []string, record func(key string) ([]byte, error), extra ...rawSection) error {
+	sort.Strings(keys)
+	c, err := createContainer(indexFile, 2+len(extra))
+	if err != nil {
+		return err
+	}
+	defer c.abort()
+
+	entries := make([]dictEntry, 0, len(keys))
+	c.beginSection(sectionData)
+	for _, key := range keys {
+		data, err := record(key)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		offset := c.offset
+		if _, err := c.Write(data); err != nil {
+			return fmt.Errorf("write record %s: %w", key, err)
+		}
+		entries = append(entries, dictEntry{key: key, offsetLen: [2]int64{offset, int64(len(data))}})
+	}
+	c.endSection()
+
+	c.beginSection(sectionDict)
+	if _, err := c.Write(encodeDict(entries)); err != nil {
+		return fmt.Errorf("write dictionary: %w", err)
+	}
+	c.endSection()
+	for _, section := range extra {
+		data := section.data
+		if section.derive != nil {
+			written := make([]string, len(entries))
+			for i, entry := range entries {
+				written[i] = entry.key
+			}
+			data = section.derive(written)
+		}
+		c.beginSection(section.tag)
+		if _, err := c.Write(data); err != nil {
+			return fmt.Errorf("write %s section: %w", section.tag, err)
+		}
+		c.endSection()
+	}
+	return c.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// prefixRange returns the sub-slice of the sorted terms that start with prefix
+func prefixRange(terms []string, prefix string) []string {
+	start := sort.SearchStrings(terms, prefix)
+	end := start
+	for end < len(terms) && strings.HasPrefix(terms[end], prefix) {
+		end++
+	}
+	return terms[start:end]
+}
+
+// isWildcard reports whether a term uses the glob characters * or ?
+func isWildcard(term string) bool {
+	return strings.ContainsAny(term, "*?")
+}
+
+// errTooManyTerms is returned when a wildcard or regular expression matches more vocabulary terms than allowed
+type errTooManyTerms struct {
+	limit int
+}
+
+func (e errTooManyTerms) Error() string {
+	return fmt.Sprintf("matches more than %d terms, make it more specific", e.limit)
+}
+
+// expandWildcard returns the terms of the sorted dictionary matching pattern. Only the part of
+// the dictionary that shares the literal prefix of pattern is scanned, and an errTooManyTerms
+// is returned when more than limit terms match.
+func expandWildcard(terms []string, pattern string, limit int) ([]string, error) {
+	prefix := pattern[:strings.IndexAny(pattern, "*?")]
+	var matched []string
+	for _, term := range prefixRange(terms, prefix) {
+		if !globMatch(pattern, term) {
+			continue
+		}
+		if len(matched) == limit {
+			return nil, errTooManyTerms{limit: limit}
+		}
+		matched = append(matched, term)
+	}
+	return matched, nil
+}
+
+// errRegexTimeout is returned when expanding a regular expression exceeds its time budget
+type errRegexTimeout struct {
+	budget time.Duration
+}
+
+func (e errRegexTimeout) Error() string {
+	return fmt.Sprintf("took longer than %v to expand, make it more specific", e.budget)
+}
+
+// expandRegex returns the terms of the sorted dictionary that re matches. re must be anchored
+// with ^ so that its literal prefix narrows the scan to one range of the dictionary. The scan
+// gives up with errTooManyTerms after limit matches and with errRegexTimeout once budget elapses.
+func expandRegex(terms []string, re *regexp.Regexp, limit int, budget time.Duration) ([]string, error) {
+	prefix, _ := re.LiteralPrefix()
+	deadline := time.Now().Add(budget)
+	var matched []string
+	for i, term := range prefixRange(terms, prefix) {
+		if i%256 == 0 && time.Now().After(deadline) {
+			return nil, errRegexTimeout{budget: budget}
+		}
+		if !re.MatchString(term) {
+			continue
+		}
+		if len(matched) == limit {
+			return nil, errTooManyTerms{limit: limit}
+		}
+		matched = append(matched, term)
+	}
+	return matched, nil
+}
+
+// globMatch reports whether s matches pattern, where * matches any run of characters and ?
+// matches a single character. Neither matches a space, so a wildcard stays within one word.
+func globMatch(pattern, s string) bool {
+	p, t := []rune(pattern), []rune(s)
+	pi, ti := 0, 0
+	star, mark := -1, 0
+	for ti < len(t) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ti
+			pi++
+		case pi < len(p) && (p[pi] == t[ti] || (p[pi] == '?' && t[ti] != ' ')):
+			pi++
+			ti++
+		case star >= 0 && t[mark] != ' ':
+			mark++
+			pi, ti = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/gin-gonic/gin"
+)
+
+// ExplainNode is a node of the parse tree as /search/explain shows it
+type ExplainNode struct {
+	Type     string        `json:"type"`     // and, or, not, term, phrase, near, wildcard, regex, field or gematria
+	Text     string        `json:"text"`     // the node written back as query syntax
+	Position int           `json:"position"` // character position of the node in the query
+	Children []ExplainNode `json:"children,omitempty"`
+}
+
+// ClauseTrace is what evaluating one clause of a query looked up and found
+type ClauseTrace struct {
+	Clause       string              `json:"clause"`
+	Type         string              `json:"type"`
+	Cardinality  uint64              `json:"cardinality"`          // live pages the clause matched, within the result so far for phrases and proximity
+	Milliseconds float64             `json:"ms"`                   // time spent evaluating the clause, its children included
+	Expansions   map[string][]string `json:"expansions,omitempty"` // exact, a fuzzy algorithm, wildcard or regex -> vocabulary terms matched through it
+	Gematria     []GematriaKeyTrace  `json:"gematria,omitempty"`   // gematria index keys that held pages
+}
+
+// GematriaKeyTrace is one value of a cipher that a clause found in the gematria index
+type GematriaKeyTrace struct {
+	Cipher string `json:"cipher"`
+	Value  uint64 `json:"value"`
+	Pages  uint64 `json:"pages"` // live pages holding a word of that value
+}
+
+// PhaseTiming is the time a search spent in one of its phases: parse, evaluate and score
+type PhaseTiming struct {
+	Phase        string  `json:"phase"`
+	Milliseconds float64 `json:"ms"`
+}
+
+// milliseconds renders d for the explain output
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// nodeType names the kind of a query node
+func nodeType(node QueryNode) string {
+	switch node.(type) {
+	case *AndNode:
+		return "and"
+	case *OrNode:
+		return "or"
+	case *NotNode:
+		return "not"
+	case *TermNode:
+		return "term"
+	case *PhraseNode:
+		return "phrase"
+	case *NearNode:
+		return "near"
+	case *WildcardNode:
+		return "wildcard"
+	case *RegexNode:
+		return "regex"
+	case *FieldNode:
+		return "field"
+	case *GematriaNode:
+		return "gematria"
+	}
+	return "unknown"
+}
+
+// describeNode renders the parse tree below node
+func describeNode(node QueryNode) ExplainNode {
+	described := ExplainNode{Type: nodeType(node), Text: node.String(), Position: node.Pos()}
+	var children []QueryNode
+	switch n := node.(type) {
+	case *AndNode:
+		children = n.Children
+	case *OrNode:
+		children = n.Children
+	case *NotNode:
+		children = []QueryNode{n.Child}
+	case *NearNode:
+		children = []QueryNode{n.Left, n.Right}
+	}
+	for _, child := range children {
+		described.Children = append(described.Children, describeNode(child))
+	}
+	return described
+}
+
+// traceExpansion records that the clause being evaluated matched the vocabulary term through kind
+func (e *queryEvaluator) traceExpansion(kind, term string) {
+	if e.current == nil {
+		return
+	}
+	if e.current.Expansions == nil {
+		e.current.Expansions = make(map[string][]string)
+	}
+	e.current.Expansions[kind] = append(e.current.Expansions[kind], term)
+}
+
+// traceGematria records every value of cipher within [min, max] that holds live pages on the clause
+// being evaluated. It reads the postings a second time, which only an explained search pays for.
+func (e *queryEvaluator) traceGematria(cipher string, min, max uint64) {
+	if e.current == nil {
+		return
+	}
+	pages := make(map[uint64]*roaring.Bitmap)
+	var values []uint64
+	for _, s := range e.index.segments {
+		for _, posting := range s.gematriaLookup.valuesIn(cipher, min, max) {
+			b, err := s.gematria.Bitmap(posting.offsetLen)
+			if err != nil {
+				errorLogger.Printf("Read error for %s_%d: %v", cipher, posting.value, err)
+				continue
+			}
+			if _, seen := pages[posting.value]; !seen {
+				pages[posting.value] = roaring.New()
+				values = append(values, posting.value)
+			}
+			pages[posting.value].Or(b)
+		}
+	}
+	for _, value := range values {
+		if live := roaring.AndNot(pages[value], e.index.deleted).GetCardinality(); live > 0 {
+			e.current.Gematria = append(e.current.Gematria, GematriaKeyTrace{Cipher: cipher, Value: value, Pages: live})
+		}
+	}
+}
+
+// handleSearchExplain answers /search/explain?q= with how a query was understood and evaluated: the
+// parse tree, the plan, what every clause expanded to and matched, and the time spent in each phase.
+// It takes the same matcher, threshold and filter parameters as /search.
+func handleSearchExplain(c *gin.Context) {
+	query, opts, release, ok := searchRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+	opts.Explain = true
+	results, err := search(c.Request.Context(), query, opts)
+	if err != nil {
+		respondSearchError(c, query, err)
+		return
+	}
+	categories := make(map[string]int, len(results.Categories))
+	for category, pages := range results.Categories {
+		categories[category] = len(pages)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":      query,
+		"tree":       describeNode(results.Tree),
+		"plan":       results.Plan,
+		"clauses":    results.Clauses,
+		"timings":    results.Timings,
+		"pages":      results.Pages.GetCardinality(),
+		"categories": categories,
+		"partial":    results.Partial,
+	})
+}
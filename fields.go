@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/gin-gonic/gin"
+)
+
+// identifierFields are the identifier fields of PageData that a query can be restricted to, either in
+// the query itself (doc:<id>, exclude_doc:<id>) or through the query parameters of the same name
+var identifierFields = []string{"doc", "page", "cover"}
+
+// excludePrefix turns a field filter into its negation, e.g. exclude_doc:<id>
+const excludePrefix = "exclude_"
+
+// metadataFields returns the record.json fields configured with kMetadataFields, e.g. agency and collection,
+// lowercased because that is how they are written in a filter such as agency:cia
+func metadataFields() []string {
+	var fields []string
+	// parse the flag/config CSV values and sanitize the string
+	for _, field := range strings.Split(*cfigs.String(kMetadataFields), ",") {
+		field = strings.ToLower(strings.ReplaceAll(field, " ", ""))
+		if len(field) > 0 && !isIdentifierField(field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// filterFields returns every field that a query can be restricted to
+func filterFields() []string {
+	return append(append([]string{}, identifierFields...), metadataFields()...)
+}
+
+func isIdentifierField(field string) bool {
+	for _, known := range identifierFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeFieldValue lowercases value and collapses its whitespace, which is how field values are keyed
+func normalizeFieldValue(value string) string {
+	return strings.Join(strings.Fields(strings.ToLower(value)), " ")
+}
+
+// fieldKey is the key of a field value in field_index.bin
+func fieldKey(field, value string) string {
+	return field + ":" + normalizeFieldValue(value)
+}
+
+// recordMetadata extracts the configured metadataFields from a parsed record.json. Strings, numbers
+// and booleans become a single value and lists become one value per scalar element.
+func recordMetadata(record map[string]interface{}) map[string][]string {
+	metadata := make(map[string][]string)
+	for key, raw := range record {
+		field := strings.ToLower(key)
+		wanted := false
+		for _, configured := range metadataFields() {
+			if field == configured {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			continue
+		}
+		items, isList := raw.([]interface{})
+		if !isList {
+			items = []interface{}{raw}
+		}
+		for _, item := range items {
+			var value string
+			switch v := item.(type) {
+			case string:
+				value = v
+			case float64:
+				value = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				value = strconv.FormatBool(v)
+			}
+			if normalizeFieldValue(value) != "" {
+				metadata[field] = append(metadata[field], value)
+			}
+		}
+	}
+	return metadata
+}
+
+// generateFieldPostings generates the field postings of a page in the "key pageID" format of buildIndex,
+// e.g. "doc:abc123 42" or "agency:cia 42", so that a query can narrow its candidates before scoring
+func generateFieldPostings(pageData *PageData, pageID int) []string {
+	values := map[string][]string{
+		"doc":   {pageData.DocumentIdentifier},
+		"page":  {pageData.PageIdentifier},
+		"cover": {pageData.CoverPageIdentifier},
+	}
+	for field, fieldValues := range pageData.Metadata {
+		values[field] = fieldValues
+	}
+	var postings []string
+	for _, field := range filterFields() {
+		for _, value := range values[field] {
+			if normalizeFieldValue(value) == "" {
+				continue
+			}
+			postings = append(postings, fieldKey(field, value)+" "+strconv.Itoa(pageID))
+		}
+	}
+	return postings
+}
+
+// parseFieldFilter splits a query word such as doc:abc123, agency:cia or exclude_doc:abc123 into its
+// field and value. The value may be empty when it follows as a quoted phrase, e.g. agency:"central intelligence"
+func parseFieldFilter(word string) (field, value string, exclude, ok bool) {
+	field, value, found := strings.Cut(word, ":")
+	if !found {
+		return "", "", false, false
+	}
+	field, exclude = strings.CutPrefix(field, excludePrefix)
+	for _, known := range filterFields() {
+		if field == known {
+			return field, value, exclude, true
+		}
+	}
+	return "", "", false, false
+}
+
+// fieldFilterNode builds the query node of a field filter, wrapping it in a NotNode when it excludes
+func fieldFilterNode(field, value string, exclude bool, at int) QueryNode {
+	node := QueryNode(&FieldNode{Field: field, Value: normalizeFieldValue(value), At: at})
+	if exclude {
+		return &NotNode{Child: node, At: at}
+	}
+	return node
+}
+
+// fieldFiltersFromRequest reads a query parameter for every filter field and its exclude_ variant,
+// e.g. /search?q=oswald&doc=abc123&agency=cia, into filter nodes that search() ANDs onto the parsed query
+func fieldFiltersFromRequest(c *gin.Context) []QueryNode {
+	var filters []QueryNode
+	for _, field := range filterFields() {
+		for _, value := range c.QueryArray(field) {
+			if normalizeFieldValue(value) != "" {
+				filters = append(filters, fieldFilterNode(field, value, false, 0))
+			}
+		}
+		for _, value := range c.QueryArray(excludePrefix + field) {
+			if normalizeFieldValue(value) != "" {
+				filters = append(filters, fieldFilterNode(field, value, true, 0))
+			}
+		}
+	}
+	return filters
+}
+
+// fieldBitmap returns the pages whose field holds value
+func (idx *indexSnapshot) fieldBitmap(field, value string) *roaring.Bitmap {
+	key := fieldKey(field, value)
+	result := roaring.New()
+	for _, s := range idx.segments {
+		b, err := s.field.KeyBitmap(key)
+		if err != nil {
+			errorLogger.Printf("Read error for %s: %v", key, err)
+			continue
+		}
+		result.Or(b)
+	}
+	return result
+}
+
+// facetCounts counts, for each of fields, how many of the pages hold each value of that field, e.g.
+// {"agency": {"cia": 12, "fbi": 3}}. Values that none of the pages hold are left out.
+func (idx *indexSnapshot) facetCounts(fields []string, pages *roaring.Bitmap) map[string]map[string]uint64 {
+	facets := make(map[string]map[string]uint64, len(fields))
+	for _, field := range fields {
+		counts := make(map[string]uint64)
+		prefix := field + ":"
+		for _, s := range idx.segments {
+			for _, key := range prefixRange(s.field.Terms, prefix) {
+				b, err := s.field.KeyBitmap(key)
+				if err != nil {
+					errorLogger.Printf("Read error for %s: %v", key, err)
+					continue
+				}
+				if n := b.AndCardinality(pages); n > 0 {
+					counts[strings.TrimPrefix(key, prefix)] += n // segments never share a page
+				}
+			}
+		}
+		facets[field] = counts
+	}
+	return facets
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/andreimerlescu/textee"
+)
+
+// pageFrequency is the number of times one term occurs on one page
+type pageFrequency struct {
+	pageID uint32
+	count  uint32
+}
+
+// generateFrequencyPostings generates term frequency postings for a given Textee and page ID. Each posting
+// has the format "term pageID count", where term is a Textee substring that may itself contain spaces.
+func generateFrequencyPostings(text *textee.Textee, pageID int) []string {
+	postings := make([]string, 0, len(text.Substrings))
+	for substring, count := range text.Substrings {
+		if count == nil || count.Load() <= 0 {
+			continue
+		}
+		postings = append(postings, substring+" "+strconv.Itoa(pageID)+" "+strconv.Itoa(int(count.Load())))
+	}
+	return postings
+}
+
+// generateLengthPosting generates the "pageID length" posting of a page, its length in words split the
+// same way as its positions
+func generateLengthPosting(text *textee.Textee, pageID int) string {
+	return strconv.Itoa(pageID) + " " + strconv.Itoa(len(normalizeWords(text.Input)))
+}
+
+// buildFrequencyIndex constructs the term frequency index from frequency_postings.txt and
+// length_postings.txt and writes it to frequency_index.bin. It is an index container (see container.go):
+//   - A DATA section where each term has one block of uvarints:
+//     pageCount, then for each page in ascending order: pageID delta, count
+//   - A DICT section mapping each term to the [offset, length] pair of its block
+//   - A LENS section holding the length of every page, see encodePageLengths
+func buildFrequencyIndex(frequencyPostingsFile, lengthPostingsFile, indexFile string) error {
+	inFile, err := os.Open(frequencyPostingsFile)
+	if err != nil {
+		return fmt.Errorf("open postings: %w", err)
+	}
+	defer inFile.Close()
+
+	termToPages := make(map[string][]pageFrequency)
+	scanner := bufio.NewScanner(inFile)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 3 {
+			continue // Skip invalid lines
+		}
+		pageID, err1 := strconv.Atoi(parts[len(parts)-2])
+		count, err2 := strconv.Atoi(parts[len(parts)-1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		term := strings.Join(parts[:len(parts)-2], " ")
+		termToPages[term] = append(termToPages[term], pageFrequency{pageID: uint32(pageID), count: uint32(count)})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan postings: %w", err)
+	}
+
+	lengths, err := readLengthPostings(lengthPostingsFile)
+	if err != nil {
+		return err
+	}
+
+	terms := make([]string, 0, len(termToPages))
+	for term := range termToPages {
+		terms = append(terms, term)
+	}
+	return writeRecordIndex(indexFile, terms, func(term string) ([]byte, error) {
+		return encodeFrequencies(termToPages[term]), nil
+	}, rawSection{tag: sectionLengths, data: encodePageLengths(lengths)})
+}
+
+// readLengthPostings reads the page lengths of length_postings.txt
+func readLengthPostings(lengthPostingsFile string) (*pageLengths, error) {
+	inFile, err := os.Open(lengthPostingsFile)
+	if err != nil {
+		return nil, fmt.Errorf("open length postings: %w", err)
+	}
+	defer inFile.Close()
+
+	lengths := &pageLengths{}
+	scanner := bufio.NewScanner(inFile)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 2 {
+			continue // Skip invalid lines
+		}
+		pageID, err1 := strconv.Atoi(parts[0])
+		length, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		lengths.add(uint32(pageID), uint32(length))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan length postings: %w", err)
+	}
+	return lengths, nil
+}
+
+// encodeFrequencies serializes the counts of one term across pages into a block of uvarints
+func encodeFrequencies(pages []pageFrequency) []byte {
+	sort.Slice(pages, func(i, j int) bool { return pages[i].pageID < pages[j].pageID })
+	buf := binary.AppendUvarint(nil, uint64(len(pages)))
+	previous := uint32(0)
+	for _, page := range pages {
+		buf = binary.AppendUvarint(buf, uint64(page.pageID-previous))
+		buf = binary.AppendUvarint(buf, uint64(page.count))
+		previous = page.pageID
+	}
+	return buf
+}
+
+// decodeFrequencies deserializes a block written by encodeFrequencies, keeping only the pages in
+// candidates (all pages when candidates is nil)
+func decodeFrequencies(data []byte, candidates *roaring.Bitmap) ([]pageFrequency, error) {
+	errCorrupt := errors.New("corrupt frequency block")
+	pageCount, n := binary.Uvarint(data)
+	if n <= 0 || pageCount > uint64(len(data)) {
+		return nil, errCorrupt
+	}
+	data = data[n:]
+	var pages []pageFrequency
+	pageID := uint64(0)
+	for i := uint64(0); i < pageCount; i++ {
+		delta, n1 := binary.Uvarint(data)
+		if n1 <= 0 {
+			return nil, errCorrupt
+		}
+		count, n2 := binary.Uvarint(data[n1:])
+		if n2 <= 0 {
+			return nil, errCorrupt
+		}
+		data = data[n1+n2:]
+		pageID += delta
+		if candidates == nil || candidates.Contains(uint32(pageID)) {
+			pages = append(pages, pageFrequency{pageID: uint32(pageID), count: uint32(count)})
+		}
+	}
+	return pages, nil
+}
+
+// pageLengths holds the length in words of every page of a segment, sorted by page ID
+type pageLengths struct {
+	ids     []uint32
+	lengths []uint32
+	total   uint64
+}
+
+// add appends the length of a page, pages may come in any order until the lengths are sorted
+func (l *pageLengths) add(pageID, length uint32) {
+	l.ids = append(l.ids, pageID)
+	l.lengths = append(l.lengths, length)
+	l.total += uint64(length)
+}
+
+// length returns the length of pageID
+func (l *pageLengths) length(pageID uint32) (uint32, bool) {
+	i := sort.Search(len(l.ids), func(i int) bool { return l.ids[i] >= pageID })
+	if i == len(l.ids) || l.ids[i] != pageID {
+		return 0, false
+	}
+	return l.lengths[i], true
+}
+
+// sortByPage orders the lengths by page ID
+func (l *pageLengths) sortByPage() {
+	order := make([]int, len(l.ids))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return l.ids[order[i]] < l.ids[order[j]] })
+	ids := make([]uint32, len(order))
+	lengths := make([]uint32, len(order))
+	for i, j := range order {
+		ids[i], lengths[i] = l.ids[j], l.lengths[j]
+	}
+	l.ids, l.lengths = ids, lengths
+}
+
+// encodePageLengths serializes a LENS section: a uvarint count, then per page in ascending order the
+// uvarint page ID delta and length
+func encodePageLengths(l *pageLengths) []byte {
+	l.sortByPage()
+	buf := binary.AppendUvarint(nil, uint64(len(l.ids)))
+	previous := uint32(0)
+	for i, pageID := range l.ids {
+		buf = binary.AppendUvarint(buf, uint64(pageID-previous))
+		buf = binary.AppendUvarint(buf, uint64(l.lengths[i]))
+		previous = pageID
+	}
+	return buf
+}
+
+// decodePageLengths deserializes a LENS section
+func decodePageLengths(data []byte) (*pageLengths, error) {
+	errCorrupt := errors.New("LENS section is corrupt")
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, errCorrupt
+	}
+	data = data[n:]
+	l := &pageLengths{ids: make([]uint32, 0, count), lengths: make([]uint32, 0, count)}
+	pageID := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		delta, n1 := binary.Uvarint(data)
+		if n1 <= 0 {
+			return nil, errCorrupt
+		}
+		length, n2 := binary.Uvarint(data[n1:])
+		if n2 <= 0 {
+			return nil, errCorrupt
+		}
+		data = data[n1+n2:]
+		pageID += delta
+		l.add(uint32(pageID), uint32(length))
+	}
+	return l, nil
+}
+
+// OpenFrequencyIndex opens frequency_index.bin with its dictionary and decodes its LENS section
+func OpenFrequencyIndex(path string) (*IndexReader, *pageLengths, error) {
+	reader, sections, err := openDictReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readSection(reader.file, sections, sectionLengths)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	lengths, err := decodePageLengths(data)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader, lengths, nil
+}
+
+// mergeFrequencyBlocks combines the frequency blocks of one term from segments with disjoint pages
+// without the deleted pages, returning nil when no page is left
+func mergeFrequencyBlocks(records [][]byte, deleted *roaring.Bitmap) ([]byte, error) {
+	var pages []pageFrequency
+	for _, data := range records {
+		decoded, err := decodeFrequencies(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range decoded {
+			if !deleted.Contains(page.pageID) {
+				pages = append(pages, page)
+			}
+		}
+	}
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return encodeFrequencies(pages), nil
+}
+
+// mergePageLengths combines the page lengths of sources without the deleted pages
+func mergePageLengths(sources []*segment, deleted *roaring.Bitmap) *pageLengths {
+	merged := &pageLengths{}
+	for _, s := range sources {
+		for i, pageID := range s.lengths.ids {
+			if !deleted.Contains(pageID) {
+				merged.add(pageID, s.lengths.lengths[i])
+			}
+		}
+	}
+	return merged
+}
+
+// BM25Params tune the Okapi BM25 ranking of sort=bm25
+type BM25Params struct {
+	K1            float64 // term frequency saturation, 0 ignores how often a term occurs
+	B             float64 // length normalization, 0 ignores page length and 1 normalizes fully
+	CategoryBoost float64 // added to the score once for every match category a page hit
+}
+
+// bm25Params reads the configured BM25 parameters
+func bm25Params() BM25Params {
+	return BM25Params{
+		K1:            *cfigs.Float64(kBM25K1),
+		B:             *cfigs.Float64(kBM25B),
+		CategoryBoost: *cfigs.Float64(kBM25CategoryBoost),
+	}
+}
+
+// validate refuses parameters that BM25 isn't defined for
+func (p BM25Params) validate() error {
+	if math.IsNaN(p.K1) || p.K1 < 0 {
+		return fmt.Errorf("k1 must be zero or more")
+	}
+	if math.IsNaN(p.B) || p.B < 0 || p.B > 1 {
+		return fmt.Errorf("b must be between 0 and 1")
+	}
+	if math.IsNaN(p.CategoryBoost) || p.CategoryBoost < 0 {
+		return fmt.Errorf("category_boost must be zero or more")
+	}
+	return nil
+}
+
+// bm25Terms returns the index terms that the leaves of a query are scored by: each term, and each phrase
+// short enough for Textee to have counted it as one substring or else each of its words. Wildcards,
+// regular expressions and gematria ranges only score through the category boost.
+func bm25Terms(leaves []QueryNode) []string {
+	var terms []string
+	for _, leaf := range leaves {
+		switch n := leaf.(type) {
+		case *TermNode:
+			terms = append(terms, n.Text)
+		case *PhraseNode:
+			if len(n.Words) <= texteeMaxWords {
+				terms = append(terms, strings.Join(n.Words, " "))
+			} else {
+				terms = append(terms, n.Words...)
+			}
+		}
+	}
+	return terms
+}
+
+// bm25Scores scores every page in pages by Okapi BM25 over terms:
+//
+//	score = Σ idf(t) · tf·(k1+1) / (tf + k1·(1 − b + b·len/avglen))
+//	idf(t) = ln(1 + (N − df + 0.5) / (df + 0.5))
+//
+// where N is the number of live pages, df the number of live pages holding t, tf the number of times t
+// occurs on the page and len the length of the page in words. When ctx runs out of time the scores of
+// the terms done so far are returned with context.DeadlineExceeded.
+func (idx *indexSnapshot) bm25Scores(ctx context.Context, terms []string, pages *roaring.Bitmap, params BM25Params) (map[uint32]float64, error) {
+	scores := make(map[uint32]float64, pages.GetCardinality())
+	total := float64(idx.allPageIDs.GetCardinality())
+	if total == 0 {
+		return scores, nil
+	}
+	averageLength := float64(idx.totalLength) / total
+	if averageLength == 0 {
+		averageLength = 1
+	}
+	for _, term := range terms {
+		if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+			return scores, err
+		} else if err != nil {
+			return nil, err
+		}
+		var frequencies []pageFrequency
+		documentFrequency := uint64(0)
+		for _, s := range idx.segments {
+			offsetLen, ok := s.frequency.Header[term]
+			if !ok {
+				continue
+			}
+			data, err := s.frequency.Read(offsetLen)
+			if err != nil {
+				return nil, fmt.Errorf("read frequencies of %s: %w", term, err)
+			}
+			all, err := decodeFrequencies(data, nil)
+			if err != nil {
+				return nil, fmt.Errorf("decode frequencies of %s: %w", term, err)
+			}
+			for _, page := range all {
+				if !idx.allPageIDs.Contains(page.pageID) {
+					continue
+				}
+				documentFrequency++
+				if pages.Contains(page.pageID) {
+					frequencies = append(frequencies, page)
+				}
+			}
+		}
+		df := float64(documentFrequency)
+		idf := math.Log(1 + (total-df+0.5)/(df+0.5))
+		for _, page := range frequencies {
+			length := averageLength
+			for _, s := range idx.segments {
+				if l, ok := s.lengths.length(page.pageID); ok {
+					length = float64(l)
+					break
+				}
+			}
+			tf := float64(page.count)
+			scores[page.pageID] += idf * tf * (params.K1 + 1) / (tf + params.K1*(1-params.B+params.B*length/averageLength))
+		}
+	}
+	return scores, nil
+}
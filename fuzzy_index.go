@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/xrash/smetrics"
+)
+
+// fuzzyIndex shortlists the vocabulary terms that can possibly match a query word under one of the fuzzy
+// algorithms, so that matchesConditionSingle only runs on those instead of on the whole vocabulary:
+//   - soundex: terms grouped by their soundex code, the shortlist is exactly the matches
+//   - hamming: terms grouped by byte length, since words of different lengths never match
+//   - ukkonen and wagner-fisher: a BK-tree on Levenshtein distance, searched within the radius that the
+//     edit costs and max subs allow
+//   - jaro and jaro-winkler: per term length, the terms holding enough of the bytes or padded bigrams of
+//     the query word, found through an inverted index of those grams and filtered by an upper bound of
+//     the similarity computed from the bytes the two words share, see jaroCandidates
+//
+// buildIndex and the segment merger store it in the FUZZ section of word_index.bin, see
+// encodeFuzzyIndex, so that loading a segment only decodes it. Terms are referred to by their ordinal
+// in the sorted dictionary.
+type fuzzyIndex struct {
+	terms    []string
+	soundex  map[string][]int32         // soundex code -> ordinals
+	byLength map[int][]int32            // byte length -> ordinals
+	grams    map[int]map[string][]int32 // byte length -> gram -> ordinals of the terms holding it, see wordGrams
+	bk       []bkNode                   // the BK-tree, rooted at bk[0]
+}
+
+// bkNode is a node of a BK-tree: every term in the subtree of bk[children[i].node] is
+// children[i].distance edits away from the term of the node
+type bkNode struct {
+	term     int32
+	children []bkChild
+}
+
+type bkChild struct {
+	distance int32
+	node     int32
+}
+
+const (
+	// jaroSlack absorbs floating point rounding so that a similarity bound never drops a true match
+	jaroSlack = 1e-9
+
+	// charGram and bigramGram start the grams of wordGrams
+	charGram   = "c"
+	bigramGram = "b"
+)
+
+// buildFuzzyIndex builds the candidate structures for every term of the sorted vocabulary
+func buildFuzzyIndex(terms []string) *fuzzyIndex {
+	f := &fuzzyIndex{
+		terms:    terms,
+		soundex:  make(map[string][]int32),
+		byLength: make(map[int][]int32),
+		grams:    make(map[int]map[string][]int32),
+	}
+	for i, term := range terms {
+		if term == "" {
+			continue
+		}
+		ordinal := int32(i)
+		code := smetrics.Soundex(term)
+		f.soundex[code] = append(f.soundex[code], ordinal)
+		f.byLength[len(term)] = append(f.byLength[len(term)], ordinal)
+		grams, ok := f.grams[len(term)]
+		if !ok {
+			grams = make(map[string][]int32)
+			f.grams[len(term)] = grams
+		}
+		chars, bigrams := wordGrams(term)
+		for _, gram := range append(chars, bigrams...) {
+			grams[gram] = append(grams[gram], ordinal)
+		}
+		f.insert(ordinal)
+	}
+	return f
+}
+
+// wordGrams returns the grams of word that Jaro candidates are found through: each of its bytes, and
+// each bigram of word between a start and an end marker. A gram is numbered by its occurrence, so that
+// the grams two words share count their common bytes and bigrams with repetition.
+func wordGrams(word string) (chars, bigrams []string) {
+	seen := make(map[string]uint64, 2*len(word)+1)
+	gram := func(kind, text string) string {
+		seen[kind+text]++
+		return string(binary.AppendUvarint([]byte(kind+text), seen[kind+text]))
+	}
+	for i := 0; i < len(word); i++ {
+		chars = append(chars, gram(charGram, word[i:i+1]))
+	}
+	padded := "\x02" + word + "\x03"
+	for i := 0; i+1 < len(padded); i++ {
+		bigrams = append(bigrams, gram(bigramGram, padded[i:i+2]))
+	}
+	return chars, bigrams
+}
+
+// insert adds the term with ordinal to the BK-tree
+func (f *fuzzyIndex) insert(ordinal int32) {
+	term := f.terms[ordinal]
+	if len(f.bk) == 0 {
+		f.bk = append(f.bk, bkNode{term: ordinal})
+		return
+	}
+	at := int32(0)
+	for {
+		distance := int32(levenshtein(term, f.terms[f.bk[at].term]))
+		if distance == 0 {
+			return
+		}
+		next := int32(-1)
+		for _, child := range f.bk[at].children {
+			if child.distance == distance {
+				next = child.node
+				break
+			}
+		}
+		if next < 0 {
+			f.bk = append(f.bk, bkNode{term: ordinal})
+			f.bk[at].children = append(f.bk[at].children, bkChild{distance: distance, node: int32(len(f.bk) - 1)})
+			return
+		}
+		at = next
+	}
+}
+
+// within returns every term of the BK-tree at most radius edits away from word
+func (f *fuzzyIndex) within(word string, radius int) []string {
+	if len(f.bk) == 0 {
+		return nil
+	}
+	var found []string
+	stack := []int32{0}
+	for len(stack) > 0 {
+		node := f.bk[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		distance := levenshtein(word, f.terms[node.term])
+		if distance <= radius {
+			found = append(found, f.terms[node.term])
+		}
+		for _, child := range node.children {
+			if int(child.distance) >= distance-radius && int(child.distance) <= distance+radius {
+				stack = append(stack, child.node)
+			}
+		}
+	}
+	return found
+}
+
+// termsOf returns the terms with ordinals
+func (f *fuzzyIndex) termsOf(ordinals []int32) []string {
+	terms := make([]string, len(ordinals))
+	for i, ordinal := range ordinals {
+		terms[i] = f.terms[ordinal]
+	}
+	return terms
+}
+
+// candidates returns the terms that can match word under algo with thresholds; every term that
+// matchesConditionSingle accepts is among them
+func (f *fuzzyIndex) candidates(word, algo string, thresholds Thresholds) []string {
+	if word == "" {
+		return f.terms
+	}
+	switch algo {
+	case "soundex":
+		return f.termsOf(f.soundex[smetrics.Soundex(word)])
+	case "hamming":
+		return f.termsOf(f.byLength[len(word)])
+	case "ukkonen":
+		return f.withinCost(word, thresholds.UkkonenMaxSubs, *cfigs.Int(kUkkonenICost), *cfigs.Int(kUkkonenDCost), *cfigs.Int(kUkkonenSCost))
+	case "wagner-fisher":
+		return f.withinCost(word, thresholds.WagnerFisherMaxSubs, *cfigs.Int(kWagnerFisherICost), *cfigs.Int(kWagnerFisherDCost), *cfigs.Int(kWagnerFisherSCost))
+	case "jaro":
+		return f.jaroCandidates(word, thresholds.Jaro, 0, 0)
+	case "jaro-winkler":
+		return f.jaroCandidates(word, thresholds.JaroWinkler, *cfigs.Int(kJaroWinklerPrefixSize), *cfigs.Float64(kJaroWinklerBoostThreshold))
+	}
+	return f.terms
+}
+
+// withinCost shortlists the terms whose weighted edit distance to word can be at most maxCost. Every
+// edit costs at least the cheapest of icost, dcost and scost, so such a term is within
+// maxCost / cheapest plain Levenshtein edits of word.
+func (f *fuzzyIndex) withinCost(word string, maxCost, icost, dcost, scost int) []string {
+	cheapest := min(icost, dcost, scost)
+	if cheapest <= 0 {
+		return f.terms // free edits make every term reachable
+	}
+	if maxCost < 0 {
+		return nil
+	}
+	return f.within(word, maxCost/cheapest)
+}
+
+// jaroCandidates shortlists the terms whose Jaro similarity to word can reach threshold, or with
+// prefixSize > 0 their Jaro-Winkler similarity. For every term length it works out the Jaro a term
+// needs, see jaroFloor, and from that how many bytes and padded bigrams of word the term holds at
+// least, see jaroSharedGrams. A term holding need of the n grams of word holds one of any n-need+1 of
+// them, so the terms of the rarest n-need+1 posting lists are shortlisted, through bigrams when that
+// list is the shorter one. Each is then checked against the bound that the c bytes it shares with word
+// put on Jaro, raised by the Jaro-Winkler boost of their common prefix:
+//
+//	jaro <= (c/len(word) + c/len(term) + 1) / 3
+func (f *fuzzyIndex) jaroCandidates(word string, threshold float64, prefixSize int, boostThreshold float64) []string {
+	var queryCounts [256]int
+	for i := 0; i < len(word); i++ {
+		queryCounts[word[i]]++
+	}
+	chars, bigrams := wordGrams(word)
+	la := float64(len(word))
+	var found []string
+	for length, ordinals := range f.byLength {
+		floor := jaroFloor(threshold, prefixSize, boostThreshold, min(len(word), length))
+		sharedChars, sharedBigrams, reachable := jaroSharedGrams(len(word), length, floor)
+		if !reachable {
+			continue
+		}
+		if sharedChars > 0 {
+			ordinals = f.shortlist(length, chars, sharedChars)
+		}
+		if sharedBigrams > 0 {
+			if byBigrams := f.shortlist(length, bigrams, sharedBigrams); len(byBigrams) < len(ordinals) {
+				ordinals = byBigrams
+			}
+		}
+		lb := float64(length)
+		for _, ordinal := range ordinals {
+			term := f.terms[ordinal]
+			counts := queryCounts
+			common := 0
+			for i := 0; i < len(term); i++ {
+				if counts[term[i]] > 0 {
+					counts[term[i]]--
+					common++
+				}
+			}
+			if common == 0 {
+				continue // jaro is 0
+			}
+			c := float64(common)
+			bound := (c/la + c/lb + 1) / 3
+			if prefixSize > 0 {
+				bound = winklerBound(bound, word, term, prefixSize)
+			}
+			if bound+jaroSlack >= threshold {
+				found = append(found, term)
+			}
+		}
+	}
+	return found
+}
+
+// shortlist returns the ordinals of the terms of length that hold at least need of grams, along with
+// some that don't: the union of the posting lists of the len(grams)-need+1 rarest grams
+func (f *fuzzyIndex) shortlist(length int, grams []string, need int) []int32 {
+	if need > len(grams) {
+		return nil
+	}
+	postings := f.grams[length]
+	lists := make([][]int32, len(grams))
+	for i, gram := range grams {
+		lists[i] = postings[gram]
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	var union []int32
+	for _, list := range lists[:len(grams)-need+1] {
+		union = append(union, list...)
+	}
+	slices.Sort(union)
+	return slices.Compact(union)
+}
+
+// jaroFloor is the Jaro similarity a term needs to reach threshold: threshold itself, or with
+// prefixSize > 0 the least Jaro that the Jaro-Winkler boost of a common prefix of up to
+// min(prefixSize, shorter) bytes raises to threshold, a boost only given above boostThreshold
+func jaroFloor(threshold float64, prefixSize int, boostThreshold float64, shorter int) float64 {
+	if prefixSize <= 0 {
+		return threshold
+	}
+	boost := 0.1 * float64(min(prefixSize, shorter))
+	boosted := math.Inf(-1)
+	if boost < 1 {
+		boosted = (threshold - boost) / (1 - boost)
+	}
+	return math.Min(threshold, math.Max(boosted, boostThreshold))
+}
+
+// jaroSharedGrams returns how many bytes and how many padded bigrams, counted with repetition, words of
+// lengths la and lb share at least when their Jaro similarity reaches floor, and whether it can at
+// all. With m matching bytes of which u are unaligned, Jaro is
+//
+//	(m/la + m/lb + (m - floor(u/2))/m) / 3
+//
+// The matches are m shared bytes. Read in order between the start and end markers, the matches of
+// each word form m+1 consecutive pairs, the same in both but for the at most 2u around unaligned
+// matches, and all bigrams of their word but for the at most la-m and lb-m that unmatched bytes come
+// between, which leaves at least 3m+1-la-lb-2u shared bigrams. Both counts are the least over every m
+// and u that reach floor; a count of 0 or less shortlists nothing.
+func jaroSharedGrams(la, lb int, floor float64) (chars, bigrams int, reachable bool) {
+	if floor <= jaroSlack {
+		return 0, 0, true
+	}
+	chars, bigrams = math.MaxInt, math.MaxInt
+	for m := 1; m <= min(la, lb); m++ {
+		fm := float64(m)
+		transpositions := math.Floor(fm*(fm/float64(la)+fm/float64(lb)+1-3*floor) + jaroSlack)
+		if transpositions < 0 {
+			continue
+		}
+		unaligned := min(m, 2*int(transpositions)+1)
+		chars = min(chars, m)
+		bigrams = min(bigrams, 3*m+1-la-lb-2*unaligned)
+		reachable = true
+	}
+	return chars, bigrams, reachable
+}
+
+// winklerBound raises the Jaro bound by the Jaro-Winkler boost of the common prefix of a and b. The
+// boost grows with jaro as long as the prefix is at most 10 characters; past that nothing is bounded.
+func winklerBound(bound float64, a, b string, prefixSize int) float64 {
+	size := min(len(a), len(b), prefixSize)
+	prefix := 0
+	for prefix < size && a[prefix] == b[prefix] {
+		prefix++
+	}
+	if prefix > 10 {
+		return math.Inf(1)
+	}
+	return math.Max(bound, bound+0.1*float64(prefix)*(1-bound))
+}
+
+// fuzzySection is the FUZZ section of a word index, built from the terms that have a record
+var fuzzySection = rawSection{tag: sectionFuzzy, derive: func(terms []string) []byte {
+	return encodeFuzzyIndex(buildFuzzyIndex(terms))
+}}
+
+// encodeFuzzyIndex serializes f into a FUZZ section. Every number is a uvarint and every list of
+// ordinals ascends and is delta coded:
+//   - the number of terms, which must be that of the DICT section
+//   - the soundex groups: a count, then per group its code, as a length and bytes, and its ordinals
+//   - the lengths: a count, then per length the length, its ordinals and its grams: a count, then per
+//     gram the gram, as a length and bytes, and its ordinals
+//   - the BK-tree: a node count, then per node its ordinal and its children: a count, then per child
+//     the distance and the index of its node
+func encodeFuzzyIndex(f *fuzzyIndex) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(f.terms)))
+	appendString := func(s string) {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	appendOrdinals := func(ordinals []int32) {
+		buf = binary.AppendUvarint(buf, uint64(len(ordinals)))
+		previous := int32(0)
+		for _, ordinal := range ordinals {
+			buf = binary.AppendUvarint(buf, uint64(ordinal-previous))
+			previous = ordinal
+		}
+	}
+
+	codes := slices.Sorted(maps.Keys(f.soundex))
+	buf = binary.AppendUvarint(buf, uint64(len(codes)))
+	for _, code := range codes {
+		appendString(code)
+		appendOrdinals(f.soundex[code])
+	}
+	lengths := slices.Sorted(maps.Keys(f.byLength))
+	buf = binary.AppendUvarint(buf, uint64(len(lengths)))
+	for _, length := range lengths {
+		buf = binary.AppendUvarint(buf, uint64(length))
+		appendOrdinals(f.byLength[length])
+		grams := slices.Sorted(maps.Keys(f.grams[length]))
+		buf = binary.AppendUvarint(buf, uint64(len(grams)))
+		for _, gram := range grams {
+			appendString(gram)
+			appendOrdinals(f.grams[length][gram])
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(f.bk)))
+	for _, node := range f.bk {
+		buf = binary.AppendUvarint(buf, uint64(node.term))
+		buf = binary.AppendUvarint(buf, uint64(len(node.children)))
+		for _, child := range node.children {
+			buf = binary.AppendUvarint(buf, uint64(child.distance))
+			buf = binary.AppendUvarint(buf, uint64(child.node))
+		}
+	}
+	return buf
+}
+
+// decodeFuzzyIndex deserializes the FUZZ section of the word index whose dictionary holds terms
+func decodeFuzzyIndex(data []byte, terms []string) (*fuzzyIndex, error) {
+	errCorrupt := errors.New("FUZZ section is corrupt")
+	next := func() (uint64, bool) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, false
+		}
+		data = data[n:]
+		return value, true
+	}
+	// count reads a count of things that each take at least one byte of what is left
+	count := func() (int, bool) {
+		value, ok := next()
+		return int(value), ok && value <= uint64(len(data))
+	}
+	readString := func() (string, bool) {
+		length, ok := count()
+		if !ok {
+			return "", false
+		}
+		s := string(data[:length])
+		data = data[length:]
+		return s, true
+	}
+	readOrdinals := func() ([]int32, bool) {
+		n, ok := count()
+		if !ok {
+			return nil, false
+		}
+		ordinals := make([]int32, n)
+		ordinal := uint64(0)
+		for i := range ordinals {
+			delta, ok := next()
+			if ordinal += delta; !ok || ordinal >= uint64(len(terms)) {
+				return nil, false
+			}
+			ordinals[i] = int32(ordinal)
+		}
+		return ordinals, true
+	}
+
+	termCount, ok := next()
+	if !ok {
+		return nil, errCorrupt
+	}
+	if termCount != uint64(len(terms)) {
+		return nil, fmt.Errorf("FUZZ section indexes %d terms, the dictionary holds %d", termCount, len(terms))
+	}
+	f := &fuzzyIndex{
+		terms:    terms,
+		soundex:  make(map[string][]int32),
+		byLength: make(map[int][]int32),
+		grams:    make(map[int]map[string][]int32),
+	}
+	codes, ok := count()
+	if !ok {
+		return nil, errCorrupt
+	}
+	for i := 0; i < codes; i++ {
+		code, ok1 := readString()
+		ordinals, ok2 := readOrdinals()
+		if !ok1 || !ok2 {
+			return nil, errCorrupt
+		}
+		f.soundex[code] = ordinals
+	}
+	lengths, ok := count()
+	if !ok {
+		return nil, errCorrupt
+	}
+	for i := 0; i < lengths; i++ {
+		length, ok1 := next()
+		ordinals, ok2 := readOrdinals()
+		grams, ok3 := count()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errCorrupt
+		}
+		f.byLength[int(length)] = ordinals
+		f.grams[int(length)] = make(map[string][]int32, grams)
+		for j := 0; j < grams; j++ {
+			gram, ok1 := readString()
+			ordinals, ok2 := readOrdinals()
+			if !ok1 || !ok2 {
+				return nil, errCorrupt
+			}
+			f.grams[int(length)][gram] = ordinals
+		}
+	}
+	nodes, ok := count()
+	if !ok {
+		return nil, errCorrupt
+	}
+	f.bk = make([]bkNode, nodes)
+	for i := range f.bk {
+		term, ok1 := next()
+		children, ok2 := count()
+		if !ok1 || !ok2 || term >= uint64(len(terms)) {
+			return nil, errCorrupt
+		}
+		f.bk[i] = bkNode{term: int32(term), children: make([]bkChild, children)}
+		for j := range f.bk[i].children {
+			distance, ok1 := next()
+			node, ok2 := next()
+			if !ok1 || !ok2 || node >= uint64(nodes) || distance > math.MaxInt32 {
+				return nil, errCorrupt
+			}
+			f.bk[i].children[j] = bkChild{distance: int32(distance), node: int32(node)}
+		}
+	}
+	if len(data) != 0 {
+		return nil, errCorrupt
+	}
+	return f, nil
+}
+
+// OpenWordIndex opens word_index.bin with its dictionary and decodes its FUZZ section. A word index
+// written before that section existed, such as one that migrateIndex rewrote, has its fuzzy index
+// built from the dictionary instead.
+func OpenWordIndex(path string) (*IndexReader, *fuzzyIndex, error) {
+	reader, sections, err := openDictReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := sections[sectionFuzzy]; !ok {
+		return reader, buildFuzzyIndex(reader.Terms), nil
+	}
+	data, err := readSection(reader.file, sections, sectionFuzzy)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	fuzzy, err := decodeFuzzyIndex(data, reader.Terms)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader, fuzzy, nil
+}
+
+// levenshtein is the plain edit distance between the bytes of a and b, the same units smetrics compares
+func levenshtein(a, b string) int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diagonal+cost)
+			diagonal = row[j]
+			row[j] = next
+		}
+	}
+	return row[len(b)]
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// legacyGematriaMagic started the binary header that gematria_index.bin had before the index container,
+// see migrateIndex
+const legacyGematriaMagic = "GEMB"
+
+// gematriaRecordSize is the size of one GEMD record: cipher uint8, value, offset and length uint64
+const gematriaRecordSize = 1 + 8 + 8 + 8
+
+// gematriaKey identifies the bitmap of one value of one cipher
+type gematriaKey struct {
+	cipher gematriaCipher
+	value  uint64
+}
+
+// parseGematriaKey splits a legacy "english_123" key, which gematria_postings.txt still uses, into its cipher and value
+func parseGematriaKey(key string) (gematriaKey, error) {
+	name, valueStr, found := strings.Cut(key, "_")
+	if !found {
+		return gematriaKey{}, fmt.Errorf("gematria key %s has no cipher", key)
+	}
+	cipher, ok := cipherID(name)
+	if !ok {
+		return gematriaKey{}, fmt.Errorf("gematria key %s has an unknown cipher", key)
+	}
+	value, err := strconv.ParseUint(valueStr, 10, 64)
+	if err != nil {
+		return gematriaKey{}, fmt.Errorf("parse gematria key %s: %w", key, err)
+	}
+	return gematriaKey{cipher: cipher, value: value}, nil
+}
+
+// buildGematriaIndex builds gematria_index.bin from gematria_postings.txt. It is an index container
+// (see container.go) with a DATA section of Roaring Bitmaps and a GEMD section holding, per cipher and
+// value sorted by both, the cipher as a uint8 (its position in gematriaCiphers) and the value and the
+// offset and length of its bitmap as uint64s.
+func buildGematriaIndex(postingsFile, indexFile string) error {
+	inFile, err := os.Open(postingsFile)
+	if err != nil {
+		return fmt.Errorf("open postings: %w", err)
+	}
+	defer inFile.Close()
+
+	keyToBitmap := make(map[gematriaKey]*roaring.Bitmap)
+	scanner := bufio.NewScanner(inFile)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 2 {
+			continue // Skip invalid lines
+		}
+		key, err := parseGematriaKey(parts[0])
+		if err != nil {
+			continue
+		}
+		pageID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		if _, exists := keyToBitmap[key]; !exists {
+			keyToBitmap[key] = roaring.New()
+		}
+		keyToBitmap[key].Add(uint32(pageID))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan postings: %w", err)
+	}
+
+	keys := make([]gematriaKey, 0, len(keyToBitmap))
+	for key := range keyToBitmap {
+		keys = append(keys, key)
+	}
+	return writeGematriaIndex(indexFile, keys, func(key gematriaKey) (*roaring.Bitmap, error) {
+		return keyToBitmap[key], nil
+	})
+}
+
+// writeGematriaIndex writes the gematria index container of keys, whose bitmaps come from bitmap; a key
+// whose bitmap is nil is left out
+func writeGematriaIndex(indexFile string, keys []gematriaKey, bitmap func(key gematriaKey) (*roaring.Bitmap, error)) error {
+	postings := make([]gematriaPosting, 0, len(keys))
+	for _, key := range keys {
+		postings = append(postings, gematriaPosting{cipher: key.cipher, value: key.value})
+	}
+	sortGematriaPostings(postings)
+
+	c, err := createContainer(indexFile, 2)
+	if err != nil {
+		return err
+	}
+	defer c.abort()
+	c.beginSection(sectionData)
+	written := postings[:0]
+	for _, posting := range postings {
+		b, err := bitmap(gematriaKey{cipher: posting.cipher, value: posting.value})
+		if err != nil {
+			return fmt.Errorf("bitmap %s_%d: %w", gematriaCiphers[posting.cipher], posting.value, err)
+		}
+		if b == nil {
+			continue
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("marshal bitmap %s_%d: %w", gematriaCiphers[posting.cipher], posting.value, err)
+		}
+		offset := c.offset
+		if _, err := c.Write(data); err != nil {
+			return fmt.Errorf("write bitmap %s_%d: %w", gematriaCiphers[posting.cipher], posting.value, err)
+		}
+		posting.offsetLen = [2]int64{offset, int64(len(data))}
+		written = append(written, posting)
+	}
+	c.endSection()
+	c.beginSection(sectionGematria)
+	if _, err := c.Write(encodeGematriaRecords(written)); err != nil {
+		return fmt.Errorf("write gematria dictionary: %w", err)
+	}
+	c.endSection()
+	return c.Close()
+}
+
+// encodeGematriaRecords encodes a GEMD section
+func encodeGematriaRecords(postings []gematriaPosting) []byte {
+	buf := make([]byte, 0, 8+len(postings)*gematriaRecordSize)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(postings)))
+	for _, posting := range postings {
+		buf = append(buf, byte(posting.cipher))
+		buf = binary.LittleEndian.AppendUint64(buf, posting.value)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(posting.offsetLen[0]))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(posting.offsetLen[1]))
+	}
+	return buf
+}
+
+// decodeGematriaRecords decodes a GEMD section
+func decodeGematriaRecords(data []byte) ([]gematriaPosting, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("GEMD section is too short")
+	}
+	count := binary.LittleEndian.Uint64(data)
+	data = data[8:]
+	if uint64(len(data)) != count*gematriaRecordSize {
+		return nil, fmt.Errorf("GEMD section holds %d bytes for %d records", len(data), count)
+	}
+	postings := make([]gematriaPosting, count)
+	for i := range postings {
+		record := data[i*gematriaRecordSize:]
+		cipher := gematriaCipher(record[0])
+		if int(cipher) >= len(gematriaCiphers) {
+			return nil, fmt.Errorf("GEMD record %d has unknown cipher %d", i, cipher)
+		}
+		postings[i] = gematriaPosting{
+			cipher: cipher,
+			value:  binary.LittleEndian.Uint64(record[1:]),
+			offsetLen: [2]int64{
+				int64(binary.LittleEndian.Uint64(record[9:])),
+				int64(binary.LittleEndian.Uint64(record[17:])),
+			},
+		}
+	}
+	return postings, nil
+}
+
+// OpenGematriaIndex opens gematria_index.bin and decodes its GEMD section into a lookup. The returned
+// IndexReader has no Header; its bitmaps are found through the lookup instead.
+func OpenGematriaIndex(path string) (*IndexReader, gematriaLookupTable, error) {
+	reader, sections, err := openContainerReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readSection(reader.file, sections, sectionGematria)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	postings, err := decodeGematriaRecords(data)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader, buildGematriaLookup(postings), nil
+}
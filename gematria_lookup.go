@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/andreimerlescu/gematria"
+)
+
+// gematriaCiphers are the ciphers of gematria.Gematria in the order their categories are reported
+var gematriaCiphers = []string{"simple", "english", "jewish", "eights", "mystery", "majestic"}
+
+// gematriaCipher is the position of a cipher in gematriaCiphers, which is how gematria_index.bin stores it
+type gematriaCipher uint8
+
+// cipherID returns the gematriaCipher of the cipher named name
+func cipherID(name string) (gematriaCipher, bool) {
+	for i, cipher := range gematriaCiphers {
+		if cipher == name {
+			return gematriaCipher(i), true
+		}
+	}
+	return 0, false
+}
+
+// gematriaPosting is one value of a cipher and the [offset, length] of its bitmap in gematria_index.bin
+type gematriaPosting struct {
+	cipher    gematriaCipher
+	value     uint64
+	offsetLen [2]int64
+}
+
+// gematriaTable holds every value of one cipher: sorted for range scans and in a map for direct lookups
+type gematriaTable struct {
+	postings []gematriaPosting
+	byValue  map[uint64][2]int64
+}
+
+// gematriaLookupTable holds one gematriaTable per cipher, indexed by gematriaCipher
+type gematriaLookupTable []gematriaTable
+
+// sortGematriaPostings sorts postings by cipher and then by value, the order of the gematria_index.bin header
+func sortGematriaPostings(postings []gematriaPosting) {
+	sort.Slice(postings, func(i, j int) bool {
+		if postings[i].cipher != postings[j].cipher {
+			return postings[i].cipher < postings[j].cipher
+		}
+		return postings[i].value < postings[j].value
+	})
+}
+
+// buildGematriaLookup groups the postings of the gematria index header by cipher, so that a value is
+// one map lookup and a range is one contiguous run of a sorted slice
+func buildGematriaLookup(postings []gematriaPosting) gematriaLookupTable {
+	sorted := append([]gematriaPosting{}, postings...)
+	sortGematriaPostings(sorted)
+	lookup := make(gematriaLookupTable, len(gematriaCiphers))
+	for i := range lookup {
+		lookup[i].byValue = make(map[uint64][2]int64)
+	}
+	for _, posting := range sorted {
+		table := &lookup[posting.cipher]
+		table.postings = append(table.postings, posting)
+		table.byValue[posting.value] = posting.offsetLen
+	}
+	return lookup
+}
+
+// size returns the number of values across every cipher
+func (l gematriaLookupTable) size() int {
+	n := 0
+	for _, table := range l {
+		n += len(table.postings)
+	}
+	return n
+}
+
+// valuesIn returns the postings of cipher whose value lies within [min, max]
+func (l gematriaLookupTable) valuesIn(cipher string, min, max uint64) []gematriaPosting {
+	id, ok := cipherID(cipher)
+	if !ok || int(id) >= len(l) {
+		return nil
+	}
+	postings := l[id].postings
+	start := sort.Search(len(postings), func(i int) bool { return postings[i].value >= min })
+	end := start
+	for end < len(postings) && postings[end].value <= max {
+		end++
+	}
+	return postings[start:end]
+}
+
+// gematriaBitmap ORs together the bitmaps of every value of cipher within [min, max] in the segment.
+// A single value, which is what every query term asks for, is a direct lookup; a range stops when ctx is done.
+func (s *segment) gematriaBitmap(ctx context.Context, cipher string, min, max uint64) (*roaring.Bitmap, error) {
+	result := roaring.New()
+	if min == max {
+		id, ok := cipherID(cipher)
+		if !ok || int(id) >= len(s.gematriaLookup) {
+			return result, nil
+		}
+		offsetLen, ok := s.gematriaLookup[id].byValue[min]
+		if !ok {
+			return result, nil
+		}
+		b, err := s.gematria.Bitmap(offsetLen)
+		if err != nil {
+			errorLogger.Printf("Read error for %s_%d: %v", cipher, min, err)
+			return result, nil
+		}
+		return b, nil
+	}
+	for _, posting := range s.gematriaLookup.valuesIn(cipher, min, max) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b, err := s.gematria.Bitmap(posting.offsetLen)
+		if err != nil {
+			errorLogger.Printf("Read error for %s_%d: %v", cipher, posting.value, err)
+			continue
+		}
+		result.Or(b)
+	}
+	return result, nil
+}
+
+// gematriaBitmap ORs together the gematria bitmaps of every segment
+func (idx *indexSnapshot) gematriaBitmap(ctx context.Context, cipher string, min, max uint64) (*roaring.Bitmap, error) {
+	result := roaring.New()
+	for _, s := range idx.segments {
+		b, err := s.gematriaBitmap(ctx, cipher, min, max)
+		if err != nil {
+			return nil, err
+		}
+		result.Or(b)
+	}
+	return result, nil
+}
+
+// gematriaValue returns the value of g in cipher
+func gematriaValue(g gematria.Gematria, cipher string) (uint64, bool) {
+	switch cipher {
+	case "simple":
+		return g.Simple, true
+	case "english":
+		return g.English, true
+	case "jewish":
+		return g.Jewish, true
+	case "eights":
+		return g.Eights, true
+	case "mystery":
+		return g.Mystery, true
+	case "majestic":
+		return g.Majestic, true
+	}
+	return 0, false
+}
+
+// isGematriaCipher reports whether cipher is one of gematriaCiphers
+func isGematriaCipher(cipher string) bool {
+	_, ok := cipherID(cipher)
+	return ok
+}
+
+// parseGematriaBounds parses the part of a gematria operator after the colon: a value (119), an
+// inclusive range (600..700, ..700 or 600..) or, after an =, the word whose value to use (=oswald)
+func parseGematriaBounds(cipher, spec string) (min, max uint64, err error) {
+	if word, ok := strings.CutPrefix(spec, "="); ok {
+		if word == "" {
+			return 0, 0, fmt.Errorf("%s:= needs a word to take the value of", cipher)
+		}
+		value, _ := gematriaValue(gematria.FromString(word), cipher)
+		return value, value, nil
+	}
+	lo, hi, isRange := strings.Cut(spec, "..")
+	if !isRange {
+		value, err := strconv.ParseUint(spec, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s value %q, expected a number, a range such as 600..700 or =word", cipher, spec)
+		}
+		return value, value, nil
+	}
+	min, max = 0, math.MaxUint64
+	if lo != "" {
+		if min, err = strconv.ParseUint(lo, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s range start %q", cipher, lo)
+		}
+	}
+	if hi != "" {
+		if max, err = strconv.ParseUint(hi, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s range end %q", cipher, hi)
+		}
+	}
+	if lo == "" && hi == "" {
+		return 0, 0, fmt.Errorf("%s range needs a start or an end", cipher)
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("%s range %s is backwards", cipher, spec)
+	}
+	return min, max, nil
+}
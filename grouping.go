@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// DocumentGroup is one document of a group=document response: how many of its pages matched and the
+// best of them, scored together so that documents can be ranked against one another
+type DocumentGroup struct {
+	ID    string       `json:"id"`    // DocumentIdentifier
+	Cover string       `json:"cover"` // CoverPageIdentifier
+	Score float64      `json:"score"` // the scores of the pages, each worth kGroupPageDecay of the one before it
+	Hits  uint64       `json:"hits"`  // matching pages in the document
+	Pages []rankedPage `json:"pages"` // the kGroupBestPages best pages, highest first
+}
+
+// documentEntry is a document of the results with what it is ordered by. Its windowEntry is the best
+// page of the document with the score of the whole document, which a cursor resumes from.
+type documentEntry struct {
+	windowEntry
+	key  string        // the document as the field index holds it, normalized
+	hits uint64        // matching pages in the document
+	best []windowEntry // the best pages, highest first
+}
+
+// documentScore adds up the scores of the pages of a document, highest first, each weighing decay times
+// the one before it. With a decay below 1 the score stays under 1/(1-decay) times that of the best
+// page, so a long document with many weak hits doesn't bury a short one with a strong hit.
+func documentScore(pages []windowEntry, decay float64) float64 {
+	var score float64
+	weight := 1.0
+	for _, page := range pages {
+		score += weight * page.score
+		weight *= decay
+	}
+	return score
+}
+
+// documentPages splits the pages of result by the document they belong to, read from the doc: keys of
+// the field index, keyed by the normalized document identifier. When the search runs out of time the
+// documents found so far are returned with context.DeadlineExceeded.
+func (e *queryEvaluator) documentPages(result *roaring.Bitmap) (map[string]*roaring.Bitmap, error) {
+	prefix := "doc:"
+	documents := make(map[string]*roaring.Bitmap)
+	for _, s := range e.index.segments {
+		for _, key := range prefixRange(s.field.Terms, prefix) {
+			if err := e.ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+				return documents, err
+			} else if err != nil {
+				return nil, err
+			}
+			b, err := s.field.KeyBitmap(key)
+			if err != nil {
+				errorLogger.Printf("Read error for %s: %v", key, err)
+				continue
+			}
+			b.And(result)
+			if b.IsEmpty() {
+				continue
+			}
+			document := strings.TrimPrefix(key, prefix)
+			if pages, ok := documents[document]; ok {
+				pages.Or(b) // a document whose pages were indexed in several segments
+			} else {
+				documents[document] = b
+			}
+		}
+	}
+	return documents, nil
+}
+
+// cutDocuments scores every page of result as the window of the options asks, groups the pages by
+// document and orders the documents by their documentScore, highest first and then by their best page.
+// It returns the documents of the window that follows its cursor, the cursor of the next one and how
+// many documents matched. When the search runs out of time the window is still cut, from the
+// categories and documents found in time, and returned with context.DeadlineExceeded.
+func (e *queryEvaluator) cutDocuments(result *roaring.Bitmap, leaves []QueryNode, bm25 map[uint32]float64, fingerprint uint64) ([]documentEntry, *searchCursor, uint64, error) {
+	window := e.opts.Window
+	categories, deadline := e.categoryBitmaps(leaves, result)
+	if deadline != nil && !errors.Is(deadline, context.DeadlineExceeded) {
+		return nil, nil, 0, deadline
+	}
+	var boost float64
+	if e.opts.BM25 != nil {
+		boost = e.opts.BM25.CategoryBoost
+	}
+	ranked := rankEntries(result, window, categories, bm25, boost)
+	rank := make(map[uint32]int, len(ranked))
+	for i, entry := range ranked {
+		rank[entry.pageID] = i
+	}
+	byDocument, err := e.documentPages(result)
+	if errors.Is(err, context.DeadlineExceeded) {
+		deadline = err
+	} else if err != nil {
+		return nil, nil, 0, err
+	}
+
+	bestPages, decay := *cfigs.Int(kGroupBestPages), *cfigs.Float64(kGroupPageDecay)
+	documents := make([]documentEntry, 0, len(byDocument))
+	entries := make([]windowEntry, 0, len(byDocument))
+	byBestPage := make(map[uint32]int, len(byDocument))
+	for key, pages := range byDocument {
+		// the pages in the order of ranked, which is highest first and then by page ID
+		order := make([]int, 0, pages.GetCardinality())
+		itr := pages.Iterator()
+		for itr.HasNext() {
+			order = append(order, rank[itr.Next()])
+		}
+		sort.Ints(order)
+		scored := make([]windowEntry, len(order))
+		for i, at := range order {
+			scored[i] = ranked[at]
+		}
+		document := documentEntry{
+			windowEntry: windowEntry{pageID: scored[0].pageID, score: documentScore(scored, decay)},
+			key:         key,
+			hits:        uint64(len(scored)),
+			best:        scored[:min(bestPages, len(scored))],
+		}
+		byBestPage[document.pageID] = len(documents)
+		documents = append(documents, document)
+		entries = append(entries, document.windowEntry)
+	}
+	// Sort by score descending, then best page ID ascending for stability
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].score == entries[j].score {
+			return entries[i].pageID < entries[j].pageID
+		}
+		return entries[i].score > entries[j].score
+	})
+	entries, next := cutWindow(entries, window, fingerprint)
+	cut := make([]documentEntry, 0, len(entries))
+	for _, entry := range entries {
+		cut = append(cut, documents[byBestPage[entry.pageID]])
+	}
+	return cut, next, uint64(len(documents)), deadline
+}
+
+// documentBestPages lists the best pages of every document in order, which is all search() reads
+func documentBestPages(documents []documentEntry) []windowEntry {
+	var pages []windowEntry
+	for _, document := range documents {
+		pages = append(pages, document.best...)
+	}
+	return pages
+}
+
+// confirmedDocuments returns the leading documents whose best pages are all among the first confirmed
+// pages of documentBestPages
+func confirmedDocuments(documents []documentEntry, confirmed int) []documentEntry {
+	for i, document := range documents {
+		if confirmed < len(document.best) {
+			return documents[:i]
+		}
+		confirmed -= len(document.best)
+	}
+	return documents
+}
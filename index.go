@@ -2,10 +2,7 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -14,33 +11,23 @@ import (
 	"github.com/RoaringBitmap/roaring"
 )
 
-// buildIndex constructs an inverted index from a postings file (e.g., word_postings.txt or gematria_postings.txt)
-// and writes it to an index file (e.g., word_index.bin or gematria_index.bin).
+// buildIndex constructs an inverted index from a postings file (e.g., word_postings.txt or field_postings.txt)
+// and writes it to an index file (e.g., word_index.bin or field_index.bin).
 // The postings file contains lines in the format "key pageID" (e.g., "secret 123").
-// The index file has:
-//   - A JSON header mapping each key to a [offset, length] pair, where offset is the byte position of the key’s bitmap in the file.
-//   - A binary body containing Roaring Bitmaps, where each bitmap lists the page IDs associated with a key.
+// The index file is an index container (see container.go) with:
+//   - A DATA section of Roaring Bitmaps, where each bitmap lists the page IDs associated with a key.
+//   - A DICT section of every key in sorted order with the [offset, length] of its bitmap, which is also
+//     what prefix and wildcard queries range over.
+//   - The extra sections after them, such as the FUZZ section of the word index (see fuzzySection).
 //
-// This function uses temporary files to group page IDs by key before building the bitmaps, with a semaphore to limit open files.
-func buildIndex(postingsFile, indexFile string) error {
+// All bitmaps are built in memory; buildIndexUnlimited trades that for temporary files.
+func buildIndex(postingsFile, indexFile string, extra ...rawSection) error {
 	inFile, err := os.Open(postingsFile)
 	if err != nil {
 		return fmt.Errorf("open postings: %w", err)
 	}
 	defer inFile.Close()
 
-	outFile, err := os.Create(indexFile)
-	if err != nil {
-		return fmt.Errorf("create index: %w", err)
-	}
-	defer outFile.Close()
-
-	// Reserve 8 bytes for header offset
-	_, err = outFile.Write(make([]byte, 8))
-	if err != nil {
-		return fmt.Errorf("reserve header offset: %w", err)
-	}
-
 	// Build bitmaps
 	keyToBitmap := make(map[string]*roaring.Bitmap)
 	scanner := bufio.NewScanner(inFile)
@@ -69,61 +56,29 @@ func buildIndex(postingsFile, indexFile string) error {
 		return fmt.Errorf("scan postings: %w", err)
 	}
 
-	// Write bitmaps and track offsets
-	header := make(map[string][2]int64)
-	bitmapStart, _ := outFile.Seek(0, io.SeekCurrent)
-	currentOffset := bitmapStart
-	for key, bitmap := range keyToBitmap {
-		data, err := bitmap.MarshalBinary()
-		if err != nil {
-			return fmt.Errorf("marshal bitmap %s: %w", key, err)
-		}
-		n, err := outFile.Write(data)
+	keys := make([]string, 0, len(keyToBitmap))
+	for key := range keyToBitmap {
+		keys = append(keys, key)
+	}
+	return writeRecordIndex(indexFile, keys, func(key string) ([]byte, error) {
+		data, err := keyToBitmap[key].MarshalBinary()
 		if err != nil {
-			return fmt.Errorf("write bitmap %s: %w", key, err)
+			return nil, fmt.Errorf("marshal bitmap %s: %w", key, err)
 		}
-		header[key] = [2]int64{currentOffset, int64(n)}
-		currentOffset += int64(n)
-	}
-
-	// Write header at the end
-	headerOffset, _ := outFile.Seek(0, io.SeekCurrent)
-	headerJSON, err := json.Marshal(header)
-	if err != nil {
-		return fmt.Errorf("marshal header: %w", err)
-	}
-	_, err = outFile.Write(headerJSON)
-	if err != nil {
-		return fmt.Errorf("write header: %w", err)
-	}
-
-	// Write header offset at the start
-	_, err = outFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("seek start: %w", err)
-	}
-	err = binary.Write(outFile, binary.LittleEndian, uint64(headerOffset))
-	if err != nil {
-		return fmt.Errorf("write header offset: %w", err)
-	}
-
-	return nil
+		return data, nil
+	}, extra...)
 }
 
-func buildIndexUnlimited(postingsFile, indexFile string) error {
+// buildIndexUnlimited writes the same index container as buildIndex without holding every bitmap in
+// memory: the page IDs of each key are spooled to a temporary file and turned into a bitmap one key
+// at a time.
+func buildIndexUnlimited(postingsFile, indexFile string, extra ...rawSection) error {
 	inFile, err := os.Open(postingsFile)
 	if err != nil {
 		return fmt.Errorf("open postings: %w", err)
 	}
 	defer inFile.Close()
 
-	outFile, err := os.Create(indexFile)
-	if err != nil {
-		return fmt.Errorf("create index: %w", err)
-	}
-	defer outFile.Close()
-	writer := bufio.NewWriter(outFile)
-
 	tempDir := filepath.Join(*cfigs.String(kCacheDir), "temp_postings")
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		return fmt.Errorf("create temp dir: %w", err)
@@ -161,6 +116,7 @@ func buildIndexUnlimited(postingsFile, indexFile string) error {
 		return fmt.Errorf("scan postings: %w", err)
 	}
 
+	keys := make([]string, 0, len(keyFiles))
 	for key, w := range keyWriters {
 		if err := w.Flush(); err != nil {
 			return fmt.Errorf("flush temp %s: %w", key, err)
@@ -168,13 +124,13 @@ func buildIndexUnlimited(postingsFile, indexFile string) error {
 		if err := keyFiles[key].Close(); err != nil {
 			return fmt.Errorf("close temp %s: %w", key, err)
 		}
+		keys = append(keys, key)
 	}
 
-	header := make(map[string][2]int64)
-	for key := range keyFiles {
+	return writeRecordIndex(indexFile, keys, func(key string) ([]byte, error) {
 		f, err := os.Open(filepath.Join(tempDir, key))
 		if err != nil {
-			return fmt.Errorf("reopen temp %s: %w", key, err)
+			return nil, fmt.Errorf("reopen temp %s: %w", key, err)
 		}
 		defer f.Close()
 
@@ -185,33 +141,12 @@ func buildIndexUnlimited(postingsFile, indexFile string) error {
 			bitmap.Add(uint32(id))
 		}
 		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("scan temp %s: %w", key, err)
-		}
-
-		offset, err := outFile.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return fmt.Errorf("seek for %s: %w", key, err)
+			return nil, fmt.Errorf("scan temp %s: %w", key, err)
 		}
 		data, err := bitmap.MarshalBinary()
 		if err != nil {
-			return fmt.Errorf("marshal %s: %w", key, err)
-		}
-		_, err = writer.Write(data)
-		if err != nil {
-			return fmt.Errorf("write bitmap %s: %w", key, err)
+			return nil, fmt.Errorf("marshal %s: %w", key, err)
 		}
-		header[key] = [2]int64{offset, int64(len(data))}
-	}
-
-	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("flush output: %w", err)
-	}
-	if _, err := outFile.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("seek start: %w", err)
-	}
-	if err := json.NewEncoder(outFile).Encode(header); err != nil {
-		return fmt.Errorf("encode header: %w", err)
-	}
-
-	return nil
+		return data, nil
+	}, extra...)
 }
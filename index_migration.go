@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreimerlescu/textee"
+)
+
+// migrateIndex rewrites an index file written before the versioned index container into one, keeping
+// its records as they are. Such a file starts with the 8-byte offset of its header, which is a JSON map
+// of keys to [offset, length] pairs, or for gematria_index.bin either that map of "english_123" keys or
+// the "GEMB" binary header. The header becomes a DICT section, or a GEMD section when gematria is set.
+//
+// The new file replaces the old one only once it is complete, along with its .sha256 checksum if it
+// had one; the term dictionary that used to sit next to it is removed. A file that is already a
+// container is left alone; migrated reports whether a rewrite happened. Files written by the old
+// buildIndexUnlimited, whose JSON header overwrote the start of its bitmaps, can't be recovered and
+// are refused.
+func migrateIndex(path string, gematria bool) (migrated bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if _, err := readContainer(file, info.Size()); !errors.Is(err, errLegacyIndex) {
+		return false, err
+	}
+
+	var offset [8]byte
+	if _, err := file.ReadAt(offset[:], 0); err != nil {
+		return false, fmt.Errorf("%s: read header offset: %w", path, err)
+	}
+	if offset[0] == '{' {
+		return false, fmt.Errorf("%s was written by buildIndexUnlimited before the index container and can't be migrated; delete the cache directory to rebuild it", path)
+	}
+	headerOffset := int64(binary.LittleEndian.Uint64(offset[:]))
+	if headerOffset < 8 || headerOffset > info.Size() {
+		return false, fmt.Errorf("%s is neither an index container nor a legacy index: header offset %d is outside of the %d byte file", path, headerOffset, info.Size())
+	}
+	header := make([]byte, info.Size()-headerOffset)
+	if _, err := file.ReadAt(header, headerOffset); err != nil {
+		return false, fmt.Errorf("%s: read legacy header: %w", path, err)
+	}
+
+	// The records move from right after the 8-byte header offset to right after the section table
+	shift := int64(containerPreambleSize+2*sectionEntrySize) - 8
+	var dictTag string
+	var dict []byte
+	var count int
+	if gematria {
+		postings, err := decodeLegacyGematriaHeader(header)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		for i := range postings {
+			postings[i].offsetLen[0] += shift
+		}
+		dictTag, dict, count = sectionGematria, encodeGematriaRecords(postings), len(postings)
+	} else {
+		legacy := make(map[string][2]int64)
+		if err := json.Unmarshal(header, &legacy); err != nil {
+			return false, fmt.Errorf("%s: decode legacy header: %w", path, err)
+		}
+		entries := make([]dictEntry, 0, len(legacy))
+		for key, offsetLen := range legacy {
+			entries = append(entries, dictEntry{key: key, offsetLen: [2]int64{offsetLen[0] + shift, offsetLen[1]}})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		dictTag, dict, count = sectionDict, encodeDict(entries), len(entries)
+	}
+
+	// the old file stays open for reading until the container replaces it, see createContainer
+	c, err := createContainer(path, 2)
+	if err != nil {
+		return false, err
+	}
+	defer c.abort()
+	c.beginSection(sectionData)
+	if _, err := io.Copy(c, io.NewSectionReader(file, 8, headerOffset-8)); err != nil {
+		return false, fmt.Errorf("%s: copy records: %w", path, err)
+	}
+	c.endSection()
+	c.beginSection(dictTag)
+	if _, err := c.Write(dict); err != nil {
+		return false, fmt.Errorf("%s: write %s section: %w", path, dictTag, err)
+	}
+	c.endSection()
+	if err := c.Close(); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+
+	_ = os.Remove(strings.TrimSuffix(path, ".bin") + ".terms")
+	if _, err := os.Stat(path + ".sha256"); err == nil {
+		if err := generateChecksum(path); err != nil {
+			return true, fmt.Errorf("%s: update checksum: %w", path, err)
+		}
+	}
+	log.Printf("Migrated %s to index format version %d with %d entries", path, containerVersion, count)
+	return true, nil
+}
+
+// decodeLegacyGematriaHeader decodes either header that gematria_index.bin had before the index container
+func decodeLegacyGematriaHeader(header []byte) ([]gematriaPosting, error) {
+	if data, ok := strings.CutPrefix(string(header), legacyGematriaMagic); ok {
+		return decodeGematriaRecords([]byte(data))
+	}
+	legacy := make(map[string][2]int64)
+	if err := json.Unmarshal(header, &legacy); err != nil {
+		return nil, fmt.Errorf("decode legacy header: %w", err)
+	}
+	postings := make([]gematriaPosting, 0, len(legacy))
+	for key, offsetLen := range legacy {
+		parsed, err := parseGematriaKey(key)
+		if err != nil {
+			return nil, err
+		}
+		postings = append(postings, gematriaPosting{cipher: parsed.cipher, value: parsed.value, offsetLen: offsetLen})
+	}
+	sortGematriaPostings(postings)
+	return postings, nil
+}
+
+// loadIndexFile migrates the index at path when it predates the index container and kMigrateIndexes is
+// set, and refuses it with a clear error otherwise, before it is opened
+func loadIndexFile(path string, gematria bool) error {
+	if *cfigs.Bool(kMigrateIndexes) {
+		_, err := migrateIndex(path, gematria)
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := readContainer(file, info.Size()); errors.Is(err, errLegacyIndex) {
+		return fmt.Errorf("%s predates the versioned index container; enable -%s or delete the cache directory to rebuild it", path, kMigrateIndexes)
+	}
+	return nil
+}
+
+// buildMissingIndexes builds the indexes of the base segment named in files, any of position_index.bin,
+// field_index.bin and frequency_index.bin, from the pages stored in apario-search-cache.jsonl instead of
+// reading -dir again, for a cache built before those indexes existed. The pages of incremental segments
+// are left out as those segments have their own. Such a cache never stored the record.json metadata of
+// its pages, so its field index only holds the doc, page and cover fields until the next full rebuild.
+func buildMissingIndexes(files []string) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheDir := *cfigs.String(kCacheDir)
+	wanted := make(map[string]bool, len(files))
+	for _, file := range files {
+		wanted[file] = true
+	}
+	incremental, err := incrementalSegmentPages()
+	if err != nil {
+		return err
+	}
+
+	idx, err := os.Open(filepath.Join(cacheDir, cacheIndexFile))
+	if err != nil {
+		return fmt.Errorf("open cache index: %w", err)
+	}
+	defer idx.Close()
+	reader, err := OpenRecordReader(filepath.Join(cacheDir, cacheFile))
+	if err != nil {
+		return fmt.Errorf("open cache file: %w", err)
+	}
+	defer reader.Close()
+
+	positionPostings := filepath.Join(cacheDir, "position_postings.txt")
+	fieldPostings := filepath.Join(cacheDir, "field_postings.txt")
+	frequencyPostings := filepath.Join(cacheDir, "frequency_postings.txt")
+	lengthPostings := filepath.Join(cacheDir, "length_postings.txt")
+	writers := make(map[string]*bufio.Writer)
+	for _, path := range []string{positionPostings, fieldPostings, frequencyPostings, lengthPostings} {
+		w, f, err := FileAppender(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		writers[path] = w
+	}
+	write := func(path string, postings ...string) error {
+		for _, posting := range postings {
+			if _, err := writers[path].WriteString(posting + "\n"); err != nil {
+				return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+			}
+		}
+		return nil
+	}
+
+	pages := 0
+	scanner := bufio.NewScanner(idx)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), " ")
+		if len(parts) != 3 {
+			continue
+		}
+		id, err1 := strconv.Atoi(parts[0])
+		offset, err2 := strconv.ParseInt(parts[1], 10, 64)
+		length, err3 := strconv.ParseInt(parts[2], 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return fmt.Errorf("parse cache index: %w", err)
+		}
+		if incremental.Contains(uint32(id)) {
+			continue
+		}
+		page, err := reader.Page([2]int64{offset, length})
+		if err != nil {
+			return fmt.Errorf("read page %d: %w", id, err)
+		}
+		if page.Textee == nil {
+			continue
+		}
+		if wanted[positionIndexFile] {
+			if err := write(positionPostings, generatePositionPostings(page.Textee.Input, id)...); err != nil {
+				return err
+			}
+		}
+		if wanted[fieldIndexFile] {
+			if err := write(fieldPostings, generateFieldPostings(page, id)...); err != nil {
+				return err
+			}
+		}
+		if wanted[frequencyIndexFile] {
+			// the substring counts don't survive the cache file, so the text is counted again
+			text, err := textee.NewTextee(page.Textee.Input)
+			if err != nil {
+				return fmt.Errorf("count the terms of page %d: %w", id, err)
+			}
+			if err := write(frequencyPostings, generateFrequencyPostings(text, id)...); err != nil {
+				return err
+			}
+			if err := write(lengthPostings, generateLengthPosting(text, id)); err != nil {
+				return err
+			}
+		}
+		pages++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read cache index: %w", err)
+	}
+	for path, w := range writers {
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("flush %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	for _, file := range files {
+		path := filepath.Join(cacheDir, file)
+		switch file {
+		case positionIndexFile:
+			err = buildPositionIndex(positionPostings, path)
+		case fieldIndexFile:
+			err = buildIndex(fieldPostings, path)
+		case frequencyIndexFile:
+			err = buildFrequencyIndex(frequencyPostings, lengthPostings, path)
+		default:
+			err = fmt.Errorf("%s can't be built from the cache file", file)
+		}
+		if err != nil {
+			return fmt.Errorf("build %s: %w", file, err)
+		}
+		if err := generateChecksum(path); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		log.Printf("Built %s from %d cached pages", file, pages)
+	}
+	return nil
+}
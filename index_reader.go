@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// IndexReader serves the bitmaps of an index file (word_index.bin, gematria_index.bin, ...) or the
+// page records of the cache file through positional reads. ReadAt never moves a shared file cursor
+// the way Seek followed by Read does, so any number of searches can read through one IndexReader
+// at the same time without decoding each other's bytes.
+type IndexReader struct {
+	file   io.ReaderAt
+	closer io.Closer
+
+	// Header maps each key of the index to the [offset, length] of its record; empty for the cache file
+	Header map[string][2]int64
+
+	// Terms lists the keys of Header in ascending byte order, the order of the DICT section
+	Terms []string
+}
+
+// openContainerReader opens an index container and reads its section table, verifying the checksum
+// of its DATA section when kVerifyIndexData is set. A file that predates the container fails with
+// errLegacyIndex.
+func openContainerReader(path string) (*IndexReader, map[string]containerSection, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	sections, err := readContainer(file, info.Size())
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if *cfigs.Bool(kVerifyIndexData) {
+		if err := verifySection(file, sections, sectionData); err != nil {
+			_ = file.Close()
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &IndexReader{file: file, closer: file, Header: map[string][2]int64{}}, sections, nil
+}
+
+// OpenIndexReader opens an index file written by buildIndex or buildPositionIndex and decodes its DICT section
+func OpenIndexReader(path string) (*IndexReader, error) {
+	reader, _, err := openDictReader(path)
+	return reader, err
+}
+
+// openDictReader is OpenIndexReader returning the section table as well, for containers with more sections
+func openDictReader(path string) (*IndexReader, map[string]containerSection, error) {
+	reader, sections, err := openContainerReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := readSection(reader.file, sections, sectionDict)
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if reader.Header, reader.Terms, err = decodeDict(data); err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reader, sections, nil
+}
+
+// OpenRecordReader opens a file without a header whose records are found through a separate index,
+// such as apario-search-cache.jsonl and cache_index.txt
+func OpenRecordReader(path string) (*IndexReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexReader{file: file, closer: file, Header: map[string][2]int64{}}, nil
+}
+
+// sharedRecordReader is a record reader that a reload replaces while searches may still be reading it.
+// refs counts the reference of the variable that publishes it plus every read in flight, see readPage;
+// the last one closes the file.
+type sharedRecordReader struct {
+	*IndexReader
+	refs atomic.Int64
+}
+
+// newSharedRecordReader holds the reference of the variable reader is about to be published in
+func newSharedRecordReader(reader *IndexReader) *sharedRecordReader {
+	shared := &sharedRecordReader{IndexReader: reader}
+	shared.refs.Store(1)
+	return shared
+}
+
+// release drops one reference, closing the file with the last one; releasing nil does nothing
+func (r *sharedRecordReader) release() {
+	if r != nil && r.refs.Add(-1) == 0 {
+		_ = r.IndexReader.Close()
+	}
+}
+
+// Read returns the record stored at offsetLen [offset, length]
+func (r *IndexReader) Read(offsetLen [2]int64) ([]byte, error) {
+	data := make([]byte, offsetLen[1])
+	if _, err := r.file.ReadAt(data, offsetLen[0]); err != nil {
+		return nil, fmt.Errorf("read %d bytes at %d: %w", offsetLen[1], offsetLen[0], err)
+	}
+	return data, nil
+}
+
+// Bitmap decodes the roaring bitmap stored at offsetLen [offset, length]
+func (r *IndexReader) Bitmap(offsetLen [2]int64) (*roaring.Bitmap, error) {
+	if offsetLen[0] < 0 || offsetLen[1] <= 0 {
+		return roaring.New(), nil
+	}
+	data, err := r.Read(offsetLen)
+	if err != nil {
+		return nil, err
+	}
+	b := roaring.New()
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return b, nil
+}
+
+// KeyBitmap decodes the bitmap of key, which is empty when the index doesn't hold key
+func (r *IndexReader) KeyBitmap(key string) (*roaring.Bitmap, error) {
+	offsetLen, ok := r.Header[key]
+	if !ok {
+		return roaring.New(), nil
+	}
+	return r.Bitmap(offsetLen)
+}
+
+// Page decodes the PageData stored at offsetLen [offset, length] of the cache file
+func (r *IndexReader) Page(offsetLen [2]int64) (*PageData, error) {
+	data, err := r.Read(offsetLen)
+	if err != nil {
+		return nil, err
+	}
+	var page PageData
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Close closes the underlying file; closing a nil IndexReader does nothing
+func (r *IndexReader) Close() error {
+	if r == nil || r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
@@ -22,6 +22,34 @@ const (
 	kWagnerFisherDCost                 string = "wagner-fisher-dcost"
 	kWagnerFisherMaxSubs               string = "wagner-fisher-max-subs"
 	kHammingMaxSubs                    string = "hamming-max-subs"
+	kJaroThresholdFloor                string = "jaro-threshold-floor"
+	kJaroThresholdCeiling              string = "jaro-threshold-ceiling"
+	kJaroWinklerThresholdFloor         string = "jaro-winkler-threshold-floor"
+	kJaroWinklerThresholdCeiling       string = "jaro-winkler-threshold-ceiling"
+	kHammingMaxSubsFloor               string = "hamming-max-subs-floor"
+	kHammingMaxSubsCeiling             string = "hamming-max-subs-ceiling"
+	kUkkonenMaxSubsFloor               string = "ukkonen-max-subs-floor"
+	kUkkonenMaxSubsCeiling             string = "ukkonen-max-subs-ceiling"
+	kWagnerFisherMaxSubsFloor          string = "wagner-fisher-max-subs-floor"
+	kWagnerFisherMaxSubsCeiling        string = "wagner-fisher-max-subs-ceiling"
+	kWildcardMaxTerms                  string = "wildcard-max-terms"
+	kRegexMaxTerms                     string = "regex-max-terms"
+	kRegexTimeoutMs                    string = "regex-timeout-ms"
+	kMetadataFields                    string = "metadata-fields"
+	kMigrateIndexes                    string = "migrate-indexes"
+	kVerifyIndexData                   string = "verify-index-data"
+	kSegmentMergeFactor                string = "segment-merge-factor"
+	kBaseRewriteRatio                  string = "base-rewrite-ratio"
+	kBM25K1                            string = "bm25-k1"
+	kBM25B                             string = "bm25-b"
+	kBM25CategoryBoost                 string = "bm25-category-boost"
+	kCategoryWeights                   string = "category-weights"
+	kSnippetChars                      string = "snippet-chars"
+	kSearchTimeoutMs                   string = "search-timeout-ms"
+	kSearchLimit                       string = "search-limit"
+	kSearchMaxLimit                    string = "search-max-limit"
+	kGroupBestPages                    string = "group-best-pages"
+	kGroupPageDecay                    string = "group-page-decay"
 	kMaxOpenFiles                      string = "max-open-files"
 	kRateLimitEnabled                  string = "rate-limit-enabled"
 	kRateLimitRequestsPerSecond        string = "rate-limit-requests-per-second"
@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"sync"
 	"syscall"
 )
@@ -42,53 +41,17 @@ func main() {
 	wg := sync.WaitGroup{}
 	systemSearchSemaphore = sema.New(*cfigs.Int(kMaxSearches))
 
-	// Check cache integrity
-	cacheFiles := []string{cacheFile, cacheIndexFile, wordIndexFile, gemIndexFile}
-	cacheValid := true
-	for _, file := range cacheFiles {
-		filePath := filepath.Join(*cfigs.String(kCacheDir), file)
-		checksumPath := filePath + ".sha256"
-		if !verifyChecksum(filePath, checksumPath) {
-			cacheValid = false
-			break
-		}
-	}
-
 	// Initialize cache
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		log.Println("Checking cache...")
-		if cacheValid {
-			log.Println("Cache files validated, loading search data...")
-			if err := loadSearchData(); err != nil {
-				errorLogger.Printf("Failed to load search data: %v", err)
-				cancel()
-				return
-			}
-			log.Println("Search data loaded successfully")
-		} else {
-			log.Println("Cache invalid or missing, rebuilding...")
-			if err := buildCache(*cfigs.String(kDir)); err != nil {
-				errorLogger.Printf("Cache initialization failed: %v", err)
-				cancel()
-				return
-			}
-			log.Println("Cache initialized successfully")
-			// Generate checksums after build
-			for _, file := range cacheFiles {
-				filePath := filepath.Join(*cfigs.String(kCacheDir), file)
-				if err := generateChecksum(filePath); err != nil {
-					errorLogger.Printf("Failed to generate checksum for %s: %v", file, err)
-				}
-			}
-			if err := loadSearchData(); err != nil {
-				errorLogger.Printf("Failed to load search data: %v", err)
-				cancel()
-				return
-			}
-			log.Println("Search data loaded successfully")
+		if err := openCache(*cfigs.String(kDir)); err != nil {
+			errorLogger.Printf("Failed to load search data: %v", err)
+			cancel()
+			return
 		}
+		log.Println("Search data loaded successfully")
 	}()
 
 	// Start web server
@@ -105,15 +68,8 @@ func main() {
 		log.Printf("Received %v signal, initiating shutdown...", sig)
 		cancel() // Cancel the context to signal goroutines to stop
 
-		if wordIndexHandle != nil {
-			_ = wordIndexHandle.Close()
-		}
-		if gemIndexHandle != nil {
-			_ = gemIndexHandle.Close()
-		}
-		if cacheFileHandle != nil {
-			_ = cacheFileHandle.Close()
-		}
+		closeSearchIndex()
+		closeCacheReader()
 	}
 
 	// Wait for all goroutines to complete with a timeout
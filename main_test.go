@@ -1,10 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"github.com/stretchr/testify/assert"
 	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/andreimerlescu/gematria"
+	"github.com/andreimerlescu/sema"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -20,12 +43,11 @@ const (
 	Q10
 	Q11
 	Q12
+	Q13
 )
 
-func TestAnalyzeQuery(t *testing.T) {
+func TestParseQuery(t *testing.T) {
 	var (
-		ok bool
-		sa SearchAnalysis
 		qs = map[uint]string{
 			Q1:  "(top secret or confidential) and communist and oswald not thought",
 			Q2:  "top secret and oswald",
@@ -39,204 +61,1519 @@ func TestAnalyzeQuery(t *testing.T) {
 			Q10: "(top secret,confidential , classified) && (communist,communism,commie) !(assassinated|killed||died,murdered) !mustard !sausage && bacon && lettuce",
 			Q11: "(secret or confidential or classified) not (cover or intentionally left blank) and (President Kennedy or John F Kennedy or President JFK or POTUS JFK or POTUS 35)",
 			Q12: "(orange juice or coffee or apple juice or tomato juice) and (sunny side up or over easy or scrambled or omelet) not alcohol and jesus and (toast or fruit bowl or french crepe)",
+			Q13: "((oswald or ruby) and not (cuba or russia)) or \"warren commission\"",
+		}
+		want = map[uint]string{
+			Q1:  "and(or(top secret, confidential), communist, oswald, not(thought))",
+			Q2:  "and(top secret, oswald)",
+			Q3:  "and(top secret, communist, not(oswald))",
+			Q4:  "and(or(top secret, confidential, classified), or(assassin, murder, kill), or(kennedy, president), or(communi, infiltrat), not(or(cover page, blank page, unclassified)))",
+			Q5:  "and(top secret, communist, not(oswald))",
+			Q6:  "and(or(communism, communist), or(top secret, confidential), communist, not(kevin bacon))",
+			Q7:  "and(or(top secret, confidential, classified), or(communist, communism, commie), or(assassinated, killed, died, murdered))",
+			Q8:  "and(or(top secret, confidential, classified), or(communist, communism, commie), not(or(assassinated, killed, died, murdered)), bacon, not(sausage), lettuce, not(mustard))",
+			Q9:  "and(or(top secret, confidential, classified), or(communist, communism, commie), not(or(assassinated, killed, died, murdered)), not(mustard), not(sausage), bacon, lettuce)",
+			Q10: "and(or(top secret, confidential, classified), or(communist, communism, commie), not(or(assassinated, killed, died, murdered)), not(mustard), not(sausage), bacon, lettuce)",
+			Q11: "and(or(secret, confidential, classified), not(or(cover, intentionally left blank)), or(president kennedy, john f kennedy, president jfk, potus jfk, potus 35))",
+			Q12: "and(or(orange juice, coffee, apple juice, tomato juice), or(sunny side up, over easy, scrambled, omelet), not(alcohol), jesus, or(toast, fruit bowl, french crepe))",
+			Q13: "or(and(or(oswald, ruby), not(or(cuba, russia))), \"warren commission\")",
 		}
 	)
 
 	for qno, q := range qs {
-		switch qno {
-		case Q1:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%02d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.NotContains(t, sa.Ands, "thought")
-				ok = assert.Contains(t, sa.Ands, "oswald")
-				ok = assert.Contains(t, sa.Nots, "thought")
-				ok = assert.NotContains(t, sa.Nots, "oswald")
-				ok = assert.Len(t, sa.Ors, 1)
-				ok = assert.Len(t, sa.Ands, 3)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
-			}
-		case Q2:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.Empty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.Empty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "top secret")
-				ok = assert.Contains(t, sa.Ands, "oswald")
-				ok = assert.Len(t, sa.Ors, 0)
-				ok = assert.Len(t, sa.Ands, 2) // Adjusted to 2
-				ok = assert.Len(t, sa.Nots, 0)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
-			}
-		case Q3:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.Empty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "top secret")
-				ok = assert.Contains(t, sa.Ands, "communist")
-				ok = assert.Contains(t, sa.Nots, "oswald")
-				ok = assert.Len(t, sa.Ors, 0)
-				ok = assert.Len(t, sa.Ands, 2)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
-			}
-		case Q4:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(top secret or confidential or classified)")
-				ok = assert.Contains(t, sa.Ands, "(communi or infiltrat)")
-				ok = assert.Contains(t, sa.Nots, "(cover page or blank page or unclassified)")
-				ok = assert.Len(t, sa.Ors, 5)
-				ok = assert.Len(t, sa.Ands, 4)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
-			}
-		case Q5:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.Empty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Len(t, sa.Ors, 0)
-				ok = assert.Len(t, sa.Ands, 2)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
-			}
-		case Q6:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(communist)")
-				ok = assert.NotContains(t, sa.Ands, "kevin bacon")
-				ok = assert.Contains(t, sa.Nots, "kevin bacon")
-				ok = assert.Len(t, sa.Ors, 2)
-				ok = assert.Len(t, sa.Ands, 3)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+		log.Println(fmt.Sprintf("PROCESSING QUERY #%02d `%#v`", qno, q))
+		tree, err := ParseQuery(q)
+		if assert.NoError(t, err, "query #%02d", qno) {
+			assert.Equal(t, want[qno], tree.String(), "query #%02d", qno)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	positions := map[string]int{
+		"":                   0,
+		"oswald and":         10,
+		"and oswald":         0,
+		"(oswald or mexico":  0,
+		"oswald) or ruby":    6,
+		"top () secret":      4,
+		`oswald "top secret`: 7,
+		`"" and oswald`:      0,
+	}
+	for q, pos := range positions {
+		_, err := ParseQuery(q)
+		var queryErr *QueryError
+		if assert.ErrorAs(t, err, &queryErr, "query `%s`", q) {
+			assert.Equal(t, pos, queryErr.Pos, "query `%s`: %v", q, err)
+		}
+	}
+}
+
+// loadTestCorpus writes docs into a temporary apario-writer style directory, builds the search
+// cache from it and loads it for searching. docs maps a document identifier to its page texts;
+// the page identifiers are "<document>-p<page number>".
+func loadTestCorpus(t *testing.T, docs map[string][]string) {
+	t.Helper()
+	loadTestCorpusWithRecords(t, docs, nil)
+}
+
+// loadTestCorpusWithRecords is loadTestCorpus with the record.json of some documents given verbatim
+func loadTestCorpusWithRecords(t *testing.T, docs map[string][]string, records map[string]string) {
+	t.Helper()
+	dir, cacheDir := t.TempDir(), t.TempDir()
+	*cfigs.String(kDir) = dir
+	*cfigs.String(kCacheDir) = cacheDir
+	if errorLogger == nil {
+		errorLogger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if systemSearchSemaphore == nil {
+		systemSearchSemaphore = sema.New(*cfigs.Int(kMaxSearches))
+	}
+	for docID, pages := range docs {
+		pagesDir := filepath.Join(dir, docID, "pages")
+		require.NoError(t, os.MkdirAll(pagesDir, 0755))
+		record, ok := records[docID]
+		if !ok {
+			record = fmt.Sprintf(`{"identifier": %q}`, docID)
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dir, docID, "record.json"), []byte(record), 0644))
+		for i, text := range pages {
+			page := fmt.Sprintf(`{"identifier": "%s-p%d"}`, docID, i+1)
+			require.NoError(t, os.WriteFile(filepath.Join(pagesDir, fmt.Sprintf("page.%06d.json", i+1)), []byte(page), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(pagesDir, fmt.Sprintf("ocr.%06d.txt", i+1)), []byte(text), 0644))
+		}
+	}
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	t.Cleanup(func() {
+		closeSearchIndex()
+		closeCacheReader()
+	})
+}
+
+// evalQuery parses q and returns the sorted page identifiers of every page in its result bitmap,
+// matching terms exactly only
+func evalQuery(t *testing.T, q string) []string {
+	t.Helper()
+	tree, err := ParseQuery(q)
+	require.NoError(t, err)
+	index := acquireIndex()
+	defer index.release()
+	evaluator := &queryEvaluator{ctx: context.Background(), opts: SearchOptions{Exact: true}, index: index}
+	b, err := evaluator.run(tree)
+	require.NoError(t, err)
+	var ids []string
+	itr := b.Iterator()
+	for itr.HasNext() {
+		page, err := readPage(int(itr.Next()))
+		require.NoError(t, err)
+		ids = append(ids, page.PageIdentifier)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestPhraseSearch(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {
+			"The central intelligence agency director met the press.",
+			"The director of the central intelligence agency declined to comment.",
+			"Central intelligence agency staff briefed the agency director.",
+		},
+	})
+
+	assert.Equal(t, []string{"memo-p1"}, evalQuery(t, `"central intelligence agency director"`))
+	assert.Equal(t, []string{"memo-p2"}, evalQuery(t, `"director of the central intelligence agency"`))
+	assert.Equal(t, []string{"memo-p1", "memo-p2", "memo-p3"}, evalQuery(t, `"central intelligence agency"`))
+	assert.Equal(t, []string{"memo-p1", "memo-p3"}, evalQuery(t, `"agency director"`))
+	assert.Empty(t, evalQuery(t, `"intelligence agency director of"`))
+}
+
+func TestNearSearch(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"cable": {
+			"Oswald visited the Cuban consulate while he was in Mexico City during September.",
+			"Oswald was seen in Dallas. Many weeks and many reports later the file moved to the station in Mexico City.",
+			"Mexico City station reported that Oswald called the embassy.",
+		},
+	})
+
+	assert.Equal(t, []string{"cable-p1", "cable-p3"}, evalQuery(t, "oswald NEAR/10 mexico city"))
+	assert.Equal(t, []string{"cable-p1", "cable-p2", "cable-p3"}, evalQuery(t, "oswald NEAR/20 mexico city"))
+	assert.Equal(t, []string{"cable-p3"}, evalQuery(t, `"mexico city station" near/3 oswald`))
+	assert.Equal(t, []string{"cable-p2"}, evalQuery(t, "mexico city not oswald near/10 mexico city"))
+
+	_, err := ParseQuery("(oswald or ruby) near/5 dallas")
+	var queryErr *QueryError
+	if assert.ErrorAs(t, err, &queryErr) {
+		assert.Equal(t, 17, queryErr.Pos)
+	}
+}
+
+func TestWildcardSearch(t *testing.T) {
+	assert.True(t, globMatch("commun?st", "communist"))
+	assert.True(t, globMatch("assassinat*", "assassination"))
+	assert.False(t, globMatch("assassinat*", "assassination plot"))
+	assert.False(t, globMatch("commun?st", "communism"))
+
+	loadTestCorpus(t, map[string][]string{
+		"report": {
+			"The assassination was investigated.",
+			"Assassinated presidents are remembered.",
+			"A communist cell met at night.",
+		},
+	})
+
+	assert.Equal(t, []string{"report-p1", "report-p2"}, evalQuery(t, "assassinat*"))
+	assert.Equal(t, []string{"report-p3"}, evalQuery(t, "commun?st"))
+	assert.Equal(t, []string{"report-p1"}, evalQuery(t, "assassinat* not presidents"))
+
+	*cfigs.Int(kWildcardMaxTerms) = 1
+	defer func() { *cfigs.Int(kWildcardMaxTerms) = 1024 }()
+	tree, err := ParseQuery("presidents or assassinat*")
+	require.NoError(t, err)
+	index := acquireIndex()
+	defer index.release()
+	_, err = (&queryEvaluator{ctx: context.Background(), opts: SearchOptions{Exact: true}, index: index}).eval(tree)
+	var queryErr *QueryError
+	if assert.ErrorAs(t, err, &queryErr) {
+		assert.Equal(t, 14, queryErr.Pos)
+	}
+}
+
+func TestRegexSearch(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"report": {
+			"The assassination was investigated.",
+			"Assassinated presidents are remembered.",
+			"An assassin was never found.",
+		},
+	})
+
+	assert.Equal(t, []string{"report-p1", "report-p2"}, evalQuery(t, "/assassinat(ed|ion)/"))
+	assert.Equal(t, []string{"report-p3"}, evalQuery(t, "/assassin/"))
+	assert.Equal(t, []string{"report-p1", "report-p3"}, evalQuery(t, "/assassin.*/ and was"))
+	assert.Equal(t, []string{"report-p2"}, evalQuery(t, "/Assassinat(ED)/"))
+	assert.Equal(t, []string{"report-p3"}, evalQuery(t, "/[A-B]ssassin/"))
+
+	// ignoring case keeps the literal prefix that narrows the scan of the vocabulary
+	re, err := compileRegex("Assassinat(ed|ion)")
+	require.NoError(t, err)
+	prefix, _ := re.LiteralPrefix()
+	assert.Equal(t, "assassinat", prefix)
+
+	// a slash that doesn't open a regular expression is part of its word
+	for q, want := range map[string]string{
+		"a /b":            "a /b",
+		"9/11 report":     "9/11 report",
+		"/a/b":            "/a/b",
+		"/":               "/",
+		"(/Oswal.*/)":     "/Oswal.*/",
+		`/mm\/dd/ or x/y`: "or(/mm/dd/, x/y)",
+	} {
+		tree, err := ParseQuery(q)
+		if assert.NoError(t, err, q) {
+			assert.Equal(t, want, tree.String(), q)
+		}
+	}
+
+	for q, pos := range map[string]int{"oswald /[a-z/": 7, "oswald /(/": 7, "//": 0} {
+		_, err := ParseQuery(q)
+		var queryErr *QueryError
+		if assert.ErrorAs(t, err, &queryErr, q) {
+			assert.Equal(t, pos, queryErr.Pos, q)
+		}
+	}
+
+	_, err = expandRegex([]string{"a", "b"}, regexp.MustCompile("^(?:.*)$"), 1, time.Second)
+	assert.ErrorAs(t, err, new(errTooManyTerms))
+	_, err = expandRegex([]string{"a", "b"}, regexp.MustCompile("^(?:.*)$"), 10, -time.Second)
+	assert.ErrorAs(t, err, new(errRegexTimeout))
+}
+
+func TestFieldFilters(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo":  {"Oswald was in Dallas.", "Ruby shot Oswald."},
+		"cable": {"Oswald visited Mexico City."},
+	})
+
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, evalQuery(t, "oswald doc:memo"))
+	assert.Equal(t, []string{"cable-p1"}, evalQuery(t, "oswald exclude_doc:memo"))
+	assert.Equal(t, []string{"memo-p2"}, evalQuery(t, "oswald not page:memo-p1 doc:MEMO"))
+	assert.Equal(t, []string{"cable-p1", "memo-p1", "memo-p2"}, evalQuery(t, "cover:memo-p1 or mexico"))
+
+	tree, err := ParseQuery("lee harvey doc:memo oswald")
+	require.NoError(t, err)
+	assert.Equal(t, "and(lee harvey, doc:memo, oswald)", tree.String())
+
+	opts := defaultSearchOptions()
+	opts.Filters = []QueryNode{fieldFilterNode("doc", "cable", true, 0)}
+	results, err := search(context.Background(), "oswald", opts)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"memo-p1", "memo-p2"}, results.Categories["exact/textee"])
+}
+
+func TestMetadataFacets(t *testing.T) {
+	loadTestCorpusWithRecords(t, map[string][]string{
+		"memo":  {"Oswald was in Dallas.", "Ruby shot Oswald."},
+		"cable": {"Oswald visited Mexico City."},
+		"note":  {"Nothing about him."},
+	}, map[string]string{
+		"memo":  `{"identifier": "memo", "agency": "CIA", "collection": ["JFK", "2017 Release"]}`,
+		"cable": `{"identifier": "cable", "agency": "FBI", "collection": "JFK", "pages": 1}`,
+		"note":  `{"identifier": "note", "agency": "CIA"}`,
+	})
+
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, evalQuery(t, "oswald agency:cia"))
+	assert.Equal(t, []string{"cable-p1"}, evalQuery(t, "oswald exclude_collection:\"2017 release\""))
+
+	results, err := search(context.Background(), "oswald", defaultSearchOptions())
+	require.NoError(t, err)
+	index := acquireIndex()
+	defer index.release()
+	assert.Equal(t, map[string]map[string]uint64{
+		"agency":     {"cia": 2, "fbi": 1},
+		"collection": {"jfk": 3, "2017 release": 2},
+	}, index.facetCounts([]string{"agency", "collection"}, results.Pages))
+
+	_, err = ParseQuery("oswald agency: dallas")
+	var queryErr *QueryError
+	if assert.ErrorAs(t, err, &queryErr) {
+		assert.Equal(t, 7, queryErr.Pos)
+	}
+}
+
+func TestGematriaOperators(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald was in Dallas.", "Ruby shot him."},
+	})
+	oswald := gematria.FromString("oswald")
+	ruby := gematria.FromString("ruby")
+
+	assert.Equal(t, []string{"memo-p1"}, evalQuery(t, fmt.Sprintf("english:%d", oswald.English)))
+	assert.Equal(t, []string{"memo-p1"}, evalQuery(t, "simple:=oswald"))
+	assert.Equal(t, []string{"memo-p2"}, evalQuery(t, fmt.Sprintf("jewish:%d..%d not simple:=oswald", ruby.Jewish, ruby.Jewish)))
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, evalQuery(t, "majestic:0.."))
+
+	tree, err := ParseQuery(`dallas english:..100 simple:="lee harvey"`)
+	require.NoError(t, err)
+	assert.Equal(t, `and(dallas, english:..100, simple:="lee harvey")`, tree.String())
+
+	for q, pos := range map[string]int{"oswald english:abc": 7, "jewish:700..600": 0, "simple:=": 0, "eights:..": 0} {
+		_, err := ParseQuery(q)
+		var queryErr *QueryError
+		if assert.ErrorAs(t, err, &queryErr, q) {
+			assert.Equal(t, pos, queryErr.Pos, q)
+		}
+	}
+}
+
+func TestSearchOptions(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald was in Dallas.", "Oswalt signed the memo."},
+	})
+
+	exactOnly, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	results, err := search(context.Background(), "oswald", exactOnly)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"exact/textee": {"memo-p1"}}, results.Categories)
+
+	no := false
+	soundexOnly, err := defaultSearchOptions().withMatchers([]string{"Soundex"}, []string{""}, &no)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"soundex"}, soundexOnly.FuzzyAlgos)
+	results, err = search(context.Background(), "oswald", soundexOnly)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fuzzy/soundex"}, mapsKeys(results.Categories))
+	assert.ElementsMatch(t, []string{"memo-p1", "memo-p2"}, results.Categories["fuzzy/soundex"])
+
+	english, err := defaultSearchOptions().withMatchers([]string{}, []string{"english"}, &no)
+	require.NoError(t, err)
+	results, err = search(context.Background(), "oswald", english)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gematria/english"}, mapsKeys(results.Categories))
+
+	_, err = defaultSearchOptions().withMatchers([]string{"levenshtein"}, nil, nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, sessionKey("oswald", exactOnly), sessionKey("oswald", soundexOnly))
+}
+
+// mapsKeys returns the sorted keys of m
+func mapsKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestThresholdOverrides(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald was in Dallas.", "Osweld signed the memo."},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{"hamming"}, []string{}, nil)
+	require.NoError(t, err)
+
+	strict, err := opts.withThresholds(map[string]float64{"hamming_max_subs": 0})
+	require.NoError(t, err)
+	results, err := search(context.Background(), "oswald", strict)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"memo-p1"}, results.Categories["fuzzy/hamming"])
+
+	loose, err := opts.withThresholds(map[string]float64{"hamming_max_subs": 1})
+	require.NoError(t, err)
+	results, err = search(context.Background(), "oswald", loose)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"memo-p1", "memo-p2"}, results.Categories["fuzzy/hamming"])
+	assert.Equal(t, 2, *cfigs.Int(kHammingMaxSubs), "overrides must not touch the global config")
+
+	for _, overrides := range []map[string]float64{
+		{"jaro": 0.0},
+		{"jaro_winkler": 1.5},
+		{"ukkonen_max_subs": 1.5},
+		{"hamming_max_subs": 99},
+		{"levenshtein": 1},
+	} {
+		_, err := opts.withThresholds(overrides)
+		assert.Error(t, err, overrides)
+	}
+}
+
+func TestConcurrentSearches(t *testing.T) {
+	docs := make(map[string][]string)
+	words := []string{"oswald", "dallas", "ruby", "mexico", "city", "cuban", "embassy", "station", "report", "agency"}
+	for d := 0; d < 8; d++ {
+		var pages []string
+		for p := 0; p < 6; p++ {
+			var text []string
+			for w := 0; w < 12; w++ {
+				text = append(text, words[(d*7+p*3+w*w)%len(words)])
 			}
-		case Q7:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.Empty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(top secret or confidential or classified)")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 3)
-				ok = assert.Len(t, sa.Nots, 0)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+			pages = append(pages, strings.Join(text, " ")+".")
+		}
+		docs[fmt.Sprintf("doc%d", d)] = pages
+	}
+	loadTestCorpus(t, docs)
+	previous := systemSearchSemaphore
+	systemSearchSemaphore = sema.New(64)
+	defer func() { systemSearchSemaphore = previous }()
+
+	queries := []string{
+		"oswald", "oswald and dallas", "ruby or mexico not city", `"mexico city"`, "oswald near/3 ruby",
+		"cub*", "/emb.*/", "doc:doc3 station", "english:=agency", "report not (oswald or dallas)",
+	}
+	serial := make(map[string]SearchResults)
+	for _, q := range queries {
+		results, err := search(context.Background(), q, defaultSearchOptions())
+		require.NoError(t, err)
+		serial[q] = results
+	}
+
+	var wg sync.WaitGroup
+	failures := make(chan string, 400)
+	for i := 0; i < 400; i++ {
+		wg.Add(1)
+		go func(q string) {
+			defer wg.Done()
+			results, err := search(context.Background(), q, defaultSearchOptions())
+			if err != nil {
+				failures <- fmt.Sprintf("%s: %v", q, err)
+				return
 			}
-		case Q8:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(top secret or confidential or classified)")
-				ok = assert.Contains(t, sa.Ands, "(communist or communism or commie)")
-				ok = assert.Contains(t, sa.Ands, "bacon")
-				ok = assert.Contains(t, sa.Ands, "lettuce")
-				ok = assert.Contains(t, sa.Nots, "(assassinated or killed or died or murdered)")
-				ok = assert.Contains(t, sa.Nots, "sausage")
-				ok = assert.Contains(t, sa.Nots, "mustard")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 4)
-				ok = assert.Len(t, sa.Nots, 3)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+			if !assert.ObjectsAreEqual(serial[q].Categories, results.Categories) || !serial[q].Pages.Equals(results.Pages) {
+				failures <- fmt.Sprintf("%s: results differ from the serial run", q)
 			}
-		case Q9:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(top secret or confidential or classified)")
-				ok = assert.Contains(t, sa.Ands, "(communist or communism or commie)")
-				ok = assert.Contains(t, sa.Ands, "bacon")
-				ok = assert.Contains(t, sa.Ands, "lettuce")
-				ok = assert.Contains(t, sa.Nots, "(assassinated or killed or died or murdered)")
-				ok = assert.Contains(t, sa.Nots, "mustard")
-				ok = assert.Contains(t, sa.Nots, "sausage")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 4)
-				ok = assert.Len(t, sa.Nots, 3)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+		}(queries[i%len(queries)])
+	}
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+}
+
+func TestFuzzyIndexMatchesBruteForce(t *testing.T) {
+	vocabulary := []string{
+		"oswald", "osvald", "oswalt", "oswaldo", "waldo", "dallas", "dalas", "dallastexas", "ruby", "rubin",
+		"robert", "rupert", "mexico", "mexican", "city", "cite", "cuba", "cuban", "cubano", "embassy",
+		"embasy", "station", "nation", "report", "reported", "agency", "agent", "a", "ab", "ba", "aab", "abc123",
+		"2025", "20251", "assassination", "assasination", "assassinated", "intelligence", "inteligence",
+		"oswald dallas", "lee harvey oswald",
+	}
+	queries := append([]string{"oswld", "dalla", "rubyy", "xyz", "assassin", "z"}, vocabulary...)
+	// words of few letters share many bytes and bigrams, which puts the gram index to work
+	random := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool)
+	for _, word := range vocabulary {
+		seen[word] = true
+	}
+	for size := len(vocabulary) + 600; len(vocabulary) < size; {
+		word := make([]byte, 3+random.Intn(8))
+		for i := range word {
+			word[i] = "aeilnorst"[random.Intn(9)]
+		}
+		if !seen[string(word)] {
+			seen[string(word)] = true
+			vocabulary = append(vocabulary, string(word))
+			if len(seen)%15 == 0 {
+				queries = append(queries, string(word), string(word[1:]))
 			}
-		case Q10:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 || len(sa.Nots) > 0 || len(sa.Ors) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(top secret or confidential  or classified)")
-				ok = assert.Contains(t, sa.Ands, "(communist or communism or commie)")
-				ok = assert.Contains(t, sa.Ands, "bacon")
-				ok = assert.Contains(t, sa.Ands, "lettuce")
-				ok = assert.Contains(t, sa.Nots, "(assassinated|killed or died or murdered)")
-				ok = assert.Contains(t, sa.Nots, "mustard")
-				ok = assert.Contains(t, sa.Nots, "sausage")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 4) // Adjusted to 4
-				ok = assert.Len(t, sa.Nots, 3) // Adjusted to 3
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+		}
+	}
+	sort.Strings(vocabulary)
+
+	// the index that buildIndex writes into the FUZZ section of the word index must shortlist the same
+	// terms as the one built in memory
+	path := filepath.Join(t.TempDir(), wordIndexFile)
+	require.NoError(t, writeRecordIndex(path, slices.Clone(vocabulary), func(string) ([]byte, error) {
+		return []byte{1}, nil
+	}, fuzzySection))
+	reader, sections, err := openDictReader(path)
+	require.NoError(t, err)
+	require.Contains(t, sections, sectionFuzzy)
+	require.NoError(t, reader.Close())
+	reader, decoded, err := OpenWordIndex(path)
+	require.NoError(t, err)
+	defer reader.Close()
+	indexes := map[string]*fuzzyIndex{"built": buildFuzzyIndex(vocabulary), "decoded": decoded}
+
+	thresholds := []Thresholds{
+		defaultSearchOptions().Thresholds,
+		{Jaro: 0.6, JaroWinkler: 0.6, HammingMaxSubs: 0, UkkonenMaxSubs: 0, WagnerFisherMaxSubs: 0},
+		{Jaro: 0.8, JaroWinkler: 0.85, HammingMaxSubs: 2, UkkonenMaxSubs: 3, WagnerFisherMaxSubs: 4},
+		{Jaro: 0.9, JaroWinkler: 0.92, HammingMaxSubs: 1, UkkonenMaxSubs: 1, WagnerFisherMaxSubs: 2},
+		{Jaro: 0.95, JaroWinkler: 0.97, HammingMaxSubs: 1, UkkonenMaxSubs: 2, WagnerFisherMaxSubs: 1},
+		{Jaro: 1.0, JaroWinkler: 1.0, HammingMaxSubs: 3, UkkonenMaxSubs: 4, WagnerFisherMaxSubs: 1},
+	}
+	for name, index := range indexes {
+		for _, limits := range thresholds {
+			for _, algo := range fuzzyAlgorithms {
+				shortlisted := 0
+				for _, word := range queries {
+					var expected, actual []string
+					for _, term := range vocabulary {
+						if matchesConditionSingle(word, term, algo, limits) {
+							expected = append(expected, term)
+						}
+					}
+					candidates := index.candidates(word, algo, limits)
+					shortlisted += len(candidates)
+					for _, term := range candidates {
+						if matchesConditionSingle(word, term, algo, limits) {
+							actual = append(actual, term)
+						}
+					}
+					sort.Strings(actual)
+					assert.Equal(t, expected, actual, "%s %s %q %+v", name, algo, word, limits)
+				}
+				if algo == "jaro" && limits.Jaro >= 0.9 {
+					assert.Less(t, shortlisted, len(queries)*len(vocabulary)/20, "%s %s %+v", name, algo, limits)
+				}
 			}
-		case Q11:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(secret or confidential or classified)")
-				ok = assert.Contains(t, sa.Ands, "(president kennedy or john f kennedy or president jfk or potus jfk or potus 35)")
-				ok = assert.Contains(t, sa.Nots, "(cover or intentionally left blank)")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 2)
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+		}
+	}
+}
+
+// writeLegacyIndex writes an index in the layout of buildIndex before the index container: the 8-byte
+// offset of a JSON header that maps each key to the [offset, length] of its bitmap
+func writeLegacyIndex(t *testing.T, path string, keys map[string][]uint32) {
+	t.Helper()
+	data := make([]byte, 8)
+	header := make(map[string][2]int64)
+	for key, pageIDs := range keys {
+		bitmap, err := roaring.BitmapOf(pageIDs...).MarshalBinary()
+		require.NoError(t, err)
+		header[key] = [2]int64{int64(len(data)), int64(len(bitmap))}
+		data = append(data, bitmap...)
+	}
+	binary.LittleEndian.PutUint64(data, uint64(len(data)))
+	headerJSON, err := json.Marshal(header)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, append(data, headerJSON...), 0644))
+}
+
+func TestIndexMigration(t *testing.T) {
+	dir := t.TempDir()
+	postings := filepath.Join(dir, "postings.txt")
+	require.NoError(t, os.WriteFile(postings, []byte("oswald 1\noswald 4\ndallas 2\nruby 3\n"), 0644))
+	gemPostings := filepath.Join(dir, "gematria_postings.txt")
+	require.NoError(t, os.WriteFile(gemPostings, []byte("english_120 1\nenglish_120 4\nsimple_20 1\nenglish_600 2\nmajestic_7 3\n"), 0644))
+
+	built := filepath.Join(dir, "built.bin")
+	require.NoError(t, buildIndex(postings, built))
+	unlimited := filepath.Join(dir, "unlimited.bin")
+	require.NoError(t, buildIndexUnlimited(postings, unlimited))
+	legacy := filepath.Join(dir, "legacy.bin")
+	writeLegacyIndex(t, legacy, map[string][]uint32{"oswald": {1, 4}, "dallas": {2}, "ruby": {3}})
+
+	_, err := OpenIndexReader(legacy)
+	assert.ErrorIs(t, err, errLegacyIndex)
+	*cfigs.Bool(kMigrateIndexes) = false
+	assert.ErrorContains(t, loadIndexFile(legacy, false), kMigrateIndexes)
+	*cfigs.Bool(kMigrateIndexes) = true
+	migrated, err := migrateIndex(built, false)
+	require.NoError(t, err)
+	assert.False(t, migrated, "a container needs no migration")
+	migrated, err = migrateIndex(legacy, false)
+	require.NoError(t, err)
+	assert.True(t, migrated)
+
+	for _, path := range []string{built, unlimited, legacy} {
+		reader, err := OpenIndexReader(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, []string{"dallas", "oswald", "ruby"}, reader.Terms, path)
+		b, err := reader.KeyBitmap("oswald")
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{1, 4}, b.ToArray(), path)
+		require.NoError(t, reader.Close())
+	}
+
+	gemBuilt := filepath.Join(dir, "gematria_built.bin")
+	require.NoError(t, buildGematriaIndex(gemPostings, gemBuilt))
+	gemLegacy := filepath.Join(dir, "gematria_legacy.bin")
+	writeLegacyIndex(t, gemLegacy, map[string][]uint32{"english_120": {1, 4}, "simple_20": {1}, "english_600": {2}, "majestic_7": {3}})
+	migrated, err = migrateIndex(gemLegacy, true)
+	require.NoError(t, err)
+	assert.True(t, migrated)
+	for _, path := range []string{gemBuilt, gemLegacy} {
+		reader, lookup, err := OpenGematriaIndex(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, 4, lookup.size(), path)
+		english, _ := cipherID("english")
+		offsetLen, ok := lookup[english].byValue[120]
+		require.True(t, ok, path)
+		b, err := reader.Bitmap(offsetLen)
+		require.NoError(t, err)
+		assert.Equal(t, []uint32{1, 4}, b.ToArray(), path)
+		assert.Equal(t, []uint64{120, 600}, []uint64{lookup[english].postings[0].value, lookup[english].postings[1].value}, path)
+		require.NoError(t, reader.Close())
+	}
+
+	// A container that isn't finished leaves the index it would replace as it was
+	c, err := createContainer(built, 2)
+	require.NoError(t, err)
+	c.beginSection(sectionData)
+	_, err = c.Write([]byte("partial"))
+	require.NoError(t, err)
+	c.endSection()
+	assert.ErrorContains(t, c.Close(), "reserved 2")
+	reader, err := OpenIndexReader(built)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dallas", "oswald", "ruby"}, reader.Terms)
+	require.NoError(t, reader.Close())
+	_, err = os.Stat(built + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the temporary file is removed")
+
+	// A flipped byte in the dictionary fails its checksum
+	data, err := os.ReadFile(built)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(built, data, 0644))
+	_, err = OpenIndexReader(built)
+	assert.ErrorContains(t, err, "checksum")
+}
+
+// TestLegacyCacheStartup starts from a cache as it was written before the index container and the
+// position, field and frequency indexes: legacy word and gematria indexes and checksums for the four
+// files that cache had. openCache must upgrade it in place rather than rebuild it from -dir.
+func TestLegacyCacheStartup(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo":  {"Oswald visited Mexico City.", "The director declined to comment."},
+		"cable": {"Oswald, Oswald and Oswald again in Dallas."},
+	})
+	closeSearchIndex()
+	closeCacheReader()
+
+	cacheDir := *cfigs.String(kCacheDir)
+	legacyPostings := func(name string) map[string][]uint32 {
+		data, err := os.ReadFile(filepath.Join(cacheDir, name))
+		require.NoError(t, err)
+		keys := make(map[string][]uint32)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			at := strings.LastIndex(line, " ")
+			require.Positive(t, at, line)
+			key, id := line[:at], line[at+1:]
+			pageID, err := strconv.Atoi(id)
+			require.NoError(t, err)
+			keys[key] = append(keys[key], uint32(pageID))
+		}
+		return keys
+	}
+	writeLegacyIndex(t, filepath.Join(cacheDir, wordIndexFile), legacyPostings("word_postings.txt"))
+	writeLegacyIndex(t, filepath.Join(cacheDir, gemIndexFile), legacyPostings("gematria_postings.txt"))
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		switch entry.Name() {
+		case cacheFile, cacheIndexFile, wordIndexFile, gemIndexFile:
+			require.NoError(t, generateChecksum(filepath.Join(cacheDir, entry.Name())))
+		case cacheFile + ".sha256", cacheIndexFile + ".sha256", wordIndexFile + ".sha256", gemIndexFile + ".sha256":
+		default:
+			require.NoError(t, os.RemoveAll(filepath.Join(cacheDir, entry.Name())))
+		}
+	}
+	// a rebuild from an empty -dir would find nothing, so every hit below comes from the upgraded cache
+	emptyDir := t.TempDir()
+
+	*cfigs.Bool(kMigrateIndexes) = false
+	assert.ErrorContains(t, openCache(emptyDir), kMigrateIndexes)
+	*cfigs.Bool(kMigrateIndexes) = true
+	require.NoError(t, openCache(emptyDir))
+
+	for _, name := range []string{wordIndexFile, gemIndexFile, positionIndexFile, fieldIndexFile, frequencyIndexFile} {
+		path := filepath.Join(cacheDir, name)
+		assert.True(t, verifyChecksum(path, path+".sha256"), name)
+	}
+	reader, err := OpenIndexReader(filepath.Join(cacheDir, wordIndexFile))
+	require.NoError(t, err, "the word index is a container after startup")
+	require.NoError(t, reader.Close())
+
+	assert.Equal(t, []string{"cable-p1", "memo-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"memo-p1"}, evalQuery(t, "oswald NEAR/2 mexico"))
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, evalQuery(t, "doc:memo"))
+	assert.Equal(t, []string{"cable-p1"}, evalQuery(t, "english:=dallas"))
+
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	opts.BM25 = &BM25Params{K1: 1.2, B: 0.75}
+	results, err := search(context.Background(), "oswald", opts)
+	require.NoError(t, err)
+	assert.Greater(t, results.Scores["cable-p1"], results.Scores["memo-p1"])
+}
+
+// writeTestDocument writes a document into -dir the way loadTestCorpus does, for the watcher to pick
+// up, and returns its directory
+func writeTestDocument(t *testing.T, docID string, pages ...string) string {
+	t.Helper()
+	dir := filepath.Join(*cfigs.String(kDir), docID)
+	pagesDir := filepath.Join(dir, "pages")
+	require.NoError(t, os.MkdirAll(pagesDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "record.json"), []byte(fmt.Sprintf(`{"identifier": %q}`, docID)), 0644))
+	for i, text := range pages {
+		page := fmt.Sprintf(`{"identifier": "%s-p%d"}`, docID, i+1)
+		require.NoError(t, os.WriteFile(filepath.Join(pagesDir, fmt.Sprintf("page.%06d.json", i+1)), []byte(page), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(pagesDir, fmt.Sprintf("ocr.%06d.txt", i+1)), []byte(text), 0644))
+	}
+	return dir
+}
+
+// segmentCount returns the number of segments searches currently read
+func segmentCount() int {
+	index := acquireIndex()
+	defer index.release()
+	return len(index.segments)
+}
+
+func TestSegments(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald visited Mexico City.", "The director declined to comment."},
+	})
+	addDocument := func(docID string, pages ...string) {
+		require.NoError(t, processNewSubdirectory(writeTestDocument(t, docID, pages...)))
+	}
+
+	addDocument("cable", "Oswald was seen in Dallas.", "The station in Mexico City reported.")
+	assert.Equal(t, 2, segmentCount())
+	assert.Equal(t, []string{"cable-p1", "memo-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"cable-p2", "memo-p1"}, evalQuery(t, `"mexico city"`))
+	assert.Equal(t, []string{"cable-p1"}, evalQuery(t, "oswald not mexico"))
+	assert.Equal(t, []string{"cable-p1", "cable-p2"}, evalQuery(t, "doc:cable"))
+	assert.Equal(t, []string{"cable-p2"}, evalQuery(t, "mexico NEAR/3 station"))
+
+	*cfigs.Int(kSegmentMergeFactor) = 2
+	defer func() { *cfigs.Int(kSegmentMergeFactor) = 4 }()
+	addDocument("note", "Ruby shot Oswald in Dallas.")
+	addDocument("wire", "Dallas police arrested Ruby.")
+	assert.Equal(t, 4, segmentCount())
+	merged, err := mergeSegmentsOnce()
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Equal(t, 3, segmentCount())
+	assert.Equal(t, []string{"cable-p1", "memo-p1", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"note-p1", "wire-p1"}, evalQuery(t, "ruby"))
+	assert.Equal(t, []string{"cable-p1", "note-p1", "wire-p1"}, evalQuery(t, "dallas"))
+
+	// a restart opens the same segments
+	require.NoError(t, loadSearchData())
+	assert.Equal(t, 3, segmentCount())
+	assert.Equal(t, []string{"note-p1", "wire-p1"}, evalQuery(t, "ruby"))
+	assert.Equal(t, []string{"wire-p1"}, evalQuery(t, "ruby not oswald"))
+}
+
+func TestSegmentMergeConcurrency(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald visited Mexico City."},
+	})
+	*cfigs.Int(kSegmentMergeFactor) = 2
+	defer func() { *cfigs.Int(kSegmentMergeFactor) = 4 }()
+	defer func() { segmentMergeWritten = nil }()
+	require.NoError(t, processNewSubdirectory(writeTestDocument(t, "cable", "Oswald was seen in Dallas.")))
+	require.NoError(t, processNewSubdirectory(writeTestDocument(t, "note", "Ruby shot Oswald in Dallas.")))
+	require.Equal(t, 3, segmentCount())
+
+	// a document and a removal that arrive while a merge is writing its segment don't wait for it
+	wire := writeTestDocument(t, "wire", "Dallas police arrested Ruby.")
+	require.NoError(t, os.RemoveAll(filepath.Join(*cfigs.String(kDir), "cable")))
+	ingested := make(chan error, 1)
+	segmentMergeWritten = func() {
+		done := make(chan error, 1)
+		go func() {
+			err := processNewSubdirectory(wire)
+			if err == nil {
+				err = deletePages(filepath.Join(*cfigs.String(kDir), "cable"))
 			}
-		case Q12:
-			log.Println(fmt.Sprintf("PROCESSING QUERY #%2d `%#v`", qno, q))
-			if sa = AnalyzeQuery(q); len(sa.Ands) > 0 {
-				log.Println(fmt.Sprintf("%#v", sa))
-				ok = assert.NotEmpty(t, sa.Ors)
-				ok = assert.NotEmpty(t, sa.Ands)
-				ok = assert.NotEmpty(t, sa.Nots)
-				ok = assert.Contains(t, sa.Ands, "(orange juice or coffee or apple juice or tomato juice)")
-				ok = assert.Contains(t, sa.Ands, "(sunny side up or over easy or scrambled or omelet)")
-				ok = assert.Contains(t, sa.Ands, "jesus")
-				ok = assert.Contains(t, sa.Ands, "(toast or fruit bowl or french crepe)")
-				ok = assert.Contains(t, sa.Nots, "alcohol")
-				ok = assert.Len(t, sa.Ors, 3)
-				ok = assert.Len(t, sa.Ands, 4) // Adjusted to 4
-				ok = assert.Len(t, sa.Nots, 1)
-				log.Println(fmt.Sprintf("\nTEST %2d COMPLETED => successful? == %#v\n", qno+1, ok))
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			ingested <- err
+		case <-time.After(5 * time.Second):
+			ingested <- fmt.Errorf("the ingest waited for the merge")
+		}
+	}
+	merged, err := mergeSegmentsOnce()
+	require.NoError(t, err)
+	require.NoError(t, <-ingested)
+	assert.True(t, merged)
+	assert.Equal(t, 3, segmentCount(), "the base, the merged and the ingested segment")
+	assert.Equal(t, []string{"memo-p1", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"note-p1", "wire-p1"}, evalQuery(t, "ruby"))
+
+	// a merge that a full rebuild overtakes is dropped instead of publishing pages the base now holds
+	require.NoError(t, processNewSubdirectory(writeTestDocument(t, "memo2", "Oswald again.")))
+	segmentMergeWritten = func() {
+		err := buildCache(*cfigs.String(kDir))
+		if err == nil {
+			err = loadSearchData()
+		}
+		ingested <- err
+	}
+	merged, err = mergeSegmentsOnce()
+	require.NoError(t, err)
+	require.NoError(t, <-ingested)
+	assert.False(t, merged)
+	assert.Equal(t, 1, segmentCount())
+	assert.Equal(t, []string{"memo-p1", "memo2-p1", "note-p1"}, evalQuery(t, "oswald"))
+	entries, err := os.ReadDir(segmentsDir())
+	if !os.IsNotExist(err) {
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo":  {"Oswald visited Mexico City.", "The director declined to comment."},
+		"cable": {"Ruby was seen in Dallas."},
+		"note":  {"Ruby shot Oswald."},
+	})
+	dir := *cfigs.String(kDir)
+
+	// a corrected page is searchable under its new text only
+	ocr := filepath.Join(dir, "memo", "pages", "ocr.000002.txt")
+	require.NoError(t, os.WriteFile(ocr, []byte("The director praised Oswald."), 0644))
+	require.NoError(t, ingestPages([]string{ocr}, "test"))
+	assert.Empty(t, evalQuery(t, "declined"))
+	assert.Equal(t, []string{"memo-p1", "memo-p2", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"memo-p2"}, evalQuery(t, "director"))
+
+	// a removed document leaves every result, negated ones included
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "cable")))
+	require.NoError(t, deletePages(filepath.Join(dir, "cable")))
+	assert.Equal(t, []string{"note-p1"}, evalQuery(t, "ruby"))
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, evalQuery(t, "not ruby"))
+
+	// tombstones outlive a restart
+	require.NoError(t, loadSearchData())
+	assert.Equal(t, []string{"note-p1"}, evalQuery(t, "ruby"))
+	assert.Empty(t, evalQuery(t, "declined"))
+
+	// a merge leaves the postings of deleted pages out
+	*cfigs.Int(kSegmentMergeFactor) = 2
+	defer func() { *cfigs.Int(kSegmentMergeFactor) = 4 }()
+	require.NoError(t, os.WriteFile(ocr, []byte("The director praised Ruby."), 0644))
+	require.NoError(t, ingestPages([]string{ocr}, "test"))
+	merged, err := mergeSegmentsOnce()
+	require.NoError(t, err)
+	assert.True(t, merged)
+	index := acquireIndex()
+	last := index.segments[len(index.segments)-1]
+	assert.Equal(t, uint64(1), last.pages.GetCardinality())
+	assert.Contains(t, last.word.Header, "ruby")
+	assert.NotContains(t, last.word.Header, "oswald")
+	index.release()
+	assert.Equal(t, []string{"memo-p2", "note-p1"}, evalQuery(t, "ruby"))
+
+	// a rebuild starts over without tombstones
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	_, err = os.Stat(filepath.Join(*cfigs.String(kCacheDir), tombstonesFile))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"memo-p1", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"memo-p2", "note-p1"}, evalQuery(t, "ruby"))
+}
+
+func TestBaseRewrite(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo":  {"Oswald visited Mexico City.", "The director declined to comment."},
+		"cable": {"Ruby was seen in Dallas."},
+		"note":  {"Ruby shot Oswald."},
+	})
+	dir := *cfigs.String(kDir)
+	baseHolds := func(term string) bool {
+		index := acquireIndex()
+		defer index.release()
+		_, ok := index.segments[0].word.Header[term]
+		return ok
+	}
+
+	// one deleted page of four stays in the base until more than the ratio are
+	*cfigs.Float64(kBaseRewriteRatio) = 0.3
+	defer func() { *cfigs.Float64(kBaseRewriteRatio) = 0.2 }()
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "cable")))
+	require.NoError(t, deletePages(filepath.Join(dir, "cable")))
+	merged, err := mergeSegmentsOnce()
+	require.NoError(t, err)
+	assert.False(t, merged)
+	assert.True(t, baseHolds("dallas"))
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "memo", "pages", "ocr.000002.txt")))
+	require.NoError(t, deletePages(filepath.Join(dir, "memo", "pages", "ocr.000002.txt")))
+	merged, err = mergeSegmentsOnce()
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Equal(t, 1, segmentCount())
+	assert.False(t, baseHolds("dallas"), "the rewrite leaves deleted pages out")
+	assert.False(t, baseHolds("director"))
+	assert.Equal(t, []string{"memo-p1", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Equal(t, []string{"note-p1"}, evalQuery(t, "ruby"))
+	assert.Equal(t, []string{"memo-p1"}, evalQuery(t, "not ruby"))
+	merged, err = mergeSegmentsOnce()
+	require.NoError(t, err)
+	assert.False(t, merged, "a rewritten base has no deleted pages left")
+
+	// the rewritten files pass their checksums, so a restart loads them rather than rebuilding
+	for _, name := range []string{wordIndexFile, gemIndexFile, positionIndexFile, fieldIndexFile, frequencyIndexFile} {
+		path := filepath.Join(*cfigs.String(kCacheDir), name)
+		assert.True(t, verifyChecksum(path, path+".sha256"), name)
+	}
+	require.NoError(t, loadSearchData())
+	assert.Equal(t, []string{"memo-p1", "note-p1"}, evalQuery(t, "oswald"))
+	assert.Empty(t, evalQuery(t, "dallas"))
+}
+
+func TestCacheReaderReload(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{"memo": {"Oswald visited Mexico City."}})
+	id, ok := pageIDs.lookup("memo-p1")
+	require.True(t, ok)
+
+	// a read that took the reader before a reload finishes on it, and the reader closes after it
+	pageOffsetsMu.RLock()
+	offsetLen, reader := cacheIdToOffset[id], cacheReader
+	reader.refs.Add(1)
+	pageOffsetsMu.RUnlock()
+	require.NoError(t, loadSearchData())
+	assert.NotSame(t, reader, cacheReader)
+	page, err := reader.Page(offsetLen)
+	require.NoError(t, err)
+	assert.Equal(t, "memo-p1", page.PageIdentifier)
+	reader.release()
+	_, err = reader.Page(offsetLen)
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	page, err = readPage(id)
+	require.NoError(t, err)
+	assert.Equal(t, "memo-p1", page.PageIdentifier)
+}
+
+func TestStablePageIDs(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald visited Mexico City.", "The director declined to comment."},
+	})
+	dir := *cfigs.String(kDir)
+	idOf := func(identifier string) int {
+		id, ok := pageIDs.lookup(identifier)
+		require.True(t, ok, identifier)
+		page, err := readPage(id)
+		require.NoError(t, err)
+		require.Equal(t, identifier, page.PageIdentifier)
+		return id
+	}
+	first, second := idOf("memo-p1"), idOf("memo-p2")
+
+	// a document that walks first doesn't renumber the pages indexed before it
+	pagesDir := filepath.Join(dir, "aaa", "pages")
+	require.NoError(t, os.MkdirAll(pagesDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "aaa", "record.json"), []byte(`{"identifier": "aaa"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(pagesDir, "page.000001.json"), []byte(`{"identifier": "aaa-p1"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(pagesDir, "ocr.000001.txt"), []byte("Ruby was seen in Dallas."), 0644))
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	assert.Equal(t, first, idOf("memo-p1"))
+	assert.Equal(t, second, idOf("memo-p2"))
+	assert.Greater(t, idOf("aaa-p1"), second)
+
+	// a modified page moves to a new ID, which the next rebuild keeps
+	ocr := filepath.Join(dir, "memo", "pages", "ocr.000002.txt")
+	require.NoError(t, os.WriteFile(ocr, []byte("The director praised Oswald."), 0644))
+	require.NoError(t, ingestPages([]string{ocr}, "test"))
+	modified := idOf("memo-p2")
+	assert.NotEqual(t, second, modified)
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	assert.Equal(t, first, idOf("memo-p1"))
+	assert.Equal(t, modified, idOf("memo-p2"))
+	assert.Equal(t, []string{"memo-p2"}, evalQuery(t, "praised"))
+
+	// two files claiming one page both keep their IDs across rebuilds
+	dupDir := filepath.Join(dir, "zzz", "pages")
+	require.NoError(t, os.MkdirAll(dupDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zzz", "record.json"), []byte(`{"identifier": "zzz"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dupDir, "page.000001.json"), []byte(`{"identifier": "memo-p1"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dupDir, "ocr.000001.txt"), []byte("A copy of the memo."), 0644))
+	duplicate := filepath.Join("zzz", "pages", "ocr.000001.txt")
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	copied := pageSources[duplicate]
+	for range 2 {
+		require.NoError(t, buildCache(dir))
+		require.NoError(t, loadSearchData())
+		assert.Equal(t, first, idOf("memo-p1"))
+		assert.Equal(t, copied, pageSources[duplicate])
+	}
+	assert.NotEqual(t, first, copied)
+
+	// a cache built before the registry existed keeps its IDs on the first rebuild
+	require.NoError(t, os.Remove(filepath.Join(*cfigs.String(kCacheDir), pageIDsFile)))
+	before := map[string]int{"memo-p1": idOf("memo-p1"), "memo-p2": idOf("memo-p2"), "aaa-p1": idOf("aaa-p1")}
+	require.NoError(t, os.WriteFile(filepath.Join(pagesDir, "page.000002.json"), []byte(`{"identifier": "aaa-p2"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(pagesDir, "ocr.000002.txt"), []byte("Ruby left Dallas."), 0644))
+	require.NoError(t, buildCache(dir))
+	require.NoError(t, loadSearchData())
+	for identifier, id := range before {
+		assert.Equal(t, id, idOf(identifier), identifier)
+	}
+	assert.FileExists(t, filepath.Join(*cfigs.String(kCacheDir), pageIDsFile))
+}
+
+func TestBM25(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {
+			"Oswald, Oswald and Oswald again.",
+			"The report mentions Oswald once among a great many other names and places and dates.",
+			"Nothing about the suspect here.",
+		},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	scores := func(query string, params BM25Params) map[string]float64 {
+		opts.BM25 = &params
+		results, err := search(context.Background(), query, opts)
+		require.NoError(t, err)
+		return results.Scores
+	}
+
+	params := BM25Params{K1: 1.2, B: 0.75}
+	ranked := scores("oswald", params)
+	require.Len(t, ranked, 2)
+	assert.Greater(t, ranked["memo-p1"], ranked["memo-p2"])
+
+	// without term frequency saturation every page holding the term scores its idf
+	params.K1 = 0
+	ranked = scores("oswald", params)
+	assert.InDelta(t, ranked["memo-p1"], ranked["memo-p2"], 1e-9)
+	assert.InDelta(t, math.Log(1+(3-2+0.5)/(2+0.5)), ranked["memo-p1"], 1e-9)
+
+	// every category a page hit adds the boost
+	params.CategoryBoost = 10
+	boosted := scores("oswald", params)
+	assert.InDelta(t, ranked["memo-p1"]+10, boosted["memo-p1"], 1e-9)
+
+	// phrases of up to three words are counted as one substring
+	params = BM25Params{K1: 1.2, B: 0.75}
+	assert.Contains(t, scores(`"oswald again"`, params), "memo-p1")
+	assert.Greater(t, scores(`"oswald again"`, params)["memo-p1"], 0.0)
+
+	require.Error(t, BM25Params{K1: 1.2, B: 1.5}.validate())
+}
+
+func TestCategoryWeights(t *testing.T) {
+	weights, err := parseCategoryWeights("exact/textee=10, fuzzy/jaro-winkler=3, gematria/*=0.5, *=0.25")
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, weights.weight("exact/textee"))
+	assert.Equal(t, 3.0, weights.weight("fuzzy/jaro-winkler"))
+	assert.Equal(t, 0.5, weights.weight("gematria/eights"))
+	assert.Equal(t, 0.25, weights.weight("fuzzy/soundex"))
+	assert.Equal(t, 1.0, CategoryWeights{}.weight("fuzzy/soundex"))
+
+	_, err = parseCategoryWeights("exact/textee")
+	require.Error(t, err)
+	_, err = parseCategoryWeights("gematria/*/x=1")
+	require.Error(t, err)
+	_, err = parseCategoryWeights("exact/textee=-1")
+	require.Error(t, err)
+
+	result := roaring.BitmapOf(1, 2)
+	categories := map[string]*roaring.Bitmap{
+		"exact/textee":    roaring.BitmapOf(1),
+		"gematria/simple": roaring.BitmapOf(1, 2),
+		"gematria/eights": roaring.BitmapOf(2),
+	}
+	ranked := rankEntries(result, &ResultWindow{Sort: "ranked", Weights: weights}, categories, nil, 0)
+	require.Len(t, ranked, 2)
+	assert.Equal(t, uint32(1), ranked[0].pageID)
+	assert.InDelta(t, 10.5, ranked[0].score, 1e-9)
+	assert.Equal(t, map[string]float64{"exact/textee": 10, "gematria/simple": 0.5}, ranked[0].breakdown)
+	assert.InDelta(t, 1.0, ranked[1].score, 1e-9)
+
+	// a request overrides single entries and keeps the rest
+	overridden := &ResultWindow{Sort: "ranked", Weights: weights.withOverrides(CategoryWeights{"gematria/eights": 20})}
+	ranked = rankEntries(result, overridden, categories, nil, 0)
+	assert.Equal(t, uint32(2), ranked[0].pageID)
+	assert.InDelta(t, 20.5, ranked[0].score, 1e-9)
+}
+
+func TestMatchDetails(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Top secret report. The agency followed Oswald, who was seen in Mexico City."},
+	})
+	*cfigs.Int(kSnippetChars) = 10
+	defer func() { *cfigs.Int(kSnippetChars) = 80 }()
+	opts, err := defaultSearchOptions().withMatchers([]string{"soundex"}, []string{"simple"}, nil)
+	require.NoError(t, err)
+	results, err := search(context.Background(), `oswald or "mexico city"`, opts)
+	require.NoError(t, err)
+
+	byCategory := make(map[string]MatchDetail)
+	for _, match := range results.Matches["memo-p1"] {
+		if match.Query == "oswald" {
+			byCategory[match.Category] = match
+		}
+	}
+	exact, ok := byCategory["exact/textee"]
+	require.True(t, ok)
+	assert.Equal(t, "oswald", exact.Text)
+	assert.Equal(t, gematria.FromString("oswald").Simple, exact.Gematria.Simple)
+	assert.Equal(t, "agency followed Oswald, who was seen", exact.Snippet)
+	assert.Equal(t, "Oswald,", exact.Snippet[exact.MatchStart:exact.MatchEnd])
+	assert.Equal(t, "Top secret report. The agency followed Oswald, who was seen in Mexico City."[exact.Offset:][:len(exact.Snippet)], exact.Snippet)
+	assert.Equal(t, "oswald", byCategory["fuzzy/soundex"].Text)
+	assert.Contains(t, byCategory, "gematria/simple")
+
+	var phrase MatchDetail
+	for _, match := range results.Matches["memo-p1"] {
+		if match.Query == `"mexico city"` {
+			phrase = match
+		}
+	}
+	assert.Equal(t, "mexico city", phrase.Text)
+	assert.Equal(t, "Mexico City.", phrase.Snippet[phrase.MatchStart:phrase.MatchEnd])
+}
+
+func TestQueryPlanner(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {
+			"The report names Oswald.",
+			"The report names Ruby.",
+			"The report names nobody.",
+			"The report is blank.",
+		},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	opts.Explain = true
+	plan := func(query string) ([]PlanStep, SearchResults) {
+		results, err := search(context.Background(), query, opts)
+		require.NoError(t, err)
+		return results.Plan, results
+	}
+
+	// the most selective clause runs first whatever order it was typed in
+	steps, results := plan("report and names and oswald")
+	require.Len(t, steps, 3)
+	assert.Equal(t, "oswald", steps[0].Clause)
+	assert.Equal(t, uint64(1), steps[0].Cardinality)
+	assert.LessOrEqual(t, steps[0].Estimate, steps[1].Estimate)
+	assert.LessOrEqual(t, steps[1].Estimate, steps[2].Estimate)
+	assert.Equal(t, uint64(1), results.Pages.GetCardinality())
+
+	// an empty result skips the remaining clauses
+	steps, results = plan("report and zapruder and names and not ruby")
+	require.Len(t, steps, 4)
+	assert.Equal(t, "zapruder", steps[0].Clause)
+	assert.Equal(t, uint64(0), steps[0].Estimate)
+	assert.False(t, steps[0].Skipped)
+	for _, step := range steps[1:] {
+		assert.True(t, step.Skipped, step.Clause)
+	}
+	assert.True(t, results.Pages.IsEmpty())
+
+	// exclusions only run after every inclusion
+	steps, _ = plan("not ruby and report and names")
+	require.Len(t, steps, 3)
+	assert.Equal(t, "not", steps[2].Op)
+	assert.Equal(t, "ruby", steps[2].Clause)
+	assert.Equal(t, uint64(2), steps[2].Cardinality)
+
+	opts.Explain = false
+	steps, _ = plan("report and names and oswald")
+	assert.Nil(t, steps)
+}
+
+func TestSearchExplain(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald met Oswalt in Dallas.", "Ruby was in Dallas."},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{"soundex"}, []string{"simple"}, nil)
+	require.NoError(t, err)
+	opts.Explain = true
+	results, err := search(context.Background(), "oswald and not rub*", opts)
+	require.NoError(t, err)
+
+	tree := describeNode(results.Tree)
+	assert.Equal(t, "and", tree.Type)
+	require.Len(t, tree.Children, 2)
+	assert.Equal(t, "term", tree.Children[0].Type)
+	assert.Equal(t, "not", tree.Children[1].Type)
+	assert.Equal(t, "wildcard", tree.Children[1].Children[0].Type)
+
+	clauses := make(map[string]ClauseTrace)
+	for _, clause := range results.Clauses {
+		clauses[clause.Clause] = clause
+	}
+	term := clauses["oswald"]
+	assert.Equal(t, uint64(1), term.Cardinality)
+	assert.Equal(t, []string{"oswald"}, term.Expansions["exact"])
+	assert.Contains(t, term.Expansions["soundex"], "oswald")
+	assert.Contains(t, term.Expansions["soundex"], "oswalt")
+	require.NotEmpty(t, term.Gematria)
+	assert.Equal(t, "simple", term.Gematria[0].Cipher)
+	assert.Equal(t, gematria.FromString("oswald").Simple, term.Gematria[0].Value)
+	assert.Equal(t, []string{"ruby"}, clauses["rub*"].Expansions["wildcard"])
+
+	var phases []string
+	for _, timing := range results.Timings {
+		phases = append(phases, timing.Phase)
+	}
+	assert.Equal(t, []string{"parse", "evaluate", "score"}, phases)
+
+	opts.Explain = false
+	results, err = search(context.Background(), "oswald", opts)
+	require.NoError(t, err)
+	assert.Nil(t, results.Clauses)
+	assert.Nil(t, results.Tree)
+}
+
+// expiredContext has run out of time for every check of Err, but never closes Done, so that a search
+// still gets its slot and then finds its deadline passed at the first point it checks
+type expiredContext struct{ context.Context }
+
+func (expiredContext) Done() <-chan struct{} { return nil }
+func (expiredContext) Err() error            { return context.DeadlineExceeded }
+
+func TestSearchCancellation(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald was in Dallas.", "Ruby shot Oswald.", "Oswald visited Mexico City."},
+	})
+	opts := defaultSearchOptions()
+
+	// a client that went away stops the search with the error of its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := search(ctx, "oswald", opts)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// a query past its deadline before its first clause finished has no pages, flagged partial
+	*cfigs.Int(kSearchTimeoutMs) = 0
+	defer func() { *cfigs.Int(kSearchTimeoutMs) = 10000 }()
+	results, err := search(expiredContext{context.Background()}, "oswald", opts)
+	require.NoError(t, err)
+	assert.True(t, results.Partial)
+	assert.True(t, results.Pages.IsEmpty())
+
+	// a client that goes away while waiting for a slot stops waiting
+	for range *cfigs.Int(kMaxSearches) {
+		systemSearchSemaphore.Acquire()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = search(ctx, "oswald", opts)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	for range *cfigs.Int(kMaxSearches) {
+		systemSearchSemaphore.Release()
+	}
+
+	*cfigs.Int(kSearchTimeoutMs) = 10000
+	results, err = search(context.Background(), "oswald", opts)
+	require.NoError(t, err)
+	assert.False(t, results.Partial)
+	assert.Equal(t, uint64(3), results.Pages.GetCardinality())
+}
+
+func TestPartialResults(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo":  {"Oswald visited Mexico City today.", "He visited Mexico City today.", "She visited Mexico City today."},
+		"cable": {"Oswald was in Dallas."},
+	})
+	*cfigs.Int(kSearchTimeoutMs) = 0
+	defer func() { *cfigs.Int(kSearchTimeoutMs) = 10000 }()
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	ctx := expiredContext{context.Background()}
+
+	// oswald, the rarer clause, is intersected before the phrase runs out of time confirming its pages,
+	// so its pages come back scored rather than nothing
+	results, err := search(ctx, `oswald "visited mexico city today"`, opts)
+	require.NoError(t, err)
+	assert.True(t, results.Partial)
+	assert.Contains(t, results.Categories["exact/textee"], "memo-p1")
+	assert.Equal(t, uint64(2), results.Pages.GetCardinality())
+
+	// a window is cut and read from the same pages, ranked by BM25 up to the terms scored in time
+	opts.BM25 = &BM25Params{K1: 1.2, B: 0.75}
+	opts.Window = &ResultWindow{Sort: "bm25", Limit: 1}
+	results, err = search(ctx, `oswald "visited mexico city today"`, opts)
+	require.NoError(t, err)
+	assert.True(t, results.Partial)
+	require.Len(t, results.Window, 1)
+	assert.Equal(t, uint64(2), results.Total)
+	assert.NotEmpty(t, results.NextCursor)
+}
+
+func TestPagination(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {
+			"Oswald was in Dallas.",
+			"Ruby shot Oswald.",
+			"Oswald visited Mexico City.",
+			"Oswald Oswald.",
+			"Nothing about the suspect here.",
+		},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+
+	// walks the windows of a search by their cursors and returns the pages in the order they came
+	walk := func(query string, window ResultWindow) []rankedPage {
+		var pages []rankedPage
+		for i := 0; i < 10; i++ {
+			opts.Window = &window
+			results, err := search(context.Background(), query, opts)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(4), results.Total)
+			assert.LessOrEqual(t, len(results.Window), window.Limit)
+			pages = append(pages, results.Window...)
+			if results.NextCursor == "" {
+				return pages
 			}
-		default:
-			continue
+			window.After, err = decodeCursor(results.NextCursor)
+			require.NoError(t, err)
 		}
-		//time.Sleep(time.Millisecond * 12_369)
+		t.Fatal("the cursor never reached the end of the results")
+		return nil
+	}
+
+	// page ID order visits every page once
+	pages := walk("oswald", ResultWindow{Limit: 3})
+	require.Len(t, pages, 4)
+	ids := make([]string, 0, len(pages))
+	for _, page := range pages {
+		ids = append(ids, page.ID)
 	}
+	assert.Equal(t, []string{"memo-p1", "memo-p2", "memo-p3", "memo-p4"}, ids)
+
+	// ranked windows continue one another in score order, with the matches of their pages
+	weights := CategoryWeights{"gematria/simple": 5}
+	pages = walk("oswald or simple:=mexico", ResultWindow{Sort: "ranked", Weights: weights, Limit: 1})
+	require.Len(t, pages, 4)
+	assert.Equal(t, "memo-p3", pages[0].ID)
+	assert.Equal(t, map[string]float64{"exact/textee": 1, "gematria/simple": 5}, pages[0].Breakdown)
+	for i := 1; i < len(pages); i++ {
+		assert.GreaterOrEqual(t, pages[i-1].Score, pages[i].Score)
+		assert.NotEmpty(t, pages[i].Matches)
+	}
+
+	// a window only reads its own pages
+	opts.Window = &ResultWindow{Limit: 2}
+	results, err := search(context.Background(), "oswald", opts)
+	require.NoError(t, err)
+	assert.Len(t, results.Matches, 2)
+	assert.Equal(t, uint64(4), results.Pages.GetCardinality())
+
+	// a cursor only continues the search it came from
+	after, err := decodeCursor(results.NextCursor)
+	require.NoError(t, err)
+	opts.Window = &ResultWindow{Limit: 2, After: after}
+	_, err = search(context.Background(), "ruby", opts)
+	require.ErrorIs(t, err, errCursorMismatch)
+	_, err = decodeCursor("not a cursor")
+	require.Error(t, err)
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"memo": {"Oswald was in Dallas.", "Ruby shot Oswald.", "Oswald visited Mexico City.", "Nothing here."},
+	})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/search", handleSearch)
+	router.GET("/search/explain", handleSearchExplain)
+	get := func(target string) (int, []byte) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder.Code, recorder.Body.Bytes()
+	}
+	type window struct {
+		Results    []string `json:"results"`
+		Total      uint64   `json:"total"`
+		NextCursor *string  `json:"next_cursor"`
+	}
+
+	// without limit, cursor or group the response is the bare array of every result
+	code, body := get("/search?q=oswald&algos=&ciphers=")
+	require.Equal(t, http.StatusOK, code, string(body))
+	var flat []string
+	require.NoError(t, json.Unmarshal(body, &flat), string(body))
+	assert.Equal(t, []string{"memo-p1", "memo-p2", "memo-p3"}, flat)
+
+	code, body = get("/search?q=oswald&algos=&ciphers=&limit=2")
+	require.Equal(t, http.StatusOK, code, string(body))
+	var first window
+	require.NoError(t, json.Unmarshal(body, &first), string(body))
+	assert.Equal(t, []string{"memo-p1", "memo-p2"}, first.Results)
+	assert.Equal(t, uint64(3), first.Total)
+	require.NotNil(t, first.NextCursor)
+
+	code, body = get("/search?q=oswald&algos=&ciphers=&limit=2&cursor=" + *first.NextCursor)
+	require.Equal(t, http.StatusOK, code, string(body))
+	var second window
+	require.NoError(t, json.Unmarshal(body, &second), string(body))
+	assert.Equal(t, []string{"memo-p3"}, second.Results)
+	assert.Nil(t, second.NextCursor)
+
+	for _, target := range []string{
+		"/search?q=ruby&algos=&ciphers=&limit=2&cursor=" + *first.NextCursor,        // another query
+		"/search?q=oswald&algos=&ciphers=&sort=bm25&cursor=" + *first.NextCursor,    // another order
+		"/search?q=oswald&cursor=" + (*first.NextCursor)[:len(*first.NextCursor)-3], // cut short
+		"/search?q=oswald&sort=rank",
+		"/search?q=oswald&limit=0",
+		"/search?q=oswald&group=page",
+		"/search?algos=",
+		"/search?q=oswald&exact=maybe",
+		"/search/explain?algos=",
+		"/search/explain?q=oswald&algos=nope",
+	} {
+		code, body = get(target)
+		assert.Equal(t, http.StatusBadRequest, code, "%s: %s", target, body)
+	}
+
+	// /search/explain reads the query and options the same way, from query= as well as q=
+	code, body = get("/search/explain?query=oswald&algos=&ciphers=")
+	require.Equal(t, http.StatusOK, code, string(body))
+	var explained struct {
+		Query string `json:"query"`
+		Pages uint64 `json:"pages"`
+	}
+	require.NoError(t, json.Unmarshal(body, &explained), string(body))
+	assert.Equal(t, "oswald", explained.Query)
+	assert.Equal(t, uint64(3), explained.Pages)
+}
+
+func TestWebSocketSubscription(t *testing.T) {
+	pages := make([]string, 150)
+	for i := range pages {
+		pages[i] = "Oswald was seen again."
+	}
+	loadTestCorpus(t, map[string][]string{"sightings": pages})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ws/search", handleWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/search"
+
+	// exact/textee has more hits than its channel holds and no reader, which must not hold up the
+	// pages of the channel subscribed to or the completion of the search
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{
+		"keyword": "oswald", "channels": []string{"gematria/simple"}, "algos": []string{}, "ciphers": []string{"simple"},
+	}))
+	received := 0
+	for {
+		var msg map[string]interface{}
+		require.NoError(t, conn.ReadJSON(&msg))
+		if msg["status"] == "completed" {
+			break
+		}
+		assert.Equal(t, "/results/oswald/gematria/simple", msg["channel"])
+		received++
+	}
+	assert.Equal(t, 150, received)
+
+	// the search finished and is cached rather than left waiting on a send
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{"simple"}, nil)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		searchManager.mu.Lock()
+		defer searchManager.mu.Unlock()
+		_, cached := searchManager.cache[sessionKey("oswald", opts)]
+		return cached
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGroupByDocument(t *testing.T) {
+	loadTestCorpus(t, map[string][]string{
+		"long":  {"Oswald again.", "Oswald again.", "Oswald again.", "Oswald again.", "Oswald again.", "Oswald again."},
+		"short": {"Nothing here.", "Oswald went to Mexico."},
+	})
+	opts, err := defaultSearchOptions().withMatchers([]string{}, []string{}, nil)
+	require.NoError(t, err)
+	grouped := func(after *searchCursor) SearchResults {
+		opts.Window = &ResultWindow{Sort: "ranked", Group: "document", Limit: 1, After: after}
+		results, err := search(context.Background(), "oswald or simple:=mexico", opts)
+		require.NoError(t, err)
+		return results
+	}
+
+	// six weak pages don't bury one strong page
+	results := grouped(nil)
+	assert.Equal(t, uint64(2), results.Total)
+	require.Len(t, results.Groups, 1)
+	short := results.Groups[0]
+	assert.Equal(t, "short", short.ID)
+	assert.Equal(t, "short-p1", short.Cover)
+	assert.Equal(t, uint64(1), short.Hits)
+	assert.InDelta(t, 2.0, short.Score, 1e-9)
+	require.Len(t, short.Pages, 1)
+	assert.Equal(t, "short-p2", short.Pages[0].ID)
+	assert.NotEmpty(t, short.Pages[0].Matches)
+
+	// only the best pages of the window's documents are read
+	assert.Len(t, results.Matches, 1)
+
+	require.NotEmpty(t, results.NextCursor)
+	after, err := decodeCursor(results.NextCursor)
+	require.NoError(t, err)
+	results = grouped(after)
+	require.Len(t, results.Groups, 1)
+	long := results.Groups[0]
+	assert.Equal(t, "long", long.ID)
+	assert.Equal(t, uint64(6), long.Hits)
+	assert.InDelta(t, 1+0.5+0.25+0.125+0.0625+0.03125, long.Score, 1e-9)
+	require.Len(t, long.Pages, 3)
+	assert.Equal(t, "long-p1", long.Pages[0].ID)
+	assert.Empty(t, results.NextCursor)
 
+	// without the decay a document scores every page it matched
+	*cfigs.Float64(kGroupPageDecay) = 1
+	defer func() { *cfigs.Float64(kGroupPageDecay) = 0.5 }()
+	results = grouped(nil)
+	require.Len(t, results.Groups, 1)
+	assert.Equal(t, "long", results.Groups[0].ID)
+	assert.InDelta(t, 6.0, results.Groups[0].Score, 1e-9)
 }
@@ -2,30 +2,185 @@ package main
 
 import (
 	"log"
+	"regexp"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/andreimerlescu/gematria"
 	"github.com/andreimerlescu/textee"
 	"github.com/xrash/smetrics"
 )
 
-func matchesExactTextee(query string, textee *textee.Textee) bool {
-	for word := range textee.Gematrias {
-		if word == query {
-			return true
+// pageTerm is a Textee substring of a page and where it first occurs in Textee.Input
+type pageTerm struct {
+	Text  string
+	Start int // byte offset of the substring in Textee.Input, -1 when it couldn't be located
+	End   int // byte offset just past the substring in Textee.Input
+}
+
+// pageText is a page's text split the way the word index splits it, so that a matched substring can
+// be traced back to the span of Textee.Input it came from
+type pageText struct {
+	textee *textee.Textee
+	words  []string   // normalized words of Textee.Input, see normalizeWords
+	spans  [][2]int   // byte offsets of each of words in Textee.Input
+	terms  []pageTerm // the Textee substrings in the order they first occur
+}
+
+// newPageText locates the substrings of a page. Every matcher walks them in order of occurrence, so the
+// match it reports is the first on the page.
+func newPageText(t *textee.Textee) *pageText {
+	p := &pageText{textee: t}
+	start := -1
+	addWord := func(end int) {
+		if word := nonWordChars.ReplaceAllString(strings.ToLower(t.Input[start:end]), ""); word != "" {
+			p.words = append(p.words, word)
+			p.spans = append(p.spans, [2]int{start, end})
 		}
+		start = -1
 	}
-	return false
+	for i, r := range t.Input {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				addWord(i)
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		addWord(len(t.Input))
+	}
+
+	seen := make(map[string]struct{}, len(t.Gematrias))
+	for i := range p.words {
+		for n := 1; n <= texteeMaxWords && i+n <= len(p.words); n++ {
+			text := strings.Join(p.words[i:i+n], " ")
+			if _, exists := seen[text]; exists {
+				continue
+			}
+			if _, ok := t.Gematrias[text]; ok {
+				seen[text] = struct{}{}
+				p.terms = append(p.terms, pageTerm{Text: text, Start: p.spans[i][0], End: p.spans[i+n-1][1]})
+			}
+		}
+	}
+	// substrings Textee split differently still match, they just can't be highlighted
+	var rest []string
+	for text := range t.Gematrias {
+		if _, exists := seen[text]; !exists {
+			rest = append(rest, text)
+		}
+	}
+	sort.Strings(rest)
+	for _, text := range rest {
+		p.terms = append(p.terms, pageTerm{Text: text, Start: -1, End: -1})
+	}
+	return p
+}
+
+// find returns the first substring of the page that match accepts
+func (p *pageText) find(match func(term string) bool) (pageTerm, bool) {
+	for _, term := range p.terms {
+		if match(term.Text) {
+			return term, true
+		}
+	}
+	return pageTerm{}, false
+}
+
+// findExact returns the first occurrence of query, a normalized substring, on the page
+func (p *pageText) findExact(query string) (pageTerm, bool) {
+	return p.find(func(term string) bool { return term == query })
+}
+
+// findPhrase returns the first place the words of a quoted phrase appear contiguously on the page
+func (p *pageText) findPhrase(words []string) (pageTerm, bool) {
+	words = normalizeWords(strings.Join(words, " "))
+	if len(words) <= texteeMaxWords {
+		return p.findExact(strings.Join(words, " "))
+	}
+	for i := 0; i+len(words) <= len(p.words); i++ {
+		if containsPhrase(p.words[i:i+len(words)], words) {
+			return pageTerm{Text: strings.Join(words, " "), Start: p.spans[i][0], End: p.spans[i+len(words)-1][1]}, true
+		}
+	}
+	return pageTerm{}, false
+}
+
+// findWildcard returns the first substring of the page that matches the glob pattern
+func (p *pageText) findWildcard(pattern string) (pageTerm, bool) {
+	return p.find(func(term string) bool { return globMatch(pattern, term) })
+}
+
+// findGematriaRange returns the first substring of the page with a cipher value within [min, max]
+func (p *pageText) findGematriaRange(cipher string, min, max uint64) (pageTerm, bool) {
+	return p.find(func(term string) bool {
+		value, ok := gematriaValue(p.textee.Gematrias[term], cipher)
+		return ok && value >= min && value <= max
+	})
+}
+
+// findRegex returns the first substring of the page that re matches in full
+func (p *pageText) findRegex(re *regexp.Regexp) (pageTerm, bool) {
+	return p.find(re.MatchString)
+}
+
+// gematria returns the gematria of a matched substring; phrases longer than Textee's substrings are
+// computed on the spot
+func (p *pageText) gematria(term pageTerm) gematria.Gematria {
+	if g, ok := p.textee.Gematrias[term.Text]; ok {
+		return g
+	}
+	return gematria.FromString(term.Text)
+}
+
+// snippet cuts the window of Textee.Input around a matched substring, up to kSnippetChars characters on
+// either side of it and widened to whole words, and returns it with its character offset in
+// Textee.Input and the character offsets of the match inside it
+func (p *pageText) snippet(term pageTerm) (text string, offset, matchStart, matchEnd int) {
+	input := p.textee.Input
+	start, end := term.Start, term.End
+	if start < 0 {
+		start, end = 0, 0
+	}
+	context := *cfigs.Int(kSnippetChars)
+	from := start
+	for n := 0; from > 0 && n < context; n++ {
+		_, size := utf8.DecodeLastRuneInString(input[:from])
+		from -= size
+	}
+	for from > 0 && from < start && !unicode.IsSpace(rune(input[from-1])) {
+		from-- // back up to the start of the word the window cut into
+	}
+	to := end
+	for n := 0; to < len(input) && n < context; n++ {
+		_, size := utf8.DecodeRuneInString(input[to:])
+		to += size
+	}
+	for to < len(input) && to > end && !unicode.IsSpace(rune(input[to])) {
+		to++ // carry on to the end of the word the window cut into
+	}
+	text = input[from:to]
+	offset = utf8.RuneCountInString(input[:from])
+	if term.Start < 0 {
+		return text, offset, -1, -1
+	}
+	matchStart = utf8.RuneCountInString(input[from:start])
+	matchEnd = matchStart + utf8.RuneCountInString(input[start:end])
+	return text, offset, matchStart, matchEnd
 }
 
-func matchesCondition(query string, pageWords map[string]gematria.Gematria, queryGematria gematria.Gematria, algo string) bool {
+func matchesCondition(query string, pageWords map[string]gematria.Gematria, queryGematria gematria.Gematria, algo string, thresholds Thresholds) bool {
 	if strings.Contains(query, " ") {
 		words := strings.Fields(query)
 		for _, qw := range words {
 			qwGematria := gematria.FromString(qw)
 			found := false
 			for pw, pg := range pageWords {
-				if matchesConditionSingle(qw, pw, algo) || matchesConditionGematria(pg, qwGematria) {
+				if matchesConditionSingle(qw, pw, algo, thresholds) || matchesConditionGematria(pg, qwGematria) {
 					found = true
 					break
 				}
@@ -37,7 +192,7 @@ func matchesCondition(query string, pageWords map[string]gematria.Gematria, quer
 		return true
 	} else {
 		for pw, pg := range pageWords {
-			if matchesConditionSingle(query, pw, algo) || matchesConditionGematria(pg, queryGematria) {
+			if matchesConditionSingle(query, pw, algo, thresholds) || matchesConditionGematria(pg, queryGematria) {
 				return true // Any match means the single word condition is satisfied
 			}
 		}
@@ -57,24 +212,25 @@ func matchesConditionGematria(gematrix gematria.Gematria, queryGematria gematria
 	return false
 }
 
-func matchesConditionSingle(query, word string, algo string) bool {
+// matchesConditionSingle reports whether word is similar to query under algo, judged by the limits in thresholds
+func matchesConditionSingle(query, word string, algo string, thresholds Thresholds) bool {
 	// If no gematria match, use the specified string similarity algorithm
 	switch algo {
 	case "jaro":
-		return smetrics.Jaro(query, word) >= *cfigs.Float64(kJaroThreshold)
+		return smetrics.Jaro(query, word) >= thresholds.Jaro
 	case "jaro-winkler":
-		return smetrics.JaroWinkler(query, word, *cfigs.Float64(kJaroWinklerBoostThreshold), *cfigs.Int(kJaroWinklerPrefixSize)) >= *cfigs.Float64(kJaroWinklerThreshold)
+		return smetrics.JaroWinkler(query, word, *cfigs.Float64(kJaroWinklerBoostThreshold), *cfigs.Int(kJaroWinklerPrefixSize)) >= thresholds.JaroWinkler
 	case "soundex":
 		return smetrics.Soundex(query) == smetrics.Soundex(word)
 	case "hamming":
 		subs, err := smetrics.Hamming(query, word)
-		return err == nil && subs <= *cfigs.Int(kHammingMaxSubs)
+		return err == nil && subs <= thresholds.HammingMaxSubs
 	case "ukkonen":
 		score := smetrics.Ukkonen(query, word, *cfigs.Int(kUkkonenICost), *cfigs.Int(kUkkonenDCost), *cfigs.Int(kUkkonenSCost))
-		return score <= *cfigs.Int(kUkkonenMaxSubs)
+		return score <= thresholds.UkkonenMaxSubs
 	case "wagner-fisher":
 		score := smetrics.WagnerFischer(query, word, *cfigs.Int(kWagnerFisherICost), *cfigs.Int(kWagnerFisherDCost), *cfigs.Int(kWagnerFisherSCost))
-		return score <= *cfigs.Int(kWagnerFisherMaxSubs)
+		return score <= thresholds.WagnerFisherMaxSubs
 	default:
 		log.Printf("Unknown algorithm: %s", algo)
 		return false
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fuzzyAlgorithms are the string-similarity algorithms a term can be matched through, see matchesConditionSingle
+var fuzzyAlgorithms = []string{"jaro", "jaro-winkler", "soundex", "hamming", "ukkonen", "wagner-fisher"}
+
+// SearchOptions selects which matchers search() runs for one request and what the request is restricted to.
+// A client that only wants exact and soundex matches skips the cost of the other ten matchers entirely.
+type SearchOptions struct {
+	Exact         bool          // match terms exactly against the word index, the exact/textee category
+	FuzzyAlgos    []string      // fuzzy algorithms to match terms through, a subset of fuzzyAlgorithms
+	GematriaTypes []string      // ciphers to match terms through, a subset of gematriaCiphers
+	Thresholds    Thresholds    // similarity limits of the fuzzy algorithms
+	Filters       []QueryNode   // field filters ANDed onto the query, e.g. doc:<id>
+	BM25          *BM25Params   // score every page by BM25 for sort=bm25, nil skips scoring
+	Explain       bool          // record the steps of the query plan in SearchResults.Plan
+	Window        *ResultWindow // score and read only one window of the ordered results, nil reads every page
+}
+
+// Thresholds are the limits under which matchesConditionSingle considers two words similar
+type Thresholds struct {
+	Jaro                float64 // minimum Jaro similarity, 1.0 is an exact match
+	JaroWinkler         float64 // minimum Jaro-Winkler similarity
+	HammingMaxSubs      int     // maximum substitutions between words of equal length
+	UkkonenMaxSubs      int     // maximum Ukkonen edit cost
+	WagnerFisherMaxSubs int     // maximum Wagner-Fisher edit cost
+}
+
+// defaultSearchOptions runs every matcher with the configured thresholds, which is what a request
+// that doesn't choose gets
+func defaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		Exact:         true,
+		FuzzyAlgos:    fuzzyAlgorithms,
+		GematriaTypes: gematriaCiphers,
+		Thresholds: Thresholds{
+			Jaro:                *cfigs.Float64(kJaroThreshold),
+			JaroWinkler:         *cfigs.Float64(kJaroWinklerThreshold),
+			HammingMaxSubs:      *cfigs.Int(kHammingMaxSubs),
+			UkkonenMaxSubs:      *cfigs.Int(kUkkonenMaxSubs),
+			WagnerFisherMaxSubs: *cfigs.Int(kWagnerFisherMaxSubs),
+		},
+	}
+}
+
+// thresholdOverrides are the thresholds a request may override, e.g. jaro=0.85 or ukkonen_max_subs=1,
+// each within the floor and ceiling that the operator configured for it
+var thresholdOverrides = []struct {
+	param   string // query parameter and websocket thresholds key
+	floor   string // config key of the lowest value a request may ask for
+	ceiling string // config key of the highest value a request may ask for
+	integer bool   // whether the threshold is a whole number of edits
+	apply   func(t *Thresholds, value float64)
+}{
+	{"jaro", kJaroThresholdFloor, kJaroThresholdCeiling, false, func(t *Thresholds, v float64) { t.Jaro = v }},
+	{"jaro_winkler", kJaroWinklerThresholdFloor, kJaroWinklerThresholdCeiling, false, func(t *Thresholds, v float64) { t.JaroWinkler = v }},
+	{"hamming_max_subs", kHammingMaxSubsFloor, kHammingMaxSubsCeiling, true, func(t *Thresholds, v float64) { t.HammingMaxSubs = int(v) }},
+	{"ukkonen_max_subs", kUkkonenMaxSubsFloor, kUkkonenMaxSubsCeiling, true, func(t *Thresholds, v float64) { t.UkkonenMaxSubs = int(v) }},
+	{"wagner_fisher_max_subs", kWagnerFisherMaxSubsFloor, kWagnerFisherMaxSubsCeiling, true, func(t *Thresholds, v float64) { t.WagnerFisherMaxSubs = int(v) }},
+}
+
+// withThresholds applies the requested threshold overrides, keyed by parameter name. A value outside
+// the configured floor and ceiling is refused rather than clamped so the client knows it was not used.
+func (o SearchOptions) withThresholds(overrides map[string]float64) (SearchOptions, error) {
+	known := make(map[string]bool, len(thresholdOverrides))
+	for _, override := range thresholdOverrides {
+		known[override.param] = true
+		value, ok := overrides[override.param]
+		if !ok {
+			continue
+		}
+		var floor, ceiling float64
+		if override.integer {
+			floor, ceiling = float64(*cfigs.Int(override.floor)), float64(*cfigs.Int(override.ceiling))
+			if value != math.Trunc(value) {
+				return o, fmt.Errorf("%s must be a whole number", override.param)
+			}
+		} else {
+			floor, ceiling = *cfigs.Float64(override.floor), *cfigs.Float64(override.ceiling)
+		}
+		if math.IsNaN(value) || value < floor || value > ceiling {
+			return o, fmt.Errorf("%s must be between %v and %v", override.param, floor, ceiling)
+		}
+		override.apply(&o.Thresholds, value)
+	}
+	for param := range overrides {
+		if !known[param] {
+			return o, fmt.Errorf("unknown threshold %q", param)
+		}
+	}
+	return o, nil
+}
+
+// withMatchers narrows the options down to the requested matchers. A nil list or exact keeps the
+// default; an empty list turns that family of matchers off.
+func (o SearchOptions) withMatchers(algos, ciphers []string, exact *bool) (SearchOptions, error) {
+	var err error
+	if algos != nil {
+		if o.FuzzyAlgos, err = parseMatcherList(algos, fuzzyAlgorithms, "algorithm"); err != nil {
+			return o, err
+		}
+	}
+	if ciphers != nil {
+		if o.GematriaTypes, err = parseMatcherList(ciphers, gematriaCiphers, "cipher"); err != nil {
+			return o, err
+		}
+	}
+	if exact != nil {
+		o.Exact = *exact
+	}
+	return o, nil
+}
+
+// parseMatcherList validates the requested matchers against known. Each value may itself be a comma
+// separated list, so algos=soundex,jaro and algos=soundex&algos=jaro are the same.
+func parseMatcherList(values, known []string, kind string) ([]string, error) {
+	selected := []string{}
+	seen := make(map[string]struct{})
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, exists := seen[name]; exists {
+				continue
+			}
+			found := false
+			for _, k := range known {
+				if name == k {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown %s %q, expected one of %s", kind, name, strings.Join(known, ", "))
+			}
+			seen[name] = struct{}{}
+			selected = append(selected, name)
+		}
+	}
+	return selected, nil
+}
+
+// searchOptionsFromRequest reads the algos, ciphers and exact query parameters, the threshold overrides
+// and the field filters, e.g. /search?q=oswald&algos=soundex,jaro&ciphers=&jaro=0.85
+func searchOptionsFromRequest(c *gin.Context) (SearchOptions, error) {
+	var algos, ciphers []string
+	if values, ok := c.GetQueryArray("algos"); ok {
+		algos = append([]string{}, values...)
+	}
+	if values, ok := c.GetQueryArray("ciphers"); ok {
+		ciphers = append([]string{}, values...)
+	}
+	var exact *bool
+	if value, ok := c.GetQuery("exact"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return SearchOptions{}, fmt.Errorf("invalid exact %q, expected true or false", value)
+		}
+		exact = &parsed
+	}
+	opts, err := defaultSearchOptions().withMatchers(algos, ciphers, exact)
+	if err != nil {
+		return SearchOptions{}, err
+	}
+	overrides := make(map[string]float64)
+	for _, override := range thresholdOverrides {
+		if value, ok := c.GetQuery(override.param); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return SearchOptions{}, fmt.Errorf("invalid %s %q, expected a number", override.param, value)
+			}
+			overrides[override.param] = parsed
+		}
+	}
+	if opts, err = opts.withThresholds(overrides); err != nil {
+		return SearchOptions{}, err
+	}
+	opts.Filters = fieldFiltersFromRequest(c)
+	return opts, nil
+}
+
+// bm25ParamsFromRequest reads the k1, b and category_boost overrides of sort=bm25, e.g.
+// /search?q=oswald&sort=bm25&k1=2&b=0.5&category_boost=0.1
+func bm25ParamsFromRequest(c *gin.Context) (BM25Params, error) {
+	params := bm25Params()
+	for _, override := range []struct {
+		param string
+		value *float64
+	}{{"k1", &params.K1}, {"b", &params.B}, {"category_boost", &params.CategoryBoost}} {
+		if value, ok := c.GetQuery(override.param); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("invalid %s %q, expected a number", override.param, value)
+			}
+			*override.value = parsed
+		}
+	}
+	return params, params.validate()
+}
+
+// categoryWeightsFromRequest reads the weight overrides of sort=ranked over the configured weights, e.g.
+// /search?q=oswald&sort=ranked&weights=exact/textee=10,gematria/*=0
+func categoryWeightsFromRequest(c *gin.Context) (CategoryWeights, error) {
+	weights, err := configuredCategoryWeights()
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseCategoryWeights(strings.Join(c.QueryArray("weights"), ","))
+	if err != nil {
+		return nil, err
+	}
+	return weights.withOverrides(overrides), nil
+}
+
+// key renders the options canonically so that searches with different options are not shared or cached together
+func (o SearchOptions) key() string {
+	algos := append([]string{}, o.FuzzyAlgos...)
+	ciphers := append([]string{}, o.GematriaTypes...)
+	sort.Strings(algos)
+	sort.Strings(ciphers)
+	return fmt.Sprintf("exact=%t;algos=%s;ciphers=%s;thresholds=%+v;filters=%s",
+		o.Exact, strings.Join(algos, ","), strings.Join(ciphers, ","), o.Thresholds, joinNodes(o.Filters))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pageIDsFile is the page ID registry in the cache directory, one "pageID PageIdentifier" line per ID
+// ever handed out. A rebuild gives every page the ID the registry holds for its PageIdentifier and only
+// allocates IDs for pages it has never seen, so numeric IDs stay valid for cursors, permalinks and cached
+// result sets across rebuilds. The file is only ever appended to: a page that was modified is indexed
+// under a new ID (see ingestPages), whose line supersedes the earlier one, and no ID is handed out twice.
+const pageIDsFile = "page_ids.txt"
+
+// pageIDRegistry maps PageIdentifiers to their numeric page IDs
+type pageIDRegistry struct {
+	ids     map[string]int
+	next    int      // the lowest ID never handed out
+	pending []string // lines not yet appended to pageIDsFile
+}
+
+// pageIDs is the registry of the cache directory, guarded by cacheMutex; buildCache and loadSearchData
+// load it and ingestPages loads it when the watcher runs first
+var pageIDs *pageIDRegistry
+
+// loadPageIDRegistry reads pageIDsFile. IDs of caches built before the registry existed are in
+// cache_index.txt only, so the registry never hands out an ID below the highest one there either, and
+// without pageIDsFile it starts from the pages of that cache, see seed.
+func loadPageIDRegistry() (*pageIDRegistry, error) {
+	r := &pageIDRegistry{ids: make(map[string]int)}
+	next, err := getNextPageID()
+	if err != nil {
+		return nil, err
+	}
+	r.next = next
+
+	file, err := os.Open(filepath.Join(*cfigs.String(kCacheDir), pageIDsFile))
+	if os.IsNotExist(err) {
+		return r, r.seed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		idStr, identifier, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse page ID: %w", err)
+		}
+		r.ids[identifier] = id
+		r.next = max(r.next, id+1)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// seed registers the IDs of the pages of a cache built before pageIDsFile existed, so that its first
+// rebuild keeps them. Every page of cache_index.txt is registered under the PageIdentifier of its cached
+// record. When page_sources.txt lists the live pages, they are registered in the order a rebuild walks
+// them, so that a later file claiming the same page gets its duplicateKey; otherwise a later line of a
+// page supersedes an earlier one, as in pageIDsFile. The IDs are saved with the next allocated ones.
+func (r *pageIDRegistry) seed() error {
+	cacheDir := *cfigs.String(kCacheDir)
+	idx, err := os.Open(filepath.Join(cacheDir, cacheIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	reader, err := OpenRecordReader(filepath.Join(cacheDir, cacheFile))
+	if err != nil {
+		return fmt.Errorf("open cache file: %w", err)
+	}
+	defer reader.Close()
+
+	var order []int
+	identifiers := make(map[int]string)
+	scanner := bufio.NewScanner(idx)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), " ")
+		if len(parts) != 3 {
+			continue
+		}
+		id, err1 := strconv.Atoi(parts[0])
+		offset, err2 := strconv.ParseInt(parts[1], 10, 64)
+		length, err3 := strconv.ParseInt(parts[2], 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return fmt.Errorf("parse cache index: %w", err)
+		}
+		page, err := reader.Page([2]int64{offset, length})
+		if err != nil {
+			return fmt.Errorf("read page %d: %w", id, err)
+		}
+		if page.PageIdentifier != "" {
+			identifiers[id] = page.PageIdentifier
+			order = append(order, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read cache index: %w", err)
+	}
+
+	register := func(key string, id int) {
+		r.ids[key] = id
+		r.pending = append(r.pending, strconv.Itoa(id)+" "+key)
+	}
+	deleted, err := loadTombstones()
+	if err != nil {
+		return err
+	}
+	sources, err := loadPageSources(deleted)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		for _, id := range order {
+			register(identifiers[id], id)
+		}
+	} else {
+		paths := make([]string, 0, len(sources))
+		for path := range sources {
+			paths = append(paths, path)
+		}
+		sort.Slice(paths, func(i, j int) bool { return walkOrder(paths[i], paths[j]) })
+		for _, path := range paths {
+			identifier, ok := identifiers[sources[path]]
+			if !ok {
+				continue
+			}
+			if _, claimed := r.ids[identifier]; claimed {
+				register(duplicateKey(identifier, path), sources[path])
+			} else {
+				register(identifier, sources[path])
+			}
+		}
+	}
+	if len(r.ids) > 0 {
+		log.Printf("Seeded the page ID registry with %d pages of the cache", len(r.ids))
+	}
+	return nil
+}
+
+// walkOrder reports whether filepath.Walk visits the relative path a before b
+func walkOrder(a, b string) bool {
+	return slices.Compare(strings.Split(a, string(filepath.Separator)), strings.Split(b, string(filepath.Separator))) < 0
+}
+
+// duplicateKey is the registry key of the page at path, relative to -dir, whose PageIdentifier a file
+// earlier in the walk already claimed, so that it keeps an ID of its own across rebuilds
+func duplicateKey(identifier, path string) string {
+	return identifier + " " + path
+}
+
+// lookup returns the ID the registry holds for identifier
+func (r *pageIDRegistry) lookup(identifier string) (int, bool) {
+	id, ok := r.ids[identifier]
+	return id, ok
+}
+
+// assign returns the ID of identifier, allocating one if the registry has never seen it
+func (r *pageIDRegistry) assign(identifier string) int {
+	if id, ok := r.ids[identifier]; ok {
+		return id
+	}
+	return r.allocate(identifier)
+}
+
+// allocate hands identifier a new ID, replacing the one it had
+func (r *pageIDRegistry) allocate(identifier string) int {
+	id := r.next
+	r.next++
+	r.ids[identifier] = id
+	r.pending = append(r.pending, strconv.Itoa(id)+" "+identifier)
+	return id
+}
+
+// save appends the IDs allocated since the last save to pageIDsFile
+func (r *pageIDRegistry) save() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(*cfigs.String(kCacheDir), pageIDsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(strings.Join(r.pending, "\n") + "\n"); err != nil {
+		return fmt.Errorf("append page IDs: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	r.pending = nil
+	return file.Close()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/gin-gonic/gin"
+)
+
+// errCursorMismatch is returned for a cursor that was handed out for a different query, options or order
+var errCursorMismatch = errors.New("cursor does not belong to this search")
+
+// ResultWindow asks search() for one window of the results in the order of Sort, resuming where the
+// previous window ended. Only the pages of the window are read from the cache file.
+type ResultWindow struct {
+	Sort    string          // "" orders by page ID, "ranked" by category weights and "bm25" by BM25
+	Weights CategoryWeights // the category weights of sort=ranked
+	Group   string          // "document" orders documents by the pages they matched instead of pages
+	Limit   int             // the most pages, or documents, the window holds, 0 for every one
+	After   *searchCursor   // where the previous window ended, nil for the first
+}
+
+// searchCursor is where a window of results ended, handed to the client as an opaque token. Page IDs
+// are stable across rebuilds (see pageIDsFile), so a cursor keeps its place while the index changes.
+type searchCursor struct {
+	Fingerprint uint64  `json:"f"` // the search the cursor belongs to, see windowFingerprint
+	Score       float64 `json:"s"` // the score of the last page of the window
+	PageID      uint32  `json:"p"` // the page ID of the last page of the window
+}
+
+// encode renders the cursor as the token a client passes back in ?cursor=
+func (c searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a token made by searchCursor.encode
+func decodeCursor(token string) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c searchCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// windowFingerprint identifies a search by its query, options and order, so that a cursor is only
+// accepted by the search it came from
+func windowFingerprint(query string, opts SearchOptions) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(query + "\x00" + opts.key() + "\x00" + opts.Window.Sort + "\x00" + opts.Window.Group))
+	switch opts.Window.Sort {
+	case "ranked":
+		keys := make([]string, 0, len(opts.Window.Weights))
+		for key, weight := range opts.Window.Weights {
+			keys = append(keys, key+"="+strconv.FormatFloat(weight, 'g', -1, 64))
+		}
+		sort.Strings(keys)
+		_, _ = h.Write([]byte(strings.Join(keys, ",")))
+	case "bm25":
+		if opts.BM25 != nil {
+			_, _ = fmt.Fprintf(h, "%+v", *opts.BM25)
+		}
+	}
+	return h.Sum64()
+}
+
+// windowEntry is a page of the results with what it was ordered by
+type windowEntry struct {
+	pageID    uint32
+	score     float64
+	breakdown map[string]float64 // category -> what it added to score, for sort=ranked
+}
+
+// after reports whether the entry comes after the cursor: a lower score, or the same score and a
+// higher page ID
+func (w windowEntry) after(c *searchCursor) bool {
+	return w.score < c.Score || (w.score == c.Score && w.pageID > c.PageID)
+}
+
+// rankEntries scores every page of result, from the category bitmaps of the query for sort=ranked and
+// from bm25 plus the category boost for sort=bm25, and orders them highest first and then by page ID
+func rankEntries(result *roaring.Bitmap, window *ResultWindow, categories map[string]*roaring.Bitmap, bm25 map[uint32]float64, boost float64) []windowEntry {
+	entries := make([]windowEntry, 0, result.GetCardinality())
+	index := make(map[uint32]int, result.GetCardinality())
+	itr := result.Iterator()
+	for itr.HasNext() {
+		pageID := itr.Next()
+		index[pageID] = len(entries)
+		entries = append(entries, windowEntry{pageID: pageID, score: bm25[pageID]})
+	}
+	for category, pages := range categories {
+		weight := boost
+		if window.Sort == "ranked" {
+			weight = window.Weights.weight(category)
+		}
+		itr := pages.Iterator()
+		for itr.HasNext() {
+			entry := &entries[index[itr.Next()]]
+			entry.score += weight
+			if window.Sort == "ranked" {
+				if entry.breakdown == nil {
+					entry.breakdown = make(map[string]float64)
+				}
+				entry.breakdown[category] = weight
+			}
+		}
+	}
+	// Sort by score descending, then page ID ascending for stability
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].score == entries[j].score {
+			return entries[i].pageID < entries[j].pageID
+		}
+		return entries[i].score > entries[j].score
+	})
+	return entries
+}
+
+// cutWindow returns the entries of the window that follows window.After and the cursor of the next
+// window, nil when the window reaches the end of the results
+func cutWindow(entries []windowEntry, window *ResultWindow, fingerprint uint64) ([]windowEntry, *searchCursor) {
+	start := 0
+	if window.After != nil {
+		start = sort.Search(len(entries), func(i int) bool { return entries[i].after(window.After) })
+	}
+	end := len(entries)
+	if window.Limit > 0 {
+		end = min(start+window.Limit, end)
+	}
+	if end == len(entries) || end == start {
+		return entries[start:end], nil
+	}
+	last := entries[end-1]
+	return entries[start:end], &searchCursor{Fingerprint: fingerprint, Score: last.score, PageID: last.pageID}
+}
+
+// pageIDWindow is cutWindow for results in page ID order, which walks the bitmap from the cursor
+// instead of ordering every page
+func pageIDWindow(result *roaring.Bitmap, window *ResultWindow, fingerprint uint64) ([]windowEntry, *searchCursor) {
+	itr := result.Iterator()
+	if window.After != nil {
+		itr.AdvanceIfNeeded(window.After.PageID + 1)
+		if window.After.PageID == ^uint32(0) {
+			return nil, nil
+		}
+	}
+	var entries []windowEntry
+	for itr.HasNext() && (window.Limit == 0 || len(entries) < window.Limit) {
+		entries = append(entries, windowEntry{pageID: itr.Next()})
+	}
+	if !itr.HasNext() || len(entries) == 0 {
+		return entries, nil
+	}
+	return entries, &searchCursor{Fingerprint: fingerprint, PageID: entries[len(entries)-1].pageID}
+}
+
+// cutResults orders the pages of result as the window of the options asks, from the indexes alone,
+// and returns the window that follows its cursor with the cursor of the next one. When the search runs
+// out of time the window is still cut, from the categories found in time, and returned with
+// context.DeadlineExceeded.
+func (e *queryEvaluator) cutResults(result *roaring.Bitmap, leaves []QueryNode, bm25 map[uint32]float64, fingerprint uint64) ([]windowEntry, *searchCursor, error) {
+	window := e.opts.Window
+	if window.Sort == "" {
+		entries, next := pageIDWindow(result, window, fingerprint)
+		return entries, next, nil
+	}
+	categories, err := e.categoryBitmaps(leaves, result)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, nil, err
+	}
+	var boost float64
+	if e.opts.BM25 != nil {
+		boost = e.opts.BM25.CategoryBoost
+	}
+	entries, next := cutWindow(rankEntries(result, window, categories, bm25, boost), window, fingerprint)
+	return entries, next, err
+}
+
+// pagedRequest reports whether a /search request asked for windows of the results with limit, cursor
+// or group; the response of one that didn't stays the bare array of every result it was before windows
+func pagedRequest(c *gin.Context) bool {
+	_, limit := c.GetQuery("limit")
+	_, cursor := c.GetQuery("cursor")
+	_, group := c.GetQuery("group")
+	return limit || cursor || group
+}
+
+// entryIterator walks the pages of a window in its order, for the scoring loop of search()
+type entryIterator struct {
+	entries []windowEntry
+	next    int
+}
+
+func (it *entryIterator) HasNext() bool { return it.next < len(it.entries) }
+
+func (it *entryIterator) Next() uint32 {
+	it.next++
+	return it.entries[it.next-1].pageID
+}
+
+// resultWindowFromRequest reads the order, limit, cursor and grouping of a /search request, e.g.
+// /search?q=oswald&limit=50&cursor=eyJmIjo... or /search?q=oswald&group=document. A request with none
+// of limit, cursor and group gets every result in one window, see pagedRequest.
+func resultWindowFromRequest(c *gin.Context, sortParam string) (ResultWindow, error) {
+	var window ResultWindow
+	switch sortParam {
+	case "":
+	case "ranked", "bm25":
+		window.Sort = sortParam
+	default:
+		return window, fmt.Errorf("invalid sort %q, expected ranked or bm25", sortParam)
+	}
+	if pagedRequest(c) {
+		window.Limit = *cfigs.Int(kSearchLimit)
+	}
+	switch group := c.Query("group"); group {
+	case "":
+	case "document":
+		window.Group = group
+		if window.Sort == "" {
+			// documents are ordered by the scores of their pages, which sort=ranked gives by default
+			window.Sort = "ranked"
+		}
+	default:
+		return window, fmt.Errorf("invalid group %q, expected document", group)
+	}
+	if value, ok := c.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return window, fmt.Errorf("invalid limit %q, expected a whole number", value)
+		}
+		if maximum := *cfigs.Int(kSearchMaxLimit); limit < 1 || limit > maximum {
+			return window, fmt.Errorf("limit must be between 1 and %d", maximum)
+		}
+		window.Limit = limit
+	}
+	if token := c.Query("cursor"); token != "" {
+		after, err := decodeCursor(token)
+		if err != nil {
+			return window, err
+		}
+		window.After = after
+	}
+	return window, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/andreimerlescu/gematria"
+)
+
+// A serialized Roaring Bitmap spends about bytesPerPage on one page ID in the sparse array containers
+// that most postings are made of, after a header of about bitmapOverhead for a bitmap of one container.
+// That turns the length of a posting into an estimate of how many pages it holds without reading it.
+const (
+	bytesPerPage   = 2
+	bitmapOverhead = 16
+)
+
+// PlanStep is one clause of an AND as the planner ran it, in the order it ran
+type PlanStep struct {
+	Clause      string `json:"clause"`
+	Op          string `json:"op"`                // "and" intersects the clause, "not" subtracts it
+	Depth       int    `json:"depth"`             // nesting of the AND the clause belongs to, 0 for the query itself
+	Estimate    uint64 `json:"estimate"`          // pages the planner expected the clause to match
+	Cardinality uint64 `json:"cardinality"`       // pages left after the step
+	Skipped     bool   `json:"skipped,omitempty"` // the result was already empty, so the clause wasn't evaluated
+}
+
+// plannedClause is a child of an AND with its estimated cardinality
+type plannedClause struct {
+	node     QueryNode
+	estimate uint64
+}
+
+// planAnd splits the children of an AND into the inclusions, most selective first so that every later
+// one only narrows down an already small result, and the exclusions, broadest first as they are the
+// likeliest to empty it. Clauses estimated the same keep the order they were typed in.
+func (e *queryEvaluator) planAnd(n *AndNode) (inclusions, exclusions []plannedClause) {
+	for _, child := range n.Children {
+		if not, ok := child.(*NotNode); ok {
+			exclusions = append(exclusions, plannedClause{node: not.Child, estimate: e.estimate(not.Child)})
+			continue
+		}
+		inclusions = append(inclusions, plannedClause{node: child, estimate: e.estimate(child)})
+	}
+	sort.SliceStable(inclusions, func(i, j int) bool { return inclusions[i].estimate < inclusions[j].estimate })
+	sort.SliceStable(exclusions, func(i, j int) bool { return exclusions[i].estimate > exclusions[j].estimate })
+	return inclusions, exclusions
+}
+
+// record appends a step to the plan when the search asked to explain it
+func (e *queryEvaluator) record(clause plannedClause, op string, depth int, result *roaring.Bitmap, skipped bool) {
+	if !e.opts.Explain {
+		return
+	}
+	e.plan = append(e.plan, PlanStep{
+		Clause:      clause.node.String(),
+		Op:          op,
+		Depth:       depth,
+		Estimate:    clause.estimate,
+		Cardinality: result.GetCardinality(),
+		Skipped:     skipped,
+	})
+}
+
+// estimate guesses how many pages node matches from the lengths of the postings it would read. It
+// never reads a bitmap; wildcards and regular expressions, which can only be sized by expanding them,
+// are assumed to match every page so that they run last.
+func (e *queryEvaluator) estimate(node QueryNode) uint64 {
+	idx := e.index
+	switch n := node.(type) {
+	case *AndNode:
+		estimate := idx.allPageIDs.GetCardinality()
+		for _, child := range n.Children {
+			if _, ok := child.(*NotNode); !ok {
+				estimate = min(estimate, e.estimate(child))
+			}
+		}
+		return estimate
+	case *OrNode:
+		var estimate uint64
+		for _, child := range n.Children {
+			estimate += e.estimate(child)
+		}
+		return min(estimate, idx.allPageIDs.GetCardinality())
+	case *NotNode:
+		return idx.allPageIDs.GetCardinality() - min(idx.allPageIDs.GetCardinality(), e.estimate(n.Child))
+	case *TermNode:
+		return idx.pagesFor(e.termSize(n.Text))
+	case *PhraseNode:
+		return idx.pagesFor(idx.phraseSize(n.Words))
+	case *NearNode:
+		return idx.pagesFor(min(idx.phraseSize(nodeWords(n.Left)), idx.phraseSize(nodeWords(n.Right))))
+	case *FieldNode:
+		return idx.pagesFor(idx.postingSize(func(s *segment) *IndexReader { return s.field }, fieldKey(n.Field, n.Value)))
+	case *GematriaNode:
+		return idx.pagesFor(idx.gematriaSize(n.Cipher, n.Min, n.Max))
+	}
+	return idx.allPageIDs.GetCardinality()
+}
+
+// termSize sums the lengths of the postings termBitmap ORs together for word
+func (e *queryEvaluator) termSize(word string) int64 {
+	idx := e.index
+	var size int64
+	if e.opts.Exact {
+		size += idx.postingSize(func(s *segment) *IndexReader { return s.word }, word)
+	}
+	for _, algo := range e.opts.FuzzyAlgos {
+		for _, s := range idx.segments {
+			for _, indexWord := range s.fuzzy.candidates(word, algo, e.opts.Thresholds) {
+				size += s.word.Header[indexWord][1]
+			}
+		}
+	}
+	for _, cipher := range e.opts.GematriaTypes {
+		if value, ok := gematriaValue(gematria.FromString(word), cipher); ok {
+			size += idx.gematriaSize(cipher, value, value)
+		}
+	}
+	return size
+}
+
+// pagesFor turns a length of postings into an estimate of the pages they hold, at most every live page
+func (idx *indexSnapshot) pagesFor(size int64) uint64 {
+	if size <= 0 {
+		return 0
+	}
+	return min(uint64(max((size-bitmapOverhead)/bytesPerPage, 1)), idx.allPageIDs.GetCardinality())
+}
+
+// postingSize sums the length of the posting of key across the index that reader picks from each segment
+func (idx *indexSnapshot) postingSize(reader func(s *segment) *IndexReader, key string) int64 {
+	var size int64
+	for _, s := range idx.segments {
+		size += reader(s).Header[key][1]
+	}
+	return size
+}
+
+// phraseSize is the length of the smallest posting phraseBitmap intersects for words
+func (idx *indexSnapshot) phraseSize(words []string) int64 {
+	words = normalizeWords(strings.Join(words, " "))
+	word := func(s *segment) *IndexReader { return s.word }
+	if len(words) <= texteeMaxWords {
+		return idx.postingSize(word, strings.Join(words, " "))
+	}
+	size := int64(-1)
+	for i := 0; i+texteeMaxWords <= len(words); i++ {
+		gram := idx.postingSize(word, strings.Join(words[i:i+texteeMaxWords], " "))
+		if size < 0 || gram < size {
+			size = gram
+		}
+	}
+	return size
+}
+
+// gematriaSize sums the lengths of the postings of every value of cipher within [min, max]
+func (idx *indexSnapshot) gematriaSize(cipher string, min, max uint64) int64 {
+	var size int64
+	for _, s := range idx.segments {
+		for _, posting := range s.gematriaLookup.valuesIn(cipher, min, max) {
+			size += posting.offsetLen[1]
+		}
+	}
+	return size
+}
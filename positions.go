@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// pagePositions is the list of word offsets at which one word occurs on one page
+type pagePositions struct {
+	pageID    uint32
+	positions []uint32
+}
+
+// generatePositionPostings generates positional postings for the words of a page. Each posting
+// has the format "word pageID p1,p2,p3" where p is the zero based offset of the word in the
+// page text after it has been split the same way Textee splits it.
+func generatePositionPostings(content string, pageID int) []string {
+	wordPositions := make(map[string][]string)
+	var order []string
+	for i, word := range normalizeWords(content) {
+		if _, exists := wordPositions[word]; !exists {
+			order = append(order, word)
+		}
+		wordPositions[word] = append(wordPositions[word], strconv.Itoa(i))
+	}
+	postings := make([]string, 0, len(order))
+	for _, word := range order {
+		postings = append(postings, word+" "+strconv.Itoa(pageID)+" "+strings.Join(wordPositions[word], ","))
+	}
+	return postings
+}
+
+// buildPositionIndex constructs the positional index from a postings file (position_postings.txt)
+// and writes it to an index file (position_index.bin). It uses the same index container as buildIndex:
+//   - A DATA section where each word has one block of uvarints:
+//     pageCount, then for each page in ascending order: pageID, positionCount, position deltas
+//   - A DICT section mapping each word to the [offset, length] pair of its block
+func buildPositionIndex(postingsFile, indexFile string) error {
+	inFile, err := os.Open(postingsFile)
+	if err != nil {
+		return fmt.Errorf("open postings: %w", err)
+	}
+	defer inFile.Close()
+
+	wordToPages := make(map[string][]pagePositions)
+	scanner := bufio.NewScanner(inFile)
+	scanner.Buffer(make([]byte, 64*kilobyte), 16*megabyte)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 3 {
+			continue // Skip invalid lines
+		}
+		pageID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		entry := pagePositions{pageID: uint32(pageID)}
+		for _, p := range strings.Split(parts[2], ",") {
+			position, err := strconv.Atoi(p)
+			if err != nil {
+				continue
+			}
+			entry.positions = append(entry.positions, uint32(position))
+		}
+		wordToPages[parts[0]] = append(wordToPages[parts[0]], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan postings: %w", err)
+	}
+
+	words := make([]string, 0, len(wordToPages))
+	for word := range wordToPages {
+		words = append(words, word)
+	}
+	return writeRecordIndex(indexFile, words, func(word string) ([]byte, error) {
+		return encodePositions(wordToPages[word]), nil
+	})
+}
+
+// encodePositions serializes the positions of one word across pages into a block of uvarints
+func encodePositions(pages []pagePositions) []byte {
+	sort.Slice(pages, func(i, j int) bool { return pages[i].pageID < pages[j].pageID })
+	buf := binary.AppendUvarint(nil, uint64(len(pages)))
+	for _, page := range pages {
+		buf = binary.AppendUvarint(buf, uint64(page.pageID))
+		buf = binary.AppendUvarint(buf, uint64(len(page.positions)))
+		previous := uint32(0)
+		for _, position := range page.positions {
+			buf = binary.AppendUvarint(buf, uint64(position-previous))
+			previous = position
+		}
+	}
+	return buf
+}
+
+// decodePositions deserializes a block written by encodePositions, keeping only the pages in
+// candidates (all pages when candidates is nil)
+func decodePositions(data []byte, candidates *roaring.Bitmap) (map[uint32][]uint32, error) {
+	errCorrupt := errors.New("corrupt positions block")
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, errCorrupt
+		}
+		data = data[n:]
+		return v, nil
+	}
+	pageCount, err := next()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[uint32][]uint32)
+	for i := uint64(0); i < pageCount; i++ {
+		pageID, err := next()
+		if err != nil {
+			return nil, err
+		}
+		count, err := next()
+		if err != nil {
+			return nil, err
+		}
+		keep := candidates == nil || candidates.Contains(uint32(pageID))
+		var positions []uint32
+		if keep {
+			positions = make([]uint32, 0, count)
+		}
+		position := uint64(0)
+		for j := uint64(0); j < count; j++ {
+			delta, err := next()
+			if err != nil {
+				return nil, err
+			}
+			position += delta
+			if keep {
+				positions = append(positions, uint32(position))
+			}
+		}
+		if keep {
+			result[uint32(pageID)] = positions
+		}
+	}
+	return result, nil
+}
+
+// readPositions returns the positions of word on each of the candidates pages, across every segment
+func (idx *indexSnapshot) readPositions(word string, candidates *roaring.Bitmap) (map[uint32][]uint32, error) {
+	result := make(map[uint32][]uint32)
+	for _, s := range idx.segments {
+		offsetLen, ok := s.position.Header[word]
+		if !ok || offsetLen[1] <= 0 {
+			continue
+		}
+		data, err := s.position.Read(offsetLen)
+		if err != nil {
+			return nil, err
+		}
+		positions, err := decodePositions(data, candidates)
+		if err != nil {
+			return nil, err
+		}
+		for pageID, p := range positions {
+			result[pageID] = p // segments never share a page
+		}
+	}
+	return result, nil
+}
+
+// sequencePositions returns, for each candidate page, the positions at which words start as a
+// contiguous run
+func (idx *indexSnapshot) sequencePositions(words []string, candidates *roaring.Bitmap) (map[uint32][]uint32, error) {
+	starts, err := idx.readPositions(words[0], candidates)
+	if err != nil {
+		return nil, err
+	}
+	for i, word := range words[1:] {
+		if len(starts) == 0 {
+			break
+		}
+		next, err := idx.readPositions(word, candidates)
+		if err != nil {
+			return nil, err
+		}
+		for pageID, positions := range starts {
+			following := make(map[uint32]struct{}, len(next[pageID]))
+			for _, p := range next[pageID] {
+				following[p] = struct{}{}
+			}
+			kept := positions[:0]
+			for _, p := range positions {
+				if _, ok := following[p+uint32(i+1)]; ok {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) == 0 {
+				delete(starts, pageID)
+			} else {
+				starts[pageID] = kept
+			}
+		}
+	}
+	return starts, nil
+}
+
+// withinDistance reports whether a run of leftLen words starting at one of left and a run of
+// rightLen words starting at one of right are separated by at most distance words
+func withinDistance(left []uint32, leftLen int, right []uint32, rightLen int, distance int) bool {
+	for _, l := range left {
+		for _, r := range right {
+			var gap int
+			if l <= r {
+				gap = int(r) - (int(l) + leftLen - 1)
+			} else {
+				gap = int(l) - (int(r) + rightLen - 1)
+			}
+			if gap <= distance {
+				return true
+			}
+		}
+	}
+	return false
+}
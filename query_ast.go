@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// QueryNode is a node of the boolean query tree that ParseQuery produces from a search query.
+// Every node remembers the character position in the original query where it started so that
+// errors and explanations can point back at the part of the query that caused them.
+type QueryNode interface {
+	// Pos returns the character position (rune index) of the node in the original query
+	Pos() int
+	// String renders the node in a canonical form, e.g. and(or(top secret, confidential), not(oswald))
+	String() string
+}
+
+// AndNode matches pages that satisfy every one of its Children
+type AndNode struct {
+	Children []QueryNode
+	At       int
+}
+
+// OrNode matches pages that satisfy at least one of its Children
+type OrNode struct {
+	Children []QueryNode
+	At       int
+}
+
+// NotNode matches pages that do not satisfy Child
+type NotNode struct {
+	Child QueryNode
+	At    int
+}
+
+// TermNode is one or more adjacent bare words, e.g. `top secret`, that are matched against the
+// word index exactly, through the fuzzy algorithms and through the gematria ciphers
+type TermNode struct {
+	Text string
+	At   int
+}
+
+// PhraseNode is a quoted run of words, e.g. `"top secret"`, that only matches the exact words
+type PhraseNode struct {
+	Words []string
+	At    int
+}
+
+// WildcardNode is a term containing the glob characters * or ?, e.g. `assassinat*` or `commun?st`,
+// that matches every vocabulary term fitting Pattern exactly
+type WildcardNode struct {
+	Pattern string
+	At      int
+}
+
+// RegexNode is a regular expression between slashes, e.g. `/assassinat(ed|ion)/`, that matches
+// every vocabulary term it matches in full, ignoring case
+type RegexNode struct {
+	Source  string         // as written between the slashes
+	Pattern *regexp.Regexp // Source anchored and with its literals lowercased, see compileRegex
+	At      int
+}
+
+// FieldNode restricts a query to the pages whose Field (doc, page, cover or a record.json metadata
+// field) is Value, e.g. `doc:abc123` or `agency:cia`
+type FieldNode struct {
+	Field string
+	Value string
+	At    int
+}
+
+// GematriaNode selects the pages holding a word whose Cipher value lies within [Min, Max], e.g.
+// `english:119`, `jewish:600..700` or `simple:=oswald`. Spec is the text after the colon.
+type GematriaNode struct {
+	Cipher string
+	Spec   string
+	Min    uint64
+	Max    uint64
+	At     int
+}
+
+// NearNode matches pages on which Left and Right, each a term or phrase taken exactly, occur
+// within Distance words of each other
+type NearNode struct {
+	Left     QueryNode
+	Right    QueryNode
+	Distance int
+	At       int
+}
+
+// QueryError is returned by ParseQuery when a query cannot be parsed. Pos is the character
+// position (rune index) in the query where the problem was found so a UI can underline it.
+type QueryError struct {
+	Pos int    `json:"position"`
+	Msg string `json:"message"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query error at position %d: %s", e.Pos, e.Msg)
+}
+
+func (n *AndNode) Pos() int      { return n.At }
+func (n *OrNode) Pos() int       { return n.At }
+func (n *NotNode) Pos() int      { return n.At }
+func (n *TermNode) Pos() int     { return n.At }
+func (n *PhraseNode) Pos() int   { return n.At }
+func (n *NearNode) Pos() int     { return n.At }
+func (n *WildcardNode) Pos() int { return n.At }
+func (n *RegexNode) Pos() int    { return n.At }
+func (n *FieldNode) Pos() int    { return n.At }
+func (n *GematriaNode) Pos() int { return n.At }
+
+func (n *AndNode) String() string { return "and(" + joinNodes(n.Children) + ")" }
+func (n *OrNode) String() string  { return "or(" + joinNodes(n.Children) + ")" }
+func (n *NotNode) String() string { return "not(" + n.Child.String() + ")" }
+func (n *TermNode) String() string {
+	return n.Text
+}
+func (n *PhraseNode) String() string {
+	return `"` + strings.Join(n.Words, " ") + `"`
+}
+func (n *WildcardNode) String() string {
+	return n.Pattern
+}
+func (n *RegexNode) String() string {
+	return "/" + n.Source + "/"
+}
+func (n *FieldNode) String() string {
+	return n.Field + ":" + n.Value
+}
+func (n *GematriaNode) String() string {
+	return n.Cipher + ":" + n.Spec
+}
+func (n *NearNode) String() string {
+	return fmt.Sprintf("near/%d(%s, %s)", n.Distance, n.Left, n.Right)
+}
+
+// Text returns the words of the phrase joined by a single space
+func (n *PhraseNode) Text() string {
+	return strings.Join(n.Words, " ")
+}
+
+func joinNodes(nodes []QueryNode) string {
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, node.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// nodeWords returns the words of a term or phrase node
+func nodeWords(node QueryNode) []string {
+	switch n := node.(type) {
+	case *TermNode:
+		return strings.Fields(n.Text)
+	case *PhraseNode:
+		return n.Words
+	}
+	return nil
+}
+
+// queryLeaves returns the distinct leaves of the tree that aren't negated, which search() scores pages by
+func queryLeaves(node QueryNode) []QueryNode {
+	var leaves []QueryNode
+	seen := make(map[string]struct{})
+	var walk func(node QueryNode, negated bool)
+	walk = func(node QueryNode, negated bool) {
+		switch n := node.(type) {
+		case *AndNode:
+			for _, child := range n.Children {
+				walk(child, negated)
+			}
+		case *OrNode:
+			for _, child := range n.Children {
+				walk(child, negated)
+			}
+		case *NotNode:
+			walk(n.Child, !negated)
+		case *NearNode:
+			// proximity operands are matched exactly, so score them as phrases
+			walk(&PhraseNode{Words: nodeWords(n.Left), At: n.Left.Pos()}, negated)
+			walk(&PhraseNode{Words: nodeWords(n.Right), At: n.Right.Pos()}, negated)
+		case *TermNode, *PhraseNode, *WildcardNode, *RegexNode, *GematriaNode:
+			if _, exists := seen[n.String()]; !negated && !exists {
+				seen[n.String()] = struct{}{}
+				leaves = append(leaves, n)
+			}
+		}
+	}
+	walk(node, false)
+	return leaves
+}
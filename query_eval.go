@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/andreimerlescu/gematria"
+)
+
+// texteeMaxWords is the longest substring, in words, that Textee emits into the word index
+const texteeMaxWords = 3
+
+// nonWordChars matches the characters that Textee strips out of every substring
+var nonWordChars = regexp.MustCompile(`[^a-z0-9]`)
+
+// queryEvaluator resolves a QueryNode tree into a bitmap of page IDs using the word and gematria indexes
+// of every segment of index. A term is matched exactly when opts.Exact is set and through each of the
+// fuzzy algorithms and ciphers of opts. Evaluation stops with the error of ctx once it is done.
+type queryEvaluator struct {
+	ctx     context.Context
+	opts    SearchOptions
+	index   *indexSnapshot
+	plan    []PlanStep                            // the steps of every AND, when opts.Explain is set
+	depth   int                                   // nesting of the AND being evaluated
+	clauses []ClauseTrace                         // every clause evaluated, children first, when opts.Explain is set
+	current *ClauseTrace                          // the clause being evaluated, which expansions are recorded on
+	terms   map[string]map[string]*roaring.Bitmap // termCategories of every term evaluated
+	partial *roaring.Bitmap                       // the top-level AND so far when ctx ran out, see run
+}
+
+// run returns the live page IDs that satisfy the query tree, without the deleted pages that segments
+// still hold. When ctx runs out of time part way, run returns context.DeadlineExceeded together with
+// the pages of the top-level clauses that were evaluated in time, which the clauses left over could
+// still have ruled out, or nil when not even the first clause finished.
+func (e *queryEvaluator) run(tree QueryNode) (*roaring.Bitmap, error) {
+	if _, ok := tree.(*AndNode); !ok {
+		// plan a lone clause as an AND of one, so that its step is explained like any other
+		tree = &AndNode{Children: []QueryNode{tree}, At: tree.Pos()}
+	}
+	b, err := e.eval(tree)
+	if errors.Is(err, context.DeadlineExceeded) && e.partial != nil {
+		b = e.partial
+	} else if err != nil {
+		return nil, err
+	}
+	b.AndNot(e.index.deleted)
+	return b, err
+}
+
+// eval returns the page IDs that satisfy node
+func (e *queryEvaluator) eval(node QueryNode) (*roaring.Bitmap, error) {
+	return e.evalWithin(node, nil)
+}
+
+// evalWithin is eval for a node whose result only matters where it overlaps within, a nil within
+// being every page. When the search is explained, the clause is traced.
+func (e *queryEvaluator) evalWithin(node QueryNode, within *roaring.Bitmap) (*roaring.Bitmap, error) {
+	if !e.opts.Explain {
+		return e.evalNode(node, within)
+	}
+	parent := e.current
+	trace := &ClauseTrace{Clause: node.String(), Type: nodeType(node)}
+	e.current = trace
+	start := time.Now()
+	b, err := e.evalNode(node, within)
+	e.current = parent
+	if err != nil {
+		return nil, err
+	}
+	trace.Milliseconds = milliseconds(time.Since(start))
+	trace.Cardinality = roaring.AndNot(b, e.index.deleted).GetCardinality()
+	e.clauses = append(e.clauses, *trace)
+	return b, nil
+}
+
+// evalNode evaluates node; phrases and proximity only confirm the pages of within
+func (e *queryEvaluator) evalNode(node QueryNode, within *roaring.Bitmap) (*roaring.Bitmap, error) {
+	switch n := node.(type) {
+	case *AndNode:
+		return e.evalAnd(n)
+	case *OrNode:
+		result := roaring.New()
+		for _, child := range n.Children {
+			b, err := e.eval(child)
+			if err != nil {
+				return nil, err
+			}
+			result.Or(b)
+		}
+		return result, nil
+	case *NotNode:
+		b, err := e.eval(n.Child)
+		if err != nil {
+			return nil, err
+		}
+		return roaring.AndNot(e.index.allPageIDs, b), nil
+	case *TermNode:
+		return e.termBitmap(n.Text)
+	case *PhraseNode:
+		return e.phraseBitmap(n.Words, within)
+	case *NearNode:
+		return e.nearBitmap(n, within)
+	case *WildcardNode:
+		return e.wildcardBitmap(n)
+	case *RegexNode:
+		return e.regexBitmap(n)
+	case *FieldNode:
+		return e.index.fieldBitmap(n.Field, n.Value), nil
+	case *GematriaNode:
+		e.traceGematria(n.Cipher, n.Min, n.Max)
+		return e.index.gematriaBitmap(e.ctx, n.Cipher, n.Min, n.Max)
+	default:
+		return nil, fmt.Errorf("unsupported query node %T", node)
+	}
+}
+
+// evalAnd intersects the inclusions in the order planAnd puts them and then subtracts the exclusions,
+// so that `a not b` never has to materialize the complement of b. Once the result is empty the
+// remaining clauses are skipped, and the clauses that confirm candidates page by page, phrases and
+// proximity, only confirm the pages still in the result.
+func (e *queryEvaluator) evalAnd(n *AndNode) (*roaring.Bitmap, error) {
+	inclusions, exclusions := e.planAnd(n)
+	depth := e.depth
+	e.depth++
+	defer func() { e.depth-- }()
+
+	var result *roaring.Bitmap
+	for _, clause := range inclusions {
+		if result != nil && result.IsEmpty() {
+			e.record(clause, "and", depth, result, true)
+			continue
+		}
+		b, err := e.evalWithin(clause.node, result)
+		if err != nil {
+			e.keepPartial(depth, result, err)
+			return nil, err
+		}
+		if result == nil {
+			result = b
+		} else {
+			result.And(b)
+		}
+		e.record(clause, "and", depth, result, false)
+	}
+	if result == nil {
+		result = e.index.allPageIDs.Clone()
+	}
+	for _, clause := range exclusions {
+		if result.IsEmpty() {
+			e.record(clause, "not", depth, result, true)
+			continue
+		}
+		b, err := e.evalWithin(clause.node, result)
+		if err != nil {
+			e.keepPartial(depth, result, err)
+			return nil, err
+		}
+		result.AndNot(b)
+		e.record(clause, "not", depth, result, false)
+	}
+	return result, nil
+}
+
+// keepPartial keeps the result of the top-level AND when its next clause ran out of time, for run
+func (e *queryEvaluator) keepPartial(depth int, result *roaring.Bitmap, err error) {
+	if depth == 0 && result != nil && errors.Is(err, context.DeadlineExceeded) {
+		e.partial = result
+	}
+}
+
+// exactBitmap returns the pages whose Textee substrings contain word exactly
+func (e *queryEvaluator) exactBitmap(word string) *roaring.Bitmap {
+	result := roaring.New()
+	for _, s := range e.index.segments {
+		b, err := s.word.KeyBitmap(word)
+		if err != nil {
+			errorLogger.Printf("Read error for %s: %v", word, err)
+			continue
+		}
+		result.Or(b)
+	}
+	return result
+}
+
+// phraseBitmap returns the pages on which words appear contiguously. Textee only indexes
+// substrings of up to texteeMaxWords words, so a longer phrase is narrowed down by intersecting
+// the postings of each of its overlapping n-grams and then confirmed against the page text, only on
+// the pages of within unless that is nil.
+func (e *queryEvaluator) phraseBitmap(words []string, within *roaring.Bitmap) (*roaring.Bitmap, error) {
+	words = normalizeWords(strings.Join(words, " "))
+	if len(words) == 0 {
+		return roaring.New(), nil
+	}
+	if len(words) <= texteeMaxWords {
+		return e.exactBitmap(strings.Join(words, " ")), nil
+	}
+
+	var candidates *roaring.Bitmap
+	for i := 0; i+texteeMaxWords <= len(words); i++ {
+		b := e.exactBitmap(strings.Join(words[i:i+texteeMaxWords], " "))
+		if candidates == nil {
+			candidates = b
+		} else {
+			candidates.And(b)
+		}
+		if within != nil {
+			candidates.And(within)
+		}
+		if candidates.IsEmpty() {
+			return candidates, nil
+		}
+	}
+
+	result := roaring.New()
+	itr := candidates.Iterator()
+	for itr.HasNext() {
+		if err := e.ctx.Err(); err != nil {
+			return nil, err
+		}
+		pageID := itr.Next()
+		page, err := readPage(int(pageID))
+		if err != nil {
+			errorLogger.Printf("Phrase confirmation error for page %d: %v", pageID, err)
+			continue
+		}
+		if containsPhrase(normalizeWords(page.Textee.Input), words) {
+			result.Add(pageID)
+		}
+	}
+	return result, nil
+}
+
+// nearBitmap returns the pages on which both operands of n occur within n.Distance words of each
+// other. Candidates come from intersecting the operands' bitmaps; the positional index then
+// confirms the distance on each candidate, only on the pages of within unless that is nil.
+func (e *queryEvaluator) nearBitmap(n *NearNode, within *roaring.Bitmap) (*roaring.Bitmap, error) {
+	leftWords := normalizeWords(strings.Join(nodeWords(n.Left), " "))
+	rightWords := normalizeWords(strings.Join(nodeWords(n.Right), " "))
+	if len(leftWords) == 0 || len(rightWords) == 0 {
+		return roaring.New(), nil
+	}
+	candidates, err := e.phraseBitmap(leftWords, within)
+	if err != nil {
+		return nil, err
+	}
+	if !candidates.IsEmpty() {
+		right, err := e.phraseBitmap(rightWords, candidates)
+		if err != nil {
+			return nil, err
+		}
+		candidates.And(right)
+	}
+	if candidates.IsEmpty() {
+		return candidates, nil
+	}
+
+	leftStarts, err := e.index.sequencePositions(leftWords, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("positions for %s: %w", n.Left, err)
+	}
+	rightStarts, err := e.index.sequencePositions(rightWords, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("positions for %s: %w", n.Right, err)
+	}
+	result := roaring.New()
+	for pageID, left := range leftStarts {
+		if right, ok := rightStarts[pageID]; ok && withinDistance(left, len(leftWords), right, len(rightWords), n.Distance) {
+			result.Add(pageID)
+		}
+	}
+	return result, nil
+}
+
+// wildcardBitmap ORs together the bitmaps of every vocabulary term matching the wildcard pattern
+func (e *queryEvaluator) wildcardBitmap(n *WildcardNode) (*roaring.Bitmap, error) {
+	limit := *cfigs.Int(kWildcardMaxTerms)
+	result, err := e.expansionBitmap("wildcard", limit, func(terms []string) ([]string, error) {
+		return expandWildcard(terms, n.Pattern, limit)
+	})
+	if err != nil {
+		return nil, &QueryError{Pos: n.At, Msg: fmt.Sprintf("%s %v", n.Pattern, err)}
+	}
+	return result, nil
+}
+
+// regexBitmap ORs together the bitmaps of every vocabulary term matching the regular expression
+func (e *queryEvaluator) regexBitmap(n *RegexNode) (*roaring.Bitmap, error) {
+	limit := *cfigs.Int(kRegexMaxTerms)
+	budget := time.Duration(*cfigs.Int(kRegexTimeoutMs)) * time.Millisecond
+	deadline := time.Now().Add(budget)
+	result, err := e.expansionBitmap("regex", limit, func(terms []string) ([]string, error) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, errRegexTimeout{budget: budget}
+		}
+		return expandRegex(terms, n.Pattern, limit, remaining)
+	})
+	if err != nil {
+		return nil, &QueryError{Pos: n.At, Msg: fmt.Sprintf("%s %v", n, err)}
+	}
+	return result, nil
+}
+
+// expansionBitmap expands a term over the vocabulary of each segment and ORs together the bitmaps of
+// what it expands to, traced as kind. More than limit distinct terms across the segments is an errTooManyTerms.
+func (e *queryEvaluator) expansionBitmap(kind string, limit int, expand func(terms []string) ([]string, error)) (*roaring.Bitmap, error) {
+	expanded := make(map[string]struct{})
+	result := roaring.New()
+	for _, s := range e.index.segments {
+		terms, err := expand(s.word.Terms)
+		if err != nil {
+			return nil, err
+		}
+		for _, term := range terms {
+			if err := e.ctx.Err(); err != nil {
+				return nil, err
+			}
+			if _, seen := expanded[term]; !seen {
+				e.traceExpansion(kind, term)
+			}
+			expanded[term] = struct{}{}
+			b, err := s.word.KeyBitmap(term)
+			if err != nil {
+				errorLogger.Printf("Read error for %s: %v", term, err)
+				continue
+			}
+			result.Or(b)
+		}
+		if len(expanded) > limit {
+			return nil, errTooManyTerms{limit: limit}
+		}
+	}
+	return result, nil
+}
+
+// termBitmap returns the pages that match word exactly, through any of the fuzzy algorithms
+// or through any of the gematria ciphers selected by the options of the evaluator
+func (e *queryEvaluator) termBitmap(word string) (*roaring.Bitmap, error) {
+	categories, err := e.termCategories(word)
+	if err != nil {
+		return nil, err
+	}
+	temp := roaring.New()
+	for _, b := range categories {
+		temp.Or(b)
+	}
+	return temp, nil
+}
+
+// termCategories returns the pages that match word by the category they match it in, e.g.
+// exact/textee, fuzzy/soundex or gematria/simple. The bitmaps are kept for the categoryBitmaps of the
+// same search and must not be modified.
+func (e *queryEvaluator) termCategories(word string) (map[string]*roaring.Bitmap, error) {
+	if categories, ok := e.terms[word]; ok {
+		return categories, nil
+	}
+	categories := make(map[string]*roaring.Bitmap)
+	if e.opts.Exact {
+		b := e.exactBitmap(word)
+		if !b.IsEmpty() {
+			e.traceExpansion("exact", word)
+		}
+		categories["exact/textee"] = b
+	}
+
+	// Fuzzy matches, confirmed on the candidates that the fuzzy index of each segment shortlists for
+	// each algorithm; a term that several segments hold is only compared once
+	for _, algo := range e.opts.FuzzyAlgos {
+		temp := roaring.New()
+		confirmed := make(map[string]bool)
+		for _, s := range e.index.segments {
+			for _, indexWord := range s.fuzzy.candidates(word, algo, e.opts.Thresholds) {
+				if err := e.ctx.Err(); err != nil {
+					return nil, err
+				}
+				matched, seen := confirmed[indexWord]
+				if !seen {
+					matched = matchesConditionSingle(word, indexWord, algo, e.opts.Thresholds)
+					confirmed[indexWord] = matched
+					if matched {
+						e.traceExpansion(algo, indexWord)
+					}
+				}
+				if !matched {
+					continue
+				}
+				b, err := s.word.KeyBitmap(indexWord)
+				if err != nil {
+					errorLogger.Printf("Read error for %s (%s): %v", indexWord, algo, err)
+					continue
+				}
+				temp.Or(b)
+			}
+		}
+		categories["fuzzy/"+algo] = temp
+	}
+
+	// Gematria matches
+	queryGematria := gematria.FromString(word)
+	for _, cipher := range e.opts.GematriaTypes {
+		value, ok := gematriaValue(queryGematria, cipher)
+		if !ok {
+			continue
+		}
+		e.traceGematria(cipher, value, value)
+		b, err := e.index.gematriaBitmap(e.ctx, cipher, value, value)
+		if err != nil {
+			return nil, err
+		}
+		categories["gematria/"+cipher] = b
+	}
+	if e.terms == nil {
+		e.terms = make(map[string]map[string]*roaring.Bitmap)
+	}
+	e.terms[word] = categories
+	return categories, nil
+}
+
+// categoryBitmaps returns, for every category the pages of result matched the leaves of the query in,
+// which of them did, from the indexes alone so that pages can be ranked without reading them. The
+// scoring loop of search() finds the same categories on the page text. When ctx runs out of time the
+// categories of the leaves done so far are returned with context.DeadlineExceeded.
+func (e *queryEvaluator) categoryBitmaps(leaves []QueryNode, result *roaring.Bitmap) (map[string]*roaring.Bitmap, error) {
+	categories := make(map[string]*roaring.Bitmap)
+	add := func(category string, b *roaring.Bitmap) {
+		b = roaring.And(b, result)
+		if b.IsEmpty() {
+			return
+		}
+		if existing, ok := categories[category]; ok {
+			existing.Or(b)
+		} else {
+			categories[category] = b
+		}
+	}
+	if len(leaves) == 0 {
+		// the query only filters, e.g. doc:<id> or not oswald, so every page it left is a match
+		add("filter", result)
+	}
+	for _, leaf := range leaves {
+		var b *roaring.Bitmap
+		var err error
+		switch n := leaf.(type) {
+		case *TermNode:
+			var parts map[string]*roaring.Bitmap
+			if parts, err = e.termCategories(n.Text); err != nil {
+				return partialCategories(categories, err)
+			}
+			for category, part := range parts {
+				add(category, part)
+			}
+			continue
+		case *PhraseNode:
+			b, err = e.phraseBitmap(n.Words, result)
+		case *WildcardNode:
+			b, err = e.wildcardBitmap(n)
+		case *RegexNode:
+			b, err = e.regexBitmap(n)
+		case *GematriaNode:
+			if b, err = e.index.gematriaBitmap(e.ctx, n.Cipher, n.Min, n.Max); err != nil {
+				return partialCategories(categories, err)
+			}
+			add("gematria/"+n.Cipher, b)
+			continue
+		default:
+			continue
+		}
+		if err != nil {
+			return partialCategories(categories, err)
+		}
+		add("exact/textee", b)
+	}
+	return categories, nil
+}
+
+// partialCategories returns the categories found so far with err when err is the deadline of the
+// search, and only err otherwise
+func partialCategories(categories map[string]*roaring.Bitmap, err error) (map[string]*roaring.Bitmap, error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return categories, err
+	}
+	return nil, err
+}
+
+// normalizeWords splits text into lowercase words stripped of everything but letters and
+// digits, the same way Textee cleans the substrings that end up in the word index
+func normalizeWords(text string) []string {
+	var words []string
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		word := nonWordChars.ReplaceAllString(field, "")
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// containsPhrase reports whether phrase occurs as a contiguous run inside words
+func containsPhrase(words, phrase []string) bool {
+	if len(phrase) == 0 || len(phrase) > len(words) {
+		return false
+	}
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		matched := true
+		for j, word := range phrase {
+			if words[i+j] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// readPage decodes the PageData of pageID from the cache file, holding a reference on the reader so
+// that a reload replacing it meanwhile doesn't close it under the read
+func readPage(pageID int) (*PageData, error) {
+	pageOffsetsMu.RLock()
+	offsetLen, ok := cacheIdToOffset[pageID]
+	reader := cacheReader
+	if reader != nil {
+		reader.refs.Add(1)
+	}
+	pageOffsetsMu.RUnlock()
+	if reader == nil {
+		return nil, fmt.Errorf("read page %d: the cache file is closed", pageID)
+	}
+	defer reader.release()
+	if !ok {
+		return nil, fmt.Errorf("page ID %d not found", pageID)
+	}
+	page, err := reader.Page(offsetLen)
+	if err != nil {
+		return nil, fmt.Errorf("parse page %d: %w", pageID, err)
+	}
+	return page, nil
+}
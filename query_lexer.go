@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type queryTokenKind int
+
+const (
+	tokEOF queryTokenKind = iota
+	tokWord
+	tokPhrase
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+	tokNear
+	tokRegex
+)
+
+func (k queryTokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of query"
+	case tokWord:
+		return "word"
+	case tokPhrase:
+		return "phrase"
+	case tokAnd:
+		return "'and'"
+	case tokOr:
+		return "'or'"
+	case tokNot:
+		return "'not'"
+	case tokLParen:
+		return "'('"
+	case tokRParen:
+		return "')'"
+	case tokNear:
+		return "'near'"
+	case tokRegex:
+		return "regular expression"
+	default:
+		return "unknown token"
+	}
+}
+
+// queryToken is a single lexeme of a search query; pos is the rune index where it starts
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+// isQuerySpecial reports whether r terminates a bare word in a search query
+func isQuerySpecial(r rune) bool {
+	switch r {
+	case '(', ')', '[', ']', '{', '}', '"', '&', '|', ',', '!':
+		return true
+	}
+	return unicode.IsSpace(r)
+}
+
+// regexEnd returns the index of the slash that closes the regular expression opened by the slash at
+// start, or -1 when no unescaped slash follows or the first one is followed by more of the word
+func regexEnd(runes []rune, start int) int {
+	for i := start + 1; i < len(runes); i++ {
+		switch {
+		case runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == '/':
+			i++
+		case runes[i] == '/':
+			if i+1 < len(runes) && !isQuerySpecial(runes[i+1]) {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// lexQuery splits a search query into tokens. Besides the keywords and, or and not it accepts
+// the symbolic shorthand that the reader has always allowed:
+//   - `&`, `&&` for and
+//   - `|`, `||` and `,` for or
+//   - `!` and `!&` for not
+//   - `[]` and `{}` as parentheses
+//
+// A word of the form near/<n> is the proximity operator, e.g. `oswald NEAR/10 mexico city`, and
+// anything between two slashes, e.g. `/assassinat(ed|ion)/`, is a regular expression kept as
+// written; a slash inside it is escaped as `\/`. A regular expression starts at the beginning of a
+// word and ends where a word would, so a slash that doesn't close, as in `a /b`, or one inside a
+// word, as in `9/11`, is part of that word.
+func lexQuery(q string) ([]queryToken, error) {
+	runes := []rune(q)
+	var tokens []queryToken
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == '[' || r == '{':
+			tokens = append(tokens, queryToken{kind: tokLParen, text: string(r), pos: i})
+			i++
+		case r == ')' || r == ']' || r == '}':
+			tokens = append(tokens, queryToken{kind: tokRParen, text: string(r), pos: i})
+			i++
+		case r == '&':
+			start := i
+			for i < len(runes) && runes[i] == '&' {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokAnd, text: string(runes[start:i]), pos: start})
+		case r == '|' || r == ',':
+			start := i
+			for i < len(runes) && (runes[i] == '|' || runes[i] == ',') {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokOr, text: string(runes[start:i]), pos: start})
+		case r == '!':
+			start := i
+			i++
+			for i < len(runes) && runes[i] == '&' {
+				i++ // !& is a single not
+			}
+			tokens = append(tokens, queryToken{kind: tokNot, text: string(runes[start:i]), pos: start})
+		case r == '"':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != '"' {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, &QueryError{Pos: start, Msg: "unterminated quoted phrase"}
+			}
+			tokens = append(tokens, queryToken{kind: tokPhrase, text: strings.ToLower(string(runes[start+1 : i])), pos: start})
+			i++
+		case r == '/' && regexEnd(runes, i) > i:
+			start, end := i, regexEnd(runes, i)
+			var pattern strings.Builder
+			for i++; i < end; i++ {
+				if runes[i] == '\\' && runes[i+1] == '/' {
+					i++
+				}
+				pattern.WriteRune(runes[i])
+			}
+			tokens = append(tokens, queryToken{kind: tokRegex, text: pattern.String(), pos: start})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !isQuerySpecial(runes[i]) {
+				i++
+			}
+			word := strings.ToLower(string(runes[start:i]))
+			kind := tokWord
+			switch word {
+			case "and":
+				kind = tokAnd
+			case "or":
+				kind = tokOr
+			case "not":
+				kind = tokNot
+			default:
+				if strings.HasPrefix(word, "near/") {
+					distance, err := strconv.Atoi(strings.TrimPrefix(word, "near/"))
+					if err != nil || distance < 0 {
+						return nil, &QueryError{Pos: start, Msg: fmt.Sprintf("invalid proximity %q, expected near/<words>", word)}
+					}
+					kind = tokNear
+				}
+			}
+			tokens = append(tokens, queryToken{kind: kind, text: word, pos: start})
+		}
+	}
+	tokens = append(tokens, queryToken{kind: tokEOF, pos: len(runes)})
+	return tokens, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// queryParser is a recursive-descent parser over the tokens produced by lexQuery.
+//
+// Grammar, from lowest to highest precedence:
+//
+//	query   := or EOF
+//	or      := and ( OR and )*
+//	and     := unary ( [AND] unary )*      adjacent groups and `a not b` are an implicit and
+//	unary   := NOT unary | near
+//	near    := primary [ NEAR primary ]     both operands must be a term or a phrase
+//	primary := '(' or ')' | PHRASE | REGEX | FIELD | WORD+
+//
+// A run of words containing * or ? becomes a WildcardNode instead of a TermNode. A word of the
+// form doc:<id> or agency:"<value>" is a FIELD filter and stands alone; exclude_doc:<id> is the
+// same as not doc:<id>. So does a gematria operator: english:119, jewish:600..700 or simple:=oswald.
+//
+// Adjacent bare words form a single term so that `top secret` is looked up as the Textee
+// substring "top secret" rather than as two unrelated words.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// ParseQuery parses a search query into a QueryNode tree. When the query is malformed the
+// returned error is a *QueryError carrying the character position of the problem.
+func ParseQuery(q string) (QueryNode, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	tokens = collapseOperators(tokens)
+	p := &queryParser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, &QueryError{Pos: 0, Msg: "empty query"}
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok.kind)}
+	}
+	return node, nil
+}
+
+// collapseOperators merges runs of binary operators such as `and and` or `and or` into a
+// single operator; a run containing any or becomes or, otherwise it stays and
+func collapseOperators(tokens []queryToken) []queryToken {
+	out := make([]queryToken, 0, len(tokens))
+	for _, tok := range tokens {
+		if n := len(out); n > 0 && (tok.kind == tokAnd || tok.kind == tokOr) {
+			prev := &out[n-1]
+			if prev.kind == tokAnd || prev.kind == tokOr {
+				if tok.kind == tokOr {
+					prev.kind = tokOr
+				}
+				continue
+			}
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) parseOr() (QueryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []QueryNode{first}
+	for p.peek().kind == tokOr {
+		p.next()
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	return newOrNode(children, first.Pos()), nil
+}
+
+func (p *queryParser) parseAnd() (QueryNode, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []QueryNode{first}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokNot, tokWord, tokPhrase, tokRegex, tokLParen:
+			// implicit and
+		default:
+			return newAndNode(children, first.Pos()), nil
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+}
+
+func (p *queryParser) parseUnary() (QueryNode, error) {
+	if p.peek().kind != tokNot {
+		return p.parseNear()
+	}
+	tok := p.next()
+	child, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if inner, ok := child.(*NotNode); ok {
+		return inner.Child, nil // not not x is x
+	}
+	return &NotNode{Child: child, At: tok.pos}, nil
+}
+
+func (p *queryParser) parseNear() (QueryNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokNear {
+		return left, nil
+	}
+	op := p.next()
+	if nodeWords(left) == nil {
+		return nil, &QueryError{Pos: op.pos, Msg: fmt.Sprintf("%s needs a term or phrase on its left", op.text)}
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if nodeWords(right) == nil {
+		return nil, &QueryError{Pos: right.Pos(), Msg: fmt.Sprintf("%s needs a term or phrase on its right", op.text)}
+	}
+	if tok := p.peek(); tok.kind == tokNear {
+		return nil, &QueryError{Pos: tok.pos, Msg: "near operators cannot be chained, group them with and"}
+	}
+	distance, _ := strconv.Atoi(strings.TrimPrefix(op.text, "near/"))
+	return &NearNode{Left: left, Right: right, Distance: distance, At: left.Pos()}, nil
+}
+
+func (p *queryParser) parsePrimary() (QueryNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokLParen:
+		p.next()
+		if p.peek().kind == tokRParen {
+			return nil, &QueryError{Pos: tok.pos, Msg: "empty group"}
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unclosed %q", tok.text)}
+		}
+		p.next()
+		return node, nil
+	case tokPhrase:
+		p.next()
+		words := strings.Fields(tok.text)
+		if len(words) == 0 {
+			return nil, &QueryError{Pos: tok.pos, Msg: "empty phrase"}
+		}
+		return &PhraseNode{Words: words, At: tok.pos}, nil
+	case tokRegex:
+		p.next()
+		if tok.text == "" {
+			return nil, &QueryError{Pos: tok.pos, Msg: "empty regular expression"}
+		}
+		re, err := compileRegex(tok.text)
+		if err != nil {
+			return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("invalid regular expression: %v", err)}
+		}
+		return &RegexNode{Source: tok.text, Pattern: re, At: tok.pos}, nil
+	case tokWord:
+		if cipher, spec, ok := strings.Cut(tok.text, ":"); ok && isGematriaCipher(cipher) {
+			p.next()
+			bounds := spec
+			if spec == "=" && p.peek().kind == tokPhrase {
+				word := p.next().text
+				spec, bounds = `="`+word+`"`, "="+word
+			}
+			min, max, err := parseGematriaBounds(cipher, bounds)
+			if err != nil {
+				return nil, &QueryError{Pos: tok.pos, Msg: err.Error()}
+			}
+			return &GematriaNode{Cipher: cipher, Spec: spec, Min: min, Max: max, At: tok.pos}, nil
+		}
+		if field, value, exclude, ok := parseFieldFilter(tok.text); ok {
+			p.next()
+			if value == "" {
+				if p.peek().kind != tokPhrase {
+					return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("%s needs a value", tok.text)}
+				}
+				value = p.next().text
+			}
+			return fieldFilterNode(field, value, exclude, tok.pos), nil
+		}
+		var words []string
+		for next := p.peek(); next.kind == tokWord && !isOperatorWord(next.text); next = p.peek() {
+			words = append(words, p.next().text)
+		}
+		text := strings.Join(words, " ")
+		if isWildcard(text) {
+			return &WildcardNode{Pattern: text, At: tok.pos}, nil
+		}
+		return &TermNode{Text: text, At: tok.pos}, nil
+	case tokEOF:
+		return nil, &QueryError{Pos: tok.pos, Msg: "expected a search term"}
+	default:
+		return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok.kind)}
+	}
+}
+
+// isOperatorWord reports whether word is a field filter such as doc:<id> or a gematria operator
+// such as english:119, either of which stands alone instead of joining the words around it
+func isOperatorWord(word string) bool {
+	if cipher, _, ok := strings.Cut(word, ":"); ok && isGematriaCipher(cipher) {
+		return true
+	}
+	_, _, _, ok := parseFieldFilter(word)
+	return ok
+}
+
+// newAndNode flattens nested and nodes, drops duplicate children and unwraps a single child
+func newAndNode(children []QueryNode, at int) QueryNode {
+	var flat []QueryNode
+	for _, child := range children {
+		if and, ok := child.(*AndNode); ok {
+			flat = append(flat, and.Children...)
+		} else {
+			flat = append(flat, child)
+		}
+	}
+	flat = uniqueNodes(flat)
+	if len(flat) == 1 {
+		return flat[0]
+	}
+	return &AndNode{Children: flat, At: at}
+}
+
+// newOrNode flattens nested or nodes, drops duplicate children and unwraps a single child
+func newOrNode(children []QueryNode, at int) QueryNode {
+	var flat []QueryNode
+	for _, child := range children {
+		if or, ok := child.(*OrNode); ok {
+			flat = append(flat, or.Children...)
+		} else {
+			flat = append(flat, child)
+		}
+	}
+	flat = uniqueNodes(flat)
+	if len(flat) == 1 {
+		return flat[0]
+	}
+	return &OrNode{Children: flat, At: at}
+}
+
+func uniqueNodes(nodes []QueryNode) []QueryNode {
+	seen := make(map[string]struct{}, len(nodes))
+	out := make([]QueryNode, 0, len(nodes))
+	for _, node := range nodes {
+		key := node.String()
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, node)
+	}
+	return out
+}
+
+// compileRegex anchors pattern to match whole terms of the lowercased vocabulary regardless of case.
+// Its character classes take both cases and its literals are lowercased rather than matched with
+// (?i), which would leave the compiled pattern without the literal prefix expandRegex narrows its
+// scan with.
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl|syntax.FoldCase)
+	if err != nil {
+		return nil, err
+	}
+	lowercaseLiterals(re)
+	return regexp.Compile("^(?:" + re.String() + ")$")
+}
+
+// lowercaseLiterals lowercases the case-folded literals of re and drops their folding
+func lowercaseLiterals(re *syntax.Regexp) {
+	if re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase != 0 {
+		for i, r := range re.Rune {
+			re.Rune[i] = unicode.ToLower(r)
+		}
+		re.Flags &^= syntax.FoldCase
+	}
+	for _, sub := range re.Sub {
+		lowercaseLiterals(sub)
+	}
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
@@ -18,6 +17,106 @@ import (
 )
 
 func handleSearch(c *gin.Context) {
+	query, opts, release, ok := searchRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	sortParam := c.Query("sort")
+
+	// facets=agency,collection adds the facet counts of every matching page to the response
+	var facetFields []string
+	for _, param := range c.QueryArray("facets") {
+		for _, field := range strings.Split(param, ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			if field == "" {
+				continue
+			}
+			if _, _, _, ok := parseFieldFilter(field + ":"); !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown facet field " + field})
+				return
+			}
+			facetFields = append(facetFields, field)
+		}
+	}
+
+	var err error
+	if value, ok := c.GetQuery("explain"); ok {
+		if opts.Explain, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid explain %q, expected true or false", value)})
+			return
+		}
+	}
+	window, err := resultWindowFromRequest(c, sortParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch window.Sort {
+	case "ranked":
+		// Return ranked results with weighted scores, their per-category breakdown and match details
+		if window.Weights, err = categoryWeightsFromRequest(c); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	case "bm25":
+		// Return results ranked by BM25 with match details
+		params, err := bm25ParamsFromRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.BM25 = &params
+	}
+	opts.Window = &window
+
+	results, err := search(c.Request.Context(), query, opts)
+	if err != nil {
+		respondSearchError(c, query, err)
+		return
+	}
+
+	paged := pagedRequest(c)
+	if window.Group != "" {
+		respondSearch(c, results.Groups, facetFields, results, paged)
+		return
+	}
+	if window.Sort != "" {
+		respondSearch(c, results.Window, facetFields, results, paged)
+		return
+	}
+	// Default: page IDs in the order of the index
+	flatResults := make([]string, 0, len(results.Window))
+	for _, page := range results.Window {
+		flatResults = append(flatResults, page.ID)
+	}
+	respondSearch(c, flatResults, facetFields, results, paged)
+}
+
+// searchRequest reads the query, from q or query, and the search options that /search and
+// /search/explain share, then waits for one of the searches the client may run at a time. A request
+// that can't be read is answered with 400 and ok is false; otherwise release gives the slot back.
+func searchRequest(c *gin.Context) (query string, opts SearchOptions, release func(), ok bool) {
+	query = c.Query("q")
+	if len(query) == 0 {
+		query = c.Query("query")
+		if len(query) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query"})
+			return "", SearchOptions{}, nil, false
+		}
+	}
+	opts, err := searchOptionsFromRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", SearchOptions{}, nil, false
+	}
+	return query, opts, acquireIPSearchSlot(c), true
+}
+
+// acquireIPSearchSlot waits for one of the kPerIPSearchLimit searches the client may run at a time and
+// returns the func that gives it back
+func acquireIPSearchSlot(c *gin.Context) (release func()) {
 	ip := FilteredIP(c)
 	// kPerIPSearchLimit restricts FilteredIP through a semaphore, so in order to get the
 	// semaphore for the FilteredIP, we need to perform this series of reader lock/unlocks
@@ -36,406 +135,378 @@ func handleSearch(c *gin.Context) {
 	searchSemaphoresLock.RLock()   // lock the sema reader
 	searchSemaphores[ip].Acquire() // acquire a lock for the ip
 	searchSemaphoresLock.RUnlock() // unlock the sema reader
-	defer func() {                 // when results delivered to user
+	return func() {                // when results delivered to user
 		searchSemaphoresLock.RLock()   // lock the sema reader
 		searchSemaphores[ip].Release() // release the lock for the ip
 		searchSemaphoresLock.RUnlock() // unlock the sema reader
-	}()
-	query := c.Query("q")
-	if len(query) == 0 {
-		query = c.Query("query")
-		if len(query) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query"})
-			return
-		}
 	}
+}
 
-	sortParam := c.Query("sort")
-	rank := sortParam == "ranked"
-
-	results, err := search(query)
-	if err != nil {
-		errorLogger.Printf("Search error for query %q: %v", query, err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Internal server error",
-			"message": "Check the server logs to see what happened.",
+// respondSearchError answers a search that failed: a query that could not be parsed or expanded with
+// the position of the problem, anything else as an internal error
+func respondSearchError(c *gin.Context, query string, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Search for query %q was cancelled: the client went away", query)
+		c.Abort()
+		return
+	}
+	if errors.Is(err, errCursorMismatch) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    queryErr.Msg,
+			"position": queryErr.Pos,
 		})
 		return
 	}
+	errorLogger.Printf("Search error for query %q: %v", query, err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   "Internal server error",
+		"message": "Check the server logs to see what happened.",
+	})
+}
 
-	if rank {
-		// Return ranked results with scores and match details
-		type rankedPage struct {
-			ID      string        `json:"id"`
-			Score   int           `json:"score"`
-			Matches []MatchDetail `json:"matches"`
-		}
-		var ranked []rankedPage
-		for pageID, count := range results.HitCounts {
-			ranked = append(ranked, rankedPage{
-				ID:      pageID,
-				Score:   count,
-				Matches: results.Matches[pageID],
-			})
-		}
-		// Sort by score descending, then ID ascending for stability
-		sort.Slice(ranked, func(i, j int) bool {
-			if ranked[i].Score == ranked[j].Score {
-				return ranked[i].ID < ranked[j].ID
-			}
-			return ranked[i].Score > ranked[j].Score
-		})
-		c.JSON(http.StatusOK, ranked)
-	} else {
-		// Default: flat list for backward compatibility
-		seen := make(map[string]struct{})
-		var flatResults []string
-		for _, pages := range results.Categories {
-			for _, pageID := range pages {
-				if _, exists := seen[pageID]; !exists {
-					seen[pageID] = struct{}{}
-					flatResults = append(flatResults, pageID)
-				}
-			}
+// respondSearch writes the search results. A paged response is one window of them with the number of
+// results that matched and the cursor of the next window, null after the last one. Otherwise it is the
+// bare body, wrapped only when facet counts or the query plan were requested or the search ran out of
+// time. Either carries the facet counts, the plan and the partial flag when there are any.
+func respondSearch(c *gin.Context, body interface{}, facetFields []string, results SearchResults, paged bool) {
+	if !paged && len(facetFields) == 0 && results.Plan == nil && !results.Partial {
+		c.JSON(http.StatusOK, body)
+		return
+	}
+	response := gin.H{"results": body}
+	if paged {
+		response["total"], response["next_cursor"] = results.Total, nil
+		if results.NextCursor != "" {
+			response["next_cursor"] = results.NextCursor
 		}
-		c.JSON(http.StatusOK, flatResults)
 	}
+	if len(facetFields) > 0 {
+		index := acquireIndex()
+		defer index.release()
+		response["facets"] = index.facetCounts(facetFields, results.Pages)
+	}
+	if results.Plan != nil {
+		response["plan"] = results.Plan
+	}
+	if results.Partial {
+		response["partial"] = true
+	}
+	c.JSON(http.StatusOK, response)
 }
 
-func search(query string) (SearchResults, error) {
+// acquireSearchSlot waits for one of the kMaxSearches slots of systemSearchSemaphore, or until ctx is
+// done; a slot that frees up for a search that stopped waiting is handed straight back
+func acquireSearchSlot(ctx context.Context) error {
+	acquired := make(chan struct{})
+	go func() {
+		systemSearchSemaphore.Acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			systemSearchSemaphore.Release()
+		}()
+		return ctx.Err()
+	}
+}
+
+// search evaluates query, restricted by the field filters of opts such as doc:<id>, and scores every
+// matching page with only the matchers that opts selects
+func search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
 	// the system has a limit on the number of concurrent searches that can be performed
 	// across the entire appliance regardless of the status of the searchSemaphores map[ip]sema
 	// that was released allowing them to search... the system needs to release a spot before
 	// a new search can be performed since this is a resource intensive process. This semaphore
 	// allows you to install the search application on a small virtual machine and serve 140GB
 	// of assets in a cached search that is blazing fast, like 30ms response times!
-	systemSearchSemaphore.Acquire()
+	if err := acquireSearchSlot(ctx); err != nil {
+		return SearchResults{}, err
+	}
 	defer systemSearchSemaphore.Release()
 
-	// Start timing the search for performance logging
-	startTime := time.Now()
-
-	// Analyze the query
-	analysis := AnalyzeQuery(query)
-	resultBitmap := roaring.New()
-	resultMutex := sync.RWMutex{}
-	fuzzyAlgos := []string{"jaro", "jaro-winkler", "soundex", "hamming", "ukkonen", "wagner-fisher"}
-	gematriaTypes := []string{"simple", "english", "jewish", "eights", "mystery", "majestic"}
-
-	// concurrently process the AND and NOT conditions
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-
-	// Process AND conditions using the in-memory word index header
-	go func() {
-		defer wg.Done()
-		for _, andCond := range analysis.Ands {
-			temp := roaring.New()
-			// Handle OR groups or single terms
-			var words []string
-			if strings.HasPrefix(andCond, "(") && strings.HasSuffix(andCond, ")") {
-				words = strings.Split(strings.Trim(andCond, "()"), " or ")
-				for i, w := range words {
-					words[i] = strings.TrimSpace(w)
-				}
-			} else {
-				words = []string{andCond}
-			}
-
-			for _, word := range words {
-				// Exact match
-				if offsetLen, ok := wordIndexHeader[word]; ok {
-					if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-						b := roaring.New()
-						data := make([]byte, offsetLen[1])
-						if _, err := wordIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-							errorLogger.Printf("Seek error: %v", err)
-							continue
-						}
-						if _, err := wordIndexHandle.Read(data); err != nil {
-							errorLogger.Printf("Read error: %v", err)
-							continue
-						}
-						if err := b.UnmarshalBinary(data); err != nil {
-							errorLogger.Printf("Unmarshal error: %v", err)
-							continue
-						}
-						temp.Or(b)
-					}
-				}
-
-				// Fuzzy matches
-				for _, algo := range fuzzyAlgos {
-					for indexWord := range wordIndexHeader {
-						if matchesConditionSingle(word, indexWord, algo) {
-							if offsetLen, ok := wordIndexHeader[indexWord]; ok {
-								if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-									b := roaring.New()
-									data := make([]byte, offsetLen[1])
-									if _, err := wordIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-										errorLogger.Printf("Seek error: %v", err)
-										continue
-									}
-									if _, err := wordIndexHandle.Read(data); err != nil {
-										errorLogger.Printf("Read error: %v", err)
-										continue
-									}
-									if err := b.UnmarshalBinary(data); err != nil {
-										errorLogger.Printf("Unmarshal error: %v", err)
-										continue
-									}
-									temp.Or(b)
-								}
-							}
-						}
-					}
-				}
+	// a query only gets kSearchTimeoutMs once it holds its slot, after which it returns the pages it
+	// confirmed so far; a client that goes away stops it straight away
+	if timeout := *cfigs.Int(kSearchTimeoutMs); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	if err := ctx.Err(); errors.Is(err, context.Canceled) {
+		return SearchResults{}, err
+	}
 
-				// Gematria matches
-				queryGematria := gematria.FromString(word)
-				for gemKey, offsetLen := range wordIndexGematrias {
-					parts := strings.SplitN(gemKey, "_", 2)
-					if len(parts) != 2 {
-						continue
-					}
-					gemType, gemValueStr := parts[0], parts[1]
-					gemValue, err := strconv.ParseUint(gemValueStr, 10, 64)
-					if err != nil {
-						errorLogger.Printf("ParseUint error: %v", err)
-						continue
-					}
-					// Match against queryGematria based on gemType
-					matches := false
-					switch gemType {
-					case "simple":
-						matches = queryGematria.Simple == gemValue
-					case "english":
-						matches = queryGematria.English == gemValue
-					case "jewish":
-						matches = queryGematria.Jewish == gemValue
-					case "eights":
-						matches = queryGematria.Eights == gemValue
-					case "mystery":
-						matches = queryGematria.Mystery == gemValue
-					case "majestic":
-						matches = queryGematria.Majestic == gemValue
-					}
-					if matches {
-						if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-							b := roaring.New()
-							data := make([]byte, offsetLen[1])
-							if _, err := gemIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-								errorLogger.Printf("Seek error for %s: %v", gemKey, err)
-								continue
-							}
-							if _, err := gemIndexHandle.Read(data); err != nil {
-								errorLogger.Printf("Read error for %s: %v", gemKey, err)
-								continue
-							}
-							if err := b.UnmarshalBinary(data); err != nil {
-								errorLogger.Printf("Unmarshal error for %s: %v", gemKey, err)
-								continue
-							}
-							temp.Or(b)
-						}
-					}
-				}
-			}
-			resultMutex.Lock()
-			if resultBitmap.IsEmpty() {
-				resultBitmap = temp
-			} else {
-				resultBitmap.And(temp)
-			}
-			resultMutex.Unlock()
+	// a cursor only continues the search it was handed out for
+	var fingerprint uint64
+	if opts.Window != nil {
+		fingerprint = windowFingerprint(query, opts)
+		if after := opts.Window.After; after != nil && after.Fingerprint != fingerprint {
+			return SearchResults{}, errCursorMismatch
 		}
-	}()
-
-	// Process NOT conditions (similar logic)
-	go func() {
-		defer wg.Done()
-		for _, notCond := range analysis.Nots {
-			temp := roaring.New()
-			var words []string
-			if strings.HasPrefix(notCond, "(") && strings.HasSuffix(notCond, ")") {
-				words = strings.Split(strings.Trim(notCond, "()"), " or ")
-				for i, w := range words {
-					words[i] = strings.TrimSpace(w)
-				}
-			} else {
-				words = []string{notCond}
-			}
+	}
 
-			for _, word := range words {
-				if offsetLen, ok := wordIndexHeader[word]; ok {
-					if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-						b := roaring.New()
-						data := make([]byte, offsetLen[1])
-						if _, err := wordIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-							errorLogger.Printf("Seek error for %s: %v", word, err)
-							continue
-						}
-						if _, err := wordIndexHandle.Read(data); err != nil {
-							errorLogger.Printf("Seek error for %s: %v", word, err)
-							continue
-						}
-						if err := b.UnmarshalBinary(data); err != nil {
-							errorLogger.Printf("Unmarshal error for %s: %v", word, err)
-							continue
-						}
-						temp.Or(b)
-					}
-				}
+	// Start timing the search for performance logging
+	startTime := time.Now()
 
-				for _, algo := range fuzzyAlgos {
-					for indexWord := range wordIndexHeader {
-						if matchesConditionSingle(word, indexWord, algo) {
-							if offsetLen, ok := wordIndexHeader[indexWord]; ok {
-								if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-									b := roaring.New()
-									data := make([]byte, offsetLen[1])
-									if _, err := wordIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-										errorLogger.Printf("wordIndexHandle.Seek error for %s: %v", word, err)
-										continue
-									}
-									if _, err := wordIndexHandle.Read(data); err != nil {
-										errorLogger.Printf("wordIndexHandle.Read(data) err: %v", err)
-										continue
-									}
-									if err := b.UnmarshalBinary(data); err != nil {
-										errorLogger.Printf("Unmarshal error for %s: %v", algo, err)
-										continue
-									}
-									temp.Or(b)
-								}
-							}
-						}
-					}
-				}
+	// Parse the query into a boolean tree
+	tree, err := ParseQuery(query)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	if len(opts.Filters) > 0 {
+		tree = newAndNode(append([]QueryNode{tree}, opts.Filters...), tree.Pos())
+	}
+	parsed := time.Now()
 
-				queryGematria := gematria.FromString(word)
-				for gemKey, offsetLen := range wordIndexGematrias {
-					parts := strings.SplitN(gemKey, "_", 2)
-					if len(parts) != 2 {
-						continue
-					}
-					gemType, gemValueStr := parts[0], parts[1]
-					gemValue, err := strconv.ParseUint(gemValueStr, 10, 64)
-					if err != nil {
-						errorLogger.Printf("Parse gematria for %s: %v", gemKey, err)
-						continue
-					}
-					matches := false
-					switch gemType {
-					case "simple":
-						matches = queryGematria.Simple == gemValue
-					case "english":
-						matches = queryGematria.English == gemValue
-					case "jewish":
-						matches = queryGematria.Jewish == gemValue
-					case "eights":
-						matches = queryGematria.Eights == gemValue
-					case "mystery":
-						matches = queryGematria.Mystery == gemValue
-					case "majestic":
-						matches = queryGematria.Majestic == gemValue
-					}
-					if matches {
-						if offsetLen[0] >= 0 && offsetLen[1] > 0 {
-							b := roaring.New()
-							data := make([]byte, offsetLen[1])
-							if _, err := gemIndexHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-								errorLogger.Printf("Seek error for %s: %v", gemKey, err)
-								continue
-							}
-							if _, err := gemIndexHandle.Read(data); err != nil {
-								errorLogger.Printf("Read error for %s: %v", gemKey, err)
-								continue
-							}
-							if err := b.UnmarshalBinary(data); err != nil {
-								errorLogger.Printf("Unmarshal error for %s: %v", gemKey, err)
-								continue
-							}
-							temp.Or(b)
-						}
-					}
-				}
-			}
-			resultMutex.Lock()
-			resultBitmap.AndNot(temp)
-			resultMutex.Unlock()
+	index := acquireIndex()
+	defer index.release()
+	evaluator := &queryEvaluator{ctx: ctx, opts: opts, index: index}
+	resultBitmap, err := evaluator.run(tree)
+	partial := false
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the pages of the clauses that were evaluated in time, see queryEvaluator.run
+		partial = true
+		if resultBitmap == nil {
+			resultBitmap = roaring.New()
 		}
-	}()
+	} else if err != nil {
+		return SearchResults{}, err
+	}
+	evaluated := time.Now()
 
 	// Initialize results
 	results := SearchResults{
 		Categories: make(map[string][]string),
 		HitCounts:  make(map[string]int),
 		Matches:    make(map[string][]MatchDetail),
+		Pages:      resultBitmap,
+		Plan:       evaluator.plan,
+	}
+	if opts.Explain {
+		results.Tree = tree
+		results.Clauses = evaluator.clauses
 	}
 
-	wg.Wait()
+	// Score the pages by BM25 from the stored term frequencies before reading any of them
+	leaves := queryLeaves(tree)
+	var bm25 map[uint32]float64
+	if opts.BM25 != nil {
+		results.Scores = make(map[string]float64)
+		bm25, err = index.bm25Scores(ctx, bm25Terms(leaves), resultBitmap, *opts.BM25)
+		if errors.Is(err, context.DeadlineExceeded) {
+			partial = true
+		} else if err != nil {
+			return SearchResults{}, err
+		}
+	}
+
+	// Order the pages from the indexes and cut out the window, so that only its pages are read
+	var window []windowEntry
+	var documents []documentEntry
+	var next *searchCursor
+	var itr roaring.IntIterable = resultBitmap.Iterator()
+	identifiers := make(map[uint32]*PageData)
+	if opts.Window != nil {
+		if opts.Window.Group == "document" {
+			documents, next, results.Total, err = evaluator.cutDocuments(resultBitmap, leaves, bm25, fingerprint)
+			window = documentBestPages(documents)
+		} else {
+			results.Total = resultBitmap.GetCardinality()
+			window, next, err = evaluator.cutResults(resultBitmap, leaves, bm25, fingerprint)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			partial = true
+		} else if err != nil {
+			return SearchResults{}, err
+		}
+		itr = &entryIterator{entries: window}
+	}
+
+	// A search that ran out of time before this point still reads the pages it found, up to one window
+	// of them, so that it returns what it has rather than nothing; only its client going away stops it
+	overtime, scoreLimit := partial, -1
+	if overtime && (opts.Window == nil || opts.Window.Limit == 0) {
+		scoreLimit = *cfigs.Int(kSearchLimit)
+	}
 
 	// Process matching pages using the in-memory cache index
-	itr := resultBitmap.Iterator()
+	confirmed := roaring.New()
 	for itr.HasNext() {
-		pageID := int(itr.Next())
-		offsetLen, ok := cacheIdToOffset[pageID]
-		if !ok {
-			errorLogger.Printf("Page ID %d not found", pageID)
-			continue
+		if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) && !overtime {
+			partial = true
+			break
+		} else if errors.Is(err, context.Canceled) {
+			return SearchResults{}, err
 		}
-		data := make([]byte, offsetLen[1])
-		if _, err := cacheFileHandle.Seek(offsetLen[0], io.SeekStart); err != nil {
-			errorLogger.Printf("Seek error: %v", err)
-			continue
+		if scoreLimit >= 0 && confirmed.GetCardinality() >= uint64(scoreLimit) {
+			break
 		}
-		if _, err := cacheFileHandle.Read(data); err != nil {
+		pageID := int(itr.Next())
+		confirmed.Add(uint32(pageID))
+		page, err := readPage(pageID)
+		if err != nil {
 			errorLogger.Printf("Search error for query %q: %v", query, err)
 			continue
 		}
-		var page PageData
-		if err := json.Unmarshal(data, &page); err != nil {
-			errorLogger.Printf("Error parsing page: %v", err)
-			continue
-		}
 		categoryMatched := make(map[string]bool)
+		if len(leaves) == 0 {
+			// the query only filters, e.g. doc:<id> or not oswald, so every page it left is a match
+			categoryMatched["filter"] = true
+		}
+		text := newPageText(page.Textee)
+		var matches []MatchDetail
+		record := func(leaf QueryNode, category string, term pageTerm) {
+			categoryMatched[category] = true
+			snippet, offset, matchStart, matchEnd := text.snippet(term)
+			matches = append(matches, MatchDetail{
+				Text:       term.Text,
+				Query:      leaf.String(),
+				Gematria:   text.gematria(term),
+				Category:   category,
+				Snippet:    snippet,
+				Offset:     offset,
+				MatchStart: matchStart,
+				MatchEnd:   matchEnd,
+			})
+		}
 
-		for _, andCond := range analysis.Ands {
-			words := strings.Fields(andCond)
-			for _, word := range words {
-				queryGematria := gematria.FromString(word)
-				if matchesExactTextee(word, page.Textee) {
-					categoryMatched["exact/textee"] = true
+		for _, leaf := range leaves {
+			if phrase, ok := leaf.(*PhraseNode); ok {
+				// phrases only ever match exactly
+				if term, found := text.findPhrase(phrase.Words); found {
+					record(leaf, "exact/textee", term)
 				}
-				for _, algo := range fuzzyAlgos {
-					category := "fuzzy/" + algo
-					for pw := range page.Textee.Gematrias {
-						if matchesConditionSingle(word, pw, algo) {
-							categoryMatched[category] = true
-							break
-						}
-					}
+				continue
+			}
+			if wildcard, ok := leaf.(*WildcardNode); ok {
+				if term, found := text.findWildcard(wildcard.Pattern); found {
+					record(leaf, "exact/textee", term)
 				}
-				for _, gemType := range gematriaTypes {
-					category := "gematria/" + gemType
-					for _, pg := range page.Textee.Gematrias {
-						if matchesConditionGematria(pg, queryGematria) {
-							categoryMatched[category] = true
-							break
-						}
-					}
+				continue
+			}
+			if gem, ok := leaf.(*GematriaNode); ok {
+				if term, found := text.findGematriaRange(gem.Cipher, gem.Min, gem.Max); found {
+					record(leaf, "gematria/"+gem.Cipher, term)
 				}
+				continue
 			}
+			if re, ok := leaf.(*RegexNode); ok {
+				if term, found := text.findRegex(re.Pattern); found {
+					record(leaf, "exact/textee", term)
+				}
+				continue
+			}
+			word := leaf.(*TermNode).Text
+			queryGematria := gematria.FromString(word)
+			if opts.Exact {
+				if term, found := text.findExact(word); found {
+					record(leaf, "exact/textee", term)
+				}
+			}
+			for _, algo := range opts.FuzzyAlgos {
+				if term, found := text.find(func(pw string) bool { return matchesConditionSingle(word, pw, algo, opts.Thresholds) }); found {
+					record(leaf, "fuzzy/"+algo, term)
+				}
+			}
+			for _, gemType := range opts.GematriaTypes {
+				// only the selected cipher counts, so that ciphers=english never reports a simple match
+				value, _ := gematriaValue(queryGematria, gemType)
+				if term, found := text.findGematriaRange(gemType, value, value); found {
+					record(leaf, "gematria/"+gemType, term)
+				}
+			}
+		}
+		identifiers[uint32(pageID)] = page
+		if len(matches) > 0 {
+			results.Matches[page.PageIdentifier] = matches
 		}
 
 		for category := range categoryMatched {
 			results.Categories[category] = append(results.Categories[category], page.PageIdentifier)
 			results.HitCounts[page.PageIdentifier]++
 		}
+		if opts.BM25 != nil && opts.Window == nil && len(categoryMatched) > 0 {
+			results.Scores[page.PageIdentifier] = bm25[uint32(pageID)] + opts.BM25.CategoryBoost*float64(len(categoryMatched))
+		}
+	}
+
+	if partial {
+		results.Partial = true
+		if opts.Window == nil {
+			results.Pages = confirmed
+		} else {
+			// the window ends at the last page, or document, it confirmed every page of and the next one
+			// resumes from there
+			window = window[:confirmed.GetCardinality()]
+			last := window
+			if opts.Window.Group == "document" {
+				documents = confirmedDocuments(documents, len(window))
+				last = make([]windowEntry, 0, len(documents))
+				for _, document := range documents {
+					last = append(last, document.windowEntry)
+				}
+			}
+			next = opts.Window.After
+			if len(last) > 0 {
+				end := last[len(last)-1]
+				next = &searchCursor{Fingerprint: fingerprint, Score: end.score, PageID: end.pageID}
+			}
+		}
+		log.Printf("Search for query %q ran out of time after confirming %d of %d pages", query, confirmed.GetCardinality(), resultBitmap.GetCardinality())
+	}
+	ranked := func(entry windowEntry) (rankedPage, bool) {
+		page, ok := identifiers[entry.pageID]
+		if !ok {
+			return rankedPage{}, false // the page could not be read
+		}
+		id := page.PageIdentifier
+		if opts.BM25 != nil {
+			results.Scores[id] = entry.score
+		}
+		return rankedPage{ID: id, Score: entry.score, Breakdown: entry.breakdown, Matches: results.Matches[id]}, true
+	}
+	if opts.Window != nil && opts.Window.Group == "document" {
+		results.Groups = make([]DocumentGroup, 0, len(documents))
+		for _, document := range documents {
+			group := DocumentGroup{ID: document.key, Score: document.score, Hits: document.hits, Pages: []rankedPage{}}
+			if best, ok := identifiers[document.pageID]; ok {
+				// the field index only holds the normalized identifier, the page has it as written
+				group.ID, group.Cover = best.DocumentIdentifier, best.CoverPageIdentifier
+			}
+			for _, entry := range document.best {
+				if page, ok := ranked(entry); ok {
+					group.Pages = append(group.Pages, page)
+				}
+			}
+			results.Groups = append(results.Groups, group)
+		}
+	} else {
+		for _, entry := range window {
+			if page, ok := ranked(entry); ok {
+				results.Window = append(results.Window, page)
+			}
+		}
+	}
+	if next != nil {
+		results.NextCursor = next.encode()
 	}
 
 	duration := time.Since(startTime)
+	if opts.Explain {
+		results.Timings = []PhaseTiming{
+			{Phase: "parse", Milliseconds: milliseconds(parsed.Sub(startTime))},
+			{Phase: "evaluate", Milliseconds: milliseconds(evaluated.Sub(parsed))},
+			{Phase: "score", Milliseconds: milliseconds(time.Since(evaluated))},
+		}
+	}
 	log.Printf("Search for query %q completed in %v", query, duration)
 	return results, nil
 }
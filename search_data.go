@@ -2,79 +2,61 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/RoaringBitmap/roaring"
 )
 
-// loadSearchData loads the word index header and cache index mappings into memory,
-// and keeps the word_index.bin and apario-search-cache.jsonl files open for search operations.
+// loadSearchData opens the base segment and every incremental segment with their dictionaries, loads
+// the cache index mappings into memory, and keeps apario-search-cache.jsonl open for search operations.
+// Every file is read through an IndexReader so searches can share them safely. Index files written
+// before the versioned index container are migrated first, or refused, see loadIndexFile.
 func loadSearchData() error {
-	// Load word index
-	wordIndexHandle, err := os.Open(filepath.Join(*cfigs.String(kCacheDir), wordIndexFile))
-	if err != nil {
-		return fmt.Errorf("failed to open word index file: %w", err)
-	}
+	// the segments are opened again, so merges of the ones published so far are dropped
+	cacheMutex.Lock()
+	indexGeneration.Add(1)
+	cacheMutex.Unlock()
 
-	var headerOffset uint64
-	err = binary.Read(wordIndexHandle, binary.LittleEndian, &headerOffset)
-	if err != nil {
-		return fmt.Errorf("failed to read word header offset: %w", err)
+	for _, name := range []string{wordIndexFile, gemIndexFile, positionIndexFile, fieldIndexFile} {
+		if err := loadIndexFile(filepath.Join(*cfigs.String(kCacheDir), name), name == gemIndexFile); err != nil {
+			return fmt.Errorf("failed to load %s: %w", name, err)
+		}
 	}
 
-	_, err = wordIndexHandle.Seek(int64(headerOffset), io.SeekStart)
+	segments, err := loadSegments()
 	if err != nil {
-		return fmt.Errorf("failed to seek to word header offset: %w", err)
+		return fmt.Errorf("failed to open index segments: %w", err)
 	}
-
-	wordIndexHeader = make(map[string][2]int64)
-	if err := json.NewDecoder(wordIndexHandle).Decode(&wordIndexHeader); err != nil {
-		return fmt.Errorf("failed to decode word header: %w", err)
-	}
-	if len(wordIndexHeader) == 0 {
+	base := segments[0]
+	if len(base.word.Header) == 0 {
+		closeSegments(segments)
 		return fmt.Errorf("word index header is empty")
 	}
-	log.Printf("Loaded word index header with %d entries", len(wordIndexHeader))
-
-	// Load gematria index
-	gemIndexHandle, err = os.Open(filepath.Join(*cfigs.String(kCacheDir), gemIndexFile))
-	if err != nil {
-		return fmt.Errorf("failed to open gematria index file: %w", err)
-	}
-
-	err = binary.Read(gemIndexHandle, binary.LittleEndian, &headerOffset)
-	if err != nil {
-		return fmt.Errorf("failed to read gematria header offset: %w", err)
-	}
-
-	_, err = gemIndexHandle.Seek(int64(headerOffset), io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("failed to seek to gematria header offset: %w", err)
-	}
-
-	wordIndexGematrias = make(map[string][2]int64)
-	if err := json.NewDecoder(gemIndexHandle).Decode(&wordIndexGematrias); err != nil {
-		return fmt.Errorf("failed to decode gematria header: %w", err)
-	}
-	if len(wordIndexGematrias) == 0 {
+	if base.gematriaLookup.size() == 0 {
+		closeSegments(segments)
 		return fmt.Errorf("gematria index header is empty")
 	}
-	log.Printf("Loaded gematria index header with %d entries", len(wordIndexGematrias))
+	log.Printf("Loaded base segment with %d words, %d gematria values, %d positions and %d fields",
+		len(base.word.Header), base.gematriaLookup.size(), len(base.position.Header), len(base.field.Header))
+	if len(segments) > 1 {
+		log.Printf("Loaded %d incremental segments", len(segments)-1)
+	}
 
 	// Load cache index
 	cacheIdx, err := os.Open(filepath.Join(*cfigs.String(kCacheDir), cacheIndexFile))
 	if err != nil {
+		closeSegments(segments)
 		return fmt.Errorf("failed to open cache index file: %w", err)
 	}
 	defer cacheIdx.Close()
 
-	cacheIdToOffset = make(map[int][2]int64)
+	offsets := make(map[int][2]int64)
+	allPageIDs := roaring.New()
 	scanner := bufio.NewScanner(cacheIdx)
 	for scanner.Scan() {
 		parts := strings.Split(scanner.Text(), " ")
@@ -83,31 +65,93 @@ func loadSearchData() error {
 		}
 		id, err := strconv.Atoi(parts[0])
 		if err != nil {
+			closeSegments(segments)
 			return fmt.Errorf("failed to parse page ID: %w", err)
 		}
 		offset, err := strconv.ParseInt(parts[1], 10, 64)
 		if err != nil {
+			closeSegments(segments)
 			return fmt.Errorf("failed to parse offset: %w", err)
 		}
 		length, err := strconv.ParseInt(parts[2], 10, 64)
 		if err != nil {
+			closeSegments(segments)
 			return fmt.Errorf("failed to parse length: %w", err)
 		}
-		cacheIdToOffset[id] = [2]int64{offset, length}
+		offsets[id] = [2]int64{offset, length}
+		allPageIDs.Add(uint32(id))
 	}
 	if err := scanner.Err(); err != nil {
+		closeSegments(segments)
 		return fmt.Errorf("error reading cache index: %w", err)
 	}
-	if len(cacheIdToOffset) == 0 {
+	if len(offsets) == 0 {
+		closeSegments(segments)
 		return fmt.Errorf("cache index is empty")
 	}
-	log.Printf("Loaded cache index with %d entries", len(cacheIdToOffset))
+	log.Printf("Loaded cache index with %d entries", len(offsets))
+
+	// The base segment holds every page that no incremental segment holds
+	base.pages = allPageIDs
+	for _, s := range segments[1:] {
+		base.pages.AndNot(s.pages)
+	}
+
+	// Load the deleted pages and the files every other page was read from
+	deleted, err := loadTombstones()
+	if err != nil {
+		closeSegments(segments)
+		return fmt.Errorf("failed to load tombstones: %w", err)
+	}
+	sources, err := loadPageSources(deleted)
+	if err != nil {
+		closeSegments(segments)
+		return fmt.Errorf("failed to load page sources: %w", err)
+	}
+	if !deleted.IsEmpty() {
+		log.Printf("Loaded %d deleted pages", deleted.GetCardinality())
+	}
 
 	// Open cache file
-	cacheFileHandle, err = os.Open(filepath.Join(*cfigs.String(kCacheDir), cacheFile))
+	reader, err := OpenRecordReader(filepath.Join(*cfigs.String(kCacheDir), cacheFile))
 	if err != nil {
+		closeSegments(segments)
 		return fmt.Errorf("failed to open cache file: %w", err)
 	}
 
+	pageOffsetsMu.Lock()
+	previous := cacheReader
+	cacheIdToOffset, cacheReader = offsets, newSharedRecordReader(reader)
+	pageOffsetsMu.Unlock()
+	previous.release() // closed once the searches reading it are done, see readPage
+
+	cacheMutex.Lock()
+	pageSources = sources
+	pageIDs, err = loadPageIDRegistry()
+	cacheMutex.Unlock()
+	if err != nil {
+		closeSegments(segments)
+		return fmt.Errorf("failed to load the page ID registry: %w", err)
+	}
+	publishIndex(func(next *indexSnapshot) {
+		next.segments = segments
+		next.deleted = deleted
+	})
 	return nil
 }
+
+// closeCacheReader unpublishes cacheReader, closing it once the searches reading it are done
+func closeCacheReader() {
+	pageOffsetsMu.Lock()
+	previous := cacheReader
+	cacheReader = nil
+	pageOffsetsMu.Unlock()
+	previous.release()
+}
+
+// closeSegments closes segments that were opened but never published
+func closeSegments(segments []*segment) {
+	for _, s := range segments {
+		s.close()
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -10,7 +11,9 @@ import (
 func (sm *SearchManager) runSearch(session *SearchSession) {
 	defer func() {
 		sm.mu.Lock()
-		delete(sm.activeSearches, session.Keyword)
+		if sm.activeSearches[session.Key] == session {
+			delete(sm.activeSearches, session.Key)
+		}
 		sm.mu.Unlock()
 
 		for _, ch := range session.Channels {
@@ -20,77 +23,131 @@ func (sm *SearchManager) runSearch(session *SearchSession) {
 		sm.cacheResults(session)
 	}()
 
-	results, err := search(session.Keyword)
+	defer session.cancel()
+	results, err := search(session.ctx, session.Keyword, session.Options)
+	session.mu.Lock()
 	if err != nil {
+		session.Partial = true
+		session.mu.Unlock()
 		return
 	}
-	session.mu.Lock()
-	defer session.mu.Unlock()
+	session.Partial = results.Partial
+	for category, pageIDs := range results.Categories {
+		session.Results[category] = pageIDs
+	}
+	// only the channels a client subscribed to have a reader, see subscribeToSearch, so no page is sent
+	// to the others and a send gives up once every client has left
+	subscribed := make(map[string]bool)
+	for _, channels := range session.Clients {
+		for _, category := range channels {
+			subscribed[category] = true
+		}
+	}
+	session.mu.Unlock()
 
 	for category, pageIDs := range results.Categories {
-		if ch, ok := session.Channels[category]; ok {
-			for _, pageID := range pageIDs {
-				// Optionally send full match details via WebSocket
-				for _, match := range results.Matches[pageID] {
-					if match.Category == category {
-						ch <- pageID // Simple version: just page ID
-						// TODO: Add option to send MatchDetail if needed
-					}
-				}
+		ch, ok := session.Channels[category]
+		if !ok || !subscribed[category] {
+			continue
+		}
+		for _, pageID := range pageIDs {
+			select {
+			case ch <- pageID:
+			case <-session.ctx.Done():
+				return
 			}
 		}
-		session.Results[category] = pageIDs
 	}
 }
 
-// Get or create a search session
-func (sm *SearchManager) getOrCreateSession(keyword string) *SearchSession {
+// sessionKey identifies a search by its keyword and options, so only identical searches share a session or cache entry
+func sessionKey(keyword string, opts SearchOptions) string {
+	return keyword + "\x00" + opts.key()
+}
+
+// getOrCreateSession subscribes conn to the channels of the search of keyword with opts, starting it
+// unless an identical one is running that its clients haven't all left. conn is registered before a
+// new search starts, so that its channels are among those the search sends its pages to.
+func (sm *SearchManager) getOrCreateSession(keyword string, opts SearchOptions, conn *websocket.Conn, subChannels []string) *SearchSession {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	if session, exists := sm.activeSearches[keyword]; exists {
-		return session
+	key := sessionKey(keyword, opts)
+	if session, exists := sm.activeSearches[key]; exists {
+		session.mu.Lock()
+		running := session.ctx.Err() == nil
+		if running {
+			session.Clients[conn] = subChannels
+		}
+		session.mu.Unlock()
+		if running {
+			return session
+		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	session := &SearchSession{
+		ctx:      ctx,
+		cancel:   cancel,
+		Key:      key,
 		Keyword:  keyword,
+		Options:  opts,
 		Channels: make(map[string]chan string),
-		Clients:  make(map[*websocket.Conn][]string),
+		Clients:  map[*websocket.Conn][]string{conn: subChannels},
 		Done:     make(chan struct{}),
 		Results:  make(map[string][]string),
 		mu:       sync.Mutex{},
 	}
 
-	// Define supported channels
-	channels := []string{
-		"exact/textee",
-		"fuzzy/jaro",
-		"fuzzy/jaro-winkler",
-		"fuzzy/soundex",
-		"fuzzy/hamming",
-		"fuzzy/wagner-fischer",
-		"gematria/simple",
-		"gematria/english",
-		"gematria/jewish",
-		"gematria/majestic",
-		"gematria/mystery",
-		"gematria/eights",
+	// Define the channels of the matchers this search runs
+	channels := []string{"filter"}
+	if opts.Exact {
+		channels = append(channels, "exact/textee")
+	}
+	for _, algo := range opts.FuzzyAlgos {
+		channels = append(channels, "fuzzy/"+algo)
+	}
+	for _, cipher := range opts.GematriaTypes {
+		channels = append(channels, "gematria/"+cipher)
 	}
 	for _, ch := range channels {
-		session.Channels[ch] = make(chan string, 100) // Buffered to prevent blocking
+		session.Channels[ch] = make(chan string, 100) // Buffered so a reader can fall behind
 	}
 
-	sm.activeSearches[keyword] = session
+	sm.activeSearches[key] = session
 	go sm.runSearch(session)
 	return session
 }
 
-// Cache completed search results
+// leave unsubscribes conn from session. Once no client is left waiting for it the search is cancelled,
+// and a later subscriber to the same search starts a new one.
+func (sm *SearchManager) leave(session *SearchSession, conn *websocket.Conn) {
+	session.mu.Lock()
+	delete(session.Clients, conn)
+	abandoned := len(session.Clients) == 0
+	if abandoned {
+		session.cancel()
+	}
+	session.mu.Unlock()
+	if !abandoned {
+		return
+	}
+	sm.mu.Lock()
+	if sm.activeSearches[session.Key] == session {
+		delete(sm.activeSearches, session.Key)
+	}
+	sm.mu.Unlock()
+}
+
+// Cache completed search results; a search that was cut short is not cached
 func (sm *SearchManager) cacheResults(session *SearchSession) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	if session.Partial {
+		return
+	}
 
-	sm.cache[session.Keyword] = &SearchResult{
+	sm.cache[session.Key] = &SearchResult{
 		Results:   session.Results,
 		Timestamp: time.Now(),
 	}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// The index is split into segments, each an immutable set of the word, gematria, position, field and
+// frequency indexes over its own pages; no page is in two segments. buildCache writes the base segment into the
+// cache directory. Every document the watcher sees afterwards becomes a small segment under
+// segments/<id>, searchable as soon as it is written, and the merger compacts segments of about the
+// same size into a larger one in the background. A query ORs the bitmaps of every segment. The next
+// full rebuild folds them all back into the base segment.
+const (
+	segmentsDirName    = "segments"
+	segmentPagesFile   = "pages.bin"       // Roaring Bitmap of the page IDs of an incremental segment
+	segmentSourcesFile = "merged_from.txt" // the segments a merged segment replaces, one directory name per line
+	segmentTempPrefix  = ".tmp-"
+
+	// baseSegmentID identifies the base segment, incremental segments count up from 1
+	baseSegmentID = 0
+)
+
+// segment is one immutable set of indexes, see segmentsDirName
+type segment struct {
+	id  int
+	dir string
+
+	word, gematria, position, field, frequency *IndexReader
+	gematriaLookup                             gematriaLookupTable
+	lengths                                    *pageLengths
+	fuzzy                                      *fuzzyIndex
+	pages                                      *roaring.Bitmap
+
+	// refs counts the snapshot that publishes the segment plus every search reading it, see acquireIndex
+	refs      atomic.Int64
+	obsolete  atomic.Bool // replaced by a merge, its directory is removed once it is closed
+	closeOnce sync.Once
+}
+
+// indexSnapshot is the set of segments that one search reads from start to finish
+type indexSnapshot struct {
+	segments    []*segment
+	deleted     *roaring.Bitmap // tombstoned pages, which segments may still hold until they are rewritten
+	allPageIDs  *roaring.Bitmap // every live page of every segment, what a negated query is subtracted from
+	totalLength uint64          // the summed length in words of every live page, see bm25Scores
+}
+
+var (
+	// indexMu guards currentIndex; searches take the read lock only long enough to acquire it
+	indexMu      sync.RWMutex
+	currentIndex *indexSnapshot
+
+	// lastSegmentID is the id of the newest incremental segment, see nextSegmentID
+	lastSegmentID atomic.Int64
+
+	// segmentMergeRequests wakes the merger after a segment was added
+	segmentMergeRequests = make(chan struct{}, 1)
+
+	// segmentMergeMu lets one merge run at a time, so that no two merges pick the same segments
+	segmentMergeMu sync.Mutex
+
+	// indexGeneration counts the full rebuilds and reloads of the index, which replace every segment;
+	// a merge that was overtaken by one is dropped, see mergeSegmentsOnce. Changed under cacheMutex.
+	indexGeneration atomic.Uint64
+
+	// segmentMergeWritten, when set, is called once a merge has written its segment and before it takes
+	// cacheMutex to publish it, so that tests can act while a merge is running
+	segmentMergeWritten func()
+)
+
+// segmentsDir returns the directory that holds the incremental segments
+func segmentsDir() string {
+	return filepath.Join(*cfigs.String(kCacheDir), segmentsDirName)
+}
+
+// nextSegmentID reserves the id of a new incremental segment
+func nextSegmentID() int {
+	return int(lastSegmentID.Add(1))
+}
+
+// segmentDirName names the directory of an incremental segment so that directories sort by id
+func segmentDirName(id int) string {
+	return fmt.Sprintf("%06d", id)
+}
+
+// openSegment opens the indexes of the segment in dir. The returned segment holds one reference, the
+// one publishIndex hands over to the snapshot that publishes it.
+func openSegment(id int, dir string) (*segment, error) {
+	s := &segment{id: id, dir: dir, pages: roaring.New()}
+	s.refs.Store(1)
+	var err error
+	if s.word, s.fuzzy, err = OpenWordIndex(filepath.Join(dir, wordIndexFile)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to open word index: %w", err)
+	}
+	if s.gematria, s.gematriaLookup, err = OpenGematriaIndex(filepath.Join(dir, gemIndexFile)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to open gematria index: %w", err)
+	}
+	if s.position, err = OpenIndexReader(filepath.Join(dir, positionIndexFile)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to open position index: %w", err)
+	}
+	if s.field, err = OpenIndexReader(filepath.Join(dir, fieldIndexFile)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to open field index: %w", err)
+	}
+	if s.frequency, s.lengths, err = OpenFrequencyIndex(filepath.Join(dir, frequencyIndexFile)); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to open frequency index: %w", err)
+	}
+	if id != baseSegmentID {
+		data, err := os.ReadFile(filepath.Join(dir, segmentPagesFile))
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to read segment pages: %w", err)
+		}
+		if err := s.pages.UnmarshalBinary(data); err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to decode segment pages: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// close closes the index files of the segment
+func (s *segment) close() {
+	for _, reader := range []*IndexReader{s.word, s.gematria, s.position, s.field, s.frequency} {
+		_ = reader.Close()
+	}
+}
+
+// release drops one reference; the last one closes the segment and, once a merge replaced it,
+// removes its directory
+func (s *segment) release() {
+	if s.refs.Add(-1) != 0 {
+		return
+	}
+	s.closeOnce.Do(func() {
+		s.close()
+		if s.obsolete.Load() && s.id != baseSegmentID {
+			if err := os.RemoveAll(s.dir); err != nil {
+				errorLogger.Printf("Failed to remove merged segment %s: %v", s.dir, err)
+			}
+		}
+	})
+}
+
+// acquireIndex returns the current snapshot with a reference held on each of its segments, so that a
+// merge can't close them underneath the search; the search calls release when it is done
+func acquireIndex() *indexSnapshot {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+	if currentIndex == nil {
+		return &indexSnapshot{deleted: roaring.New(), allPageIDs: roaring.New()}
+	}
+	for _, s := range currentIndex.segments {
+		s.refs.Add(1)
+	}
+	return currentIndex
+}
+
+// release drops the references acquireIndex took
+func (idx *indexSnapshot) release() {
+	for _, s := range idx.segments {
+		s.release()
+	}
+}
+
+// publishIndex replaces the current snapshot with a copy of it that change edits, swapping segments or
+// adding tombstones. Segments that change adds must come straight from openSegment; the snapshot's
+// reference on every segment it drops is released. Cached search results are forgotten since they may
+// no longer be complete, or no longer exist.
+func publishIndex(change func(next *indexSnapshot)) {
+	indexMu.Lock()
+	next := &indexSnapshot{deleted: roaring.New()}
+	var previous []*segment
+	if currentIndex != nil {
+		previous = currentIndex.segments
+		next.deleted = currentIndex.deleted.Clone()
+	}
+	next.segments = append([]*segment{}, previous...)
+	change(next)
+	next.allPageIDs = roaring.New()
+	for _, s := range next.segments {
+		next.allPageIDs.Or(s.pages)
+		next.totalLength += s.lengths.total
+		itr := roaring.And(s.pages, next.deleted).Iterator()
+		for itr.HasNext() {
+			if length, ok := s.lengths.length(itr.Next()); ok {
+				next.totalLength -= uint64(length)
+			}
+		}
+	}
+	next.allPageIDs.AndNot(next.deleted)
+	currentIndex = next
+	indexMu.Unlock()
+
+	kept := make(map[*segment]struct{}, len(next.segments))
+	for _, s := range next.segments {
+		kept[s] = struct{}{}
+	}
+	for _, s := range previous {
+		if _, ok := kept[s]; !ok {
+			s.release()
+		}
+	}
+
+	searchManager.mu.Lock()
+	searchManager.cache = make(map[string]*SearchResult)
+	searchManager.mu.Unlock()
+}
+
+// closeSearchIndex unpublishes every segment, closing each once its last search finishes
+func closeSearchIndex() {
+	publishIndex(func(next *indexSnapshot) { next.segments = nil })
+}
+
+// loadSegments opens the base segment in the cache directory and every incremental segment under
+// segments/, after removing what an interrupted ingest or merge left behind
+func loadSegments() ([]*segment, error) {
+	if err := cleanSegmentsDir(); err != nil {
+		return nil, err
+	}
+	base, err := openSegment(baseSegmentID, *cfigs.String(kCacheDir))
+	if err != nil {
+		return nil, err
+	}
+	segments := []*segment{base}
+	entries, err := os.ReadDir(segmentsDir())
+	if err != nil && !os.IsNotExist(err) {
+		base.close()
+		return nil, err
+	}
+	maxID := 0
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() || id <= baseSegmentID {
+			continue
+		}
+		s, err := openSegment(id, filepath.Join(segmentsDir(), entry.Name()))
+		if err != nil {
+			for _, opened := range segments {
+				opened.close()
+			}
+			return nil, fmt.Errorf("segment %s: %w", entry.Name(), err)
+		}
+		segments = append(segments, s)
+		maxID = max(maxID, id)
+	}
+	if int64(maxID) > lastSegmentID.Load() {
+		lastSegmentID.Store(int64(maxID))
+	}
+	return segments, nil
+}
+
+// incrementalSegmentPages reads the page IDs of every incremental segment on disk without opening its
+// indexes, for building base segment indexes that must leave those pages out
+func incrementalSegmentPages() (*roaring.Bitmap, error) {
+	pages := roaring.New()
+	if err := cleanSegmentsDir(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(segmentsDir())
+	if os.IsNotExist(err) {
+		return pages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if id, err := strconv.Atoi(entry.Name()); err != nil || !entry.IsDir() || id <= baseSegmentID {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(segmentsDir(), entry.Name(), segmentPagesFile))
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: failed to read segment pages: %w", entry.Name(), err)
+		}
+		b := roaring.New()
+		if err := b.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("segment %s: failed to decode segment pages: %w", entry.Name(), err)
+		}
+		pages.Or(b)
+	}
+	return pages, nil
+}
+
+// cleanSegmentsDir removes the temporary directories of interrupted ingests and merges, and the
+// segments that a merged segment replaced when the merge was interrupted before removing them
+func cleanSegmentsDir() error {
+	entries, err := os.ReadDir(segmentsDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(segmentsDir(), entry.Name())
+		if strings.HasPrefix(entry.Name(), segmentTempPrefix) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		sources, err := os.ReadFile(filepath.Join(path, segmentSourcesFile))
+		if err != nil {
+			continue
+		}
+		for _, source := range strings.Fields(string(sources)) {
+			if source == entry.Name() || strings.ContainsAny(source, `/\`) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(segmentsDir(), source)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createSegmentDir creates the temporary directory a new segment is written to
+func createSegmentDir(id int) (string, error) {
+	tmp := filepath.Join(segmentsDir(), segmentTempPrefix+segmentDirName(id))
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", fmt.Errorf("create segment directory: %w", err)
+	}
+	return tmp, nil
+}
+
+// finishSegment writes the page IDs of the segment written to tmp, moves it in place and opens it
+func finishSegment(id int, tmp string, pages *roaring.Bitmap) (*segment, error) {
+	data, err := pages.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("marshal segment pages: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, segmentPagesFile), data, 0644); err != nil {
+		return nil, fmt.Errorf("write segment pages: %w", err)
+	}
+	dir := filepath.Join(segmentsDir(), segmentDirName(id))
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, fmt.Errorf("move segment in place: %w", err)
+	}
+	return openSegment(id, dir)
+}
+
+// requestSegmentMerge wakes the merger without waiting for it
+func requestSegmentMerge() {
+	select {
+	case segmentMergeRequests <- struct{}{}:
+	default:
+	}
+}
+
+// runSegmentMerger compacts segments whenever one is added, until ctx is done
+func runSegmentMerger(ctx context.Context) {
+	requestSegmentMerge() // segments left from the previous run
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-segmentMergeRequests:
+			for {
+				merged, err := mergeSegmentsOnce()
+				if err != nil {
+					errorLogger.Printf("Segment merge failed: %v", err)
+				}
+				if !merged || err != nil || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// mergeSegmentsOnce merges one tier of segments, reporting whether there was one to merge. The merged
+// segment is written without cacheMutex, so that ingests and deletions carry on meanwhile; it is only
+// held to take the snapshot and to publish the result. A merge that a full rebuild or reload overtook
+// is dropped, as that replaced every segment it merged.
+func mergeSegmentsOnce() (bool, error) {
+	segmentMergeMu.Lock()
+	defer segmentMergeMu.Unlock()
+
+	cacheMutex.RLock()
+	generation := indexGeneration.Load()
+	idx := acquireIndex()
+	cacheMutex.RUnlock()
+	defer idx.release()
+	sources := pickSegmentMerge(idx.segments, *cfigs.Int(kSegmentMergeFactor))
+	rewriteBase := false
+	if len(sources) == 0 {
+		base := pickBaseRewrite(idx.segments, idx.deleted, *cfigs.Float64(kBaseRewriteRatio))
+		if base == nil {
+			return false, nil
+		}
+		sources, rewriteBase = []*segment{base}, true
+	}
+	id, tmp, pages, err := mergeSegments(sources, idx.deleted)
+	if tmp != "" {
+		defer os.RemoveAll(tmp) // a no-op once moved in place
+	}
+	if err == nil && segmentMergeWritten != nil {
+		segmentMergeWritten()
+	}
+
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	if indexGeneration.Load() != generation {
+		// the rebuild may have removed the directory the merge was writing to, so err says nothing more
+		log.Printf("Dropped the merge of %d segments: the index was rebuilt meanwhile", len(sources))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var merged *segment
+	if rewriteBase {
+		merged, err = replaceBaseSegment(tmp, sources[0].pages)
+	} else {
+		merged, err = finishSegment(id, tmp, pages)
+	}
+	if err != nil {
+		return false, err
+	}
+	replaced := make(map[*segment]struct{}, len(sources))
+	for _, s := range sources {
+		replaced[s] = struct{}{}
+		s.obsolete.Store(true)
+	}
+	empty := !rewriteBase && merged.pages.IsEmpty() // every page of the sources was deleted
+	publishIndex(func(next *indexSnapshot) {
+		kept := next.segments[:0]
+		for _, s := range next.segments {
+			if _, ok := replaced[s]; !ok {
+				kept = append(kept, s)
+			} else if rewriteBase {
+				kept = append(kept, merged) // the base stays first
+			}
+		}
+		if !empty && !rewriteBase {
+			kept = append(kept, merged)
+		}
+		next.segments = kept
+	})
+	if empty {
+		merged.obsolete.Store(true)
+		merged.release()
+	}
+	if rewriteBase {
+		log.Printf("Rewrote the base segment without its deleted pages, %d pages left", pages.GetCardinality())
+	} else {
+		log.Printf("Merged %d segments into segment %d with %d pages", len(sources), merged.id, merged.pages.GetCardinality())
+	}
+	return true, nil
+}
+
+// pickBaseRewrite returns the base segment when more than ratio of the pages its indexes hold are
+// deleted, for the merger to rewrite without them, and nil otherwise or when ratio is 0. The pages it
+// holds are counted from its page lengths, which a rewrite leaves the deleted pages out of.
+func pickBaseRewrite(segments []*segment, deleted *roaring.Bitmap, ratio float64) *segment {
+	if ratio <= 0 {
+		return nil
+	}
+	for _, s := range segments {
+		if s.id != baseSegmentID || len(s.lengths.ids) == 0 {
+			continue
+		}
+		held := 0
+		for _, pageID := range s.lengths.ids {
+			if deleted.Contains(pageID) {
+				held++
+			}
+		}
+		if float64(held)/float64(len(s.lengths.ids)) > ratio {
+			return s
+		}
+	}
+	return nil
+}
+
+// replaceBaseSegment moves the index files that a merge of the base segment wrote to tmp over those of
+// the base segment in the cache directory, with their checksums, and opens them. Searches still reading
+// the old base keep their open files. Each file is complete on its own, so a crash part way leaves base
+// files that only differ in which deleted pages they still hold, which the tombstones hide anyway.
+func replaceBaseSegment(tmp string, pages *roaring.Bitmap) (*segment, error) {
+	cacheDir := *cfigs.String(kCacheDir)
+	for _, file := range []string{wordIndexFile, gemIndexFile, positionIndexFile, fieldIndexFile, frequencyIndexFile} {
+		path := filepath.Join(cacheDir, file)
+		if err := os.Rename(filepath.Join(tmp, file), path); err != nil {
+			return nil, fmt.Errorf("replace %s: %w", file, err)
+		}
+		if err := generateChecksum(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	base, err := openSegment(baseSegmentID, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	// the base keeps every page no incremental segment holds, deleted ones included, see loadSearchData
+	base.pages = pages.Clone()
+	return base, nil
+}
+
+// pickSegmentMerge returns the incremental segments of the smallest size tier that holds at least
+// factor of them, where a segment of n pages is in tier floor(log_factor(n)). Merging a tier moves its
+// pages up one tier, so every page is rewritten about log_factor(pages) times. The base segment is
+// never merged with others, see pickBaseRewrite; a factor below 2 turns merging off.
+func pickSegmentMerge(segments []*segment, factor int) []*segment {
+	if factor < 2 {
+		return nil
+	}
+	tiers := make(map[int][]*segment)
+	for _, s := range segments {
+		if s.id == baseSegmentID {
+			continue
+		}
+		tier := 0
+		for n := s.pages.GetCardinality(); n >= uint64(factor); n /= uint64(factor) {
+			tier++
+		}
+		tiers[tier] = append(tiers[tier], s)
+	}
+	var ready []int
+	for tier, members := range tiers {
+		if len(members) >= factor {
+			ready = append(ready, tier)
+		}
+	}
+	if len(ready) == 0 {
+		return nil
+	}
+	sort.Ints(ready)
+	picked := tiers[ready[0]]
+	sort.Slice(picked, func(i, j int) bool { return picked[i].id < picked[j].id })
+	return picked
+}
+
+// mergeSegments writes one segment holding the pages of every source into the temporary directory tmp,
+// leaving out the postings of the deleted pages, for finishSegment to move in place under id. Keys that
+// only deleted pages held are dropped. The caller removes tmp when it doesn't finish the segment.
+func mergeSegments(sources []*segment, deleted *roaring.Bitmap) (id int, tmp string, pages *roaring.Bitmap, err error) {
+	id = nextSegmentID()
+	if tmp, err = createSegmentDir(id); err != nil {
+		return id, "", nil, err
+	}
+
+	var words, positions, fields, frequencies []*IndexReader
+	pages = roaring.New()
+	var names []string
+	for _, s := range sources {
+		words = append(words, s.word)
+		positions = append(positions, s.position)
+		fields = append(fields, s.field)
+		frequencies = append(frequencies, s.frequency)
+		pages.Or(s.pages)
+		names = append(names, filepath.Base(s.dir))
+	}
+	deleted = roaring.And(deleted, pages)
+	pages.AndNot(deleted)
+	bitmaps := func(records [][]byte) ([]byte, error) { return mergeBitmaps(records, deleted) }
+	positionBlocks := func(records [][]byte) ([]byte, error) { return mergePositionBlocks(records, deleted) }
+	frequencyBlocks := func(records [][]byte) ([]byte, error) { return mergeFrequencyBlocks(records, deleted) }
+	if err := mergeRecordIndexes(filepath.Join(tmp, wordIndexFile), words, bitmaps, fuzzySection); err != nil {
+		return id, tmp, nil, fmt.Errorf("merge word indexes: %w", err)
+	}
+	if err := mergeRecordIndexes(filepath.Join(tmp, positionIndexFile), positions, positionBlocks); err != nil {
+		return id, tmp, nil, fmt.Errorf("merge position indexes: %w", err)
+	}
+	if err := mergeRecordIndexes(filepath.Join(tmp, fieldIndexFile), fields, bitmaps); err != nil {
+		return id, tmp, nil, fmt.Errorf("merge field indexes: %w", err)
+	}
+	lengths := rawSection{tag: sectionLengths, data: encodePageLengths(mergePageLengths(sources, deleted))}
+	if err := mergeRecordIndexes(filepath.Join(tmp, frequencyIndexFile), frequencies, frequencyBlocks, lengths); err != nil {
+		return id, tmp, nil, fmt.Errorf("merge frequency indexes: %w", err)
+	}
+	if err := mergeGematriaIndexes(filepath.Join(tmp, gemIndexFile), sources, deleted); err != nil {
+		return id, tmp, nil, fmt.Errorf("merge gematria indexes: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, segmentSourcesFile), []byte(strings.Join(names, "\n")+"\n"), 0644); err != nil {
+		return id, tmp, nil, fmt.Errorf("write merged segments: %w", err)
+	}
+	return id, tmp, pages, nil
+}
+
+// mergeRecordIndexes writes the union of the keys of readers to indexFile, combining the records that
+// several readers hold for the same key with merge. A key whose merge returns no record is dropped. The
+// extra sections are written as they are.
+func mergeRecordIndexes(indexFile string, readers []*IndexReader, merge func(records [][]byte) ([]byte, error), extra ...rawSection) error {
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, reader := range readers {
+		for _, key := range reader.Terms {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return writeRecordIndex(indexFile, keys, func(key string) ([]byte, error) {
+		var records [][]byte
+		for _, reader := range readers {
+			offsetLen, ok := reader.Header[key]
+			if !ok {
+				continue
+			}
+			data, err := reader.Read(offsetLen)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %w", key, err)
+			}
+			records = append(records, data)
+		}
+		return merge(records)
+	}, extra...)
+}
+
+// mergeBitmaps ORs serialized Roaring Bitmaps together without the deleted pages, returning nil when
+// no page is left
+func mergeBitmaps(records [][]byte, deleted *roaring.Bitmap) ([]byte, error) {
+	result := roaring.New()
+	for _, data := range records {
+		b := roaring.New()
+		if err := b.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+		result.Or(b)
+	}
+	result.AndNot(deleted)
+	if result.IsEmpty() {
+		return nil, nil
+	}
+	return result.MarshalBinary()
+}
+
+// mergePositionBlocks combines the position blocks of one word from segments with disjoint pages
+// without the deleted pages, returning nil when no page is left
+func mergePositionBlocks(records [][]byte, deleted *roaring.Bitmap) ([]byte, error) {
+	var pages []pagePositions
+	for _, data := range records {
+		decoded, err := decodePositions(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		for pageID, positions := range decoded {
+			if !deleted.Contains(pageID) {
+				pages = append(pages, pagePositions{pageID: pageID, positions: positions})
+			}
+		}
+	}
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return encodePositions(pages), nil
+}
+
+// mergeGematriaIndexes writes the union of the gematria indexes of sources to indexFile, without the
+// deleted pages
+func mergeGematriaIndexes(indexFile string, sources []*segment, deleted *roaring.Bitmap) error {
+	locations := make(map[gematriaKey][]*segment)
+	var keys []gematriaKey
+	for _, s := range sources {
+		for _, table := range s.gematriaLookup {
+			for _, posting := range table.postings {
+				key := gematriaKey{cipher: posting.cipher, value: posting.value}
+				if _, ok := locations[key]; !ok {
+					keys = append(keys, key)
+				}
+				locations[key] = append(locations[key], s)
+			}
+		}
+	}
+	return writeGematriaIndex(indexFile, keys, func(key gematriaKey) (*roaring.Bitmap, error) {
+		result := roaring.New()
+		for _, s := range locations[key] {
+			offsetLen := s.gematriaLookup[key.cipher].byValue[key.value]
+			b, err := s.gematria.Bitmap(offsetLen)
+			if err != nil {
+				return nil, err
+			}
+			result.Or(b)
+		}
+		result.AndNot(deleted)
+		if result.IsEmpty() {
+			return nil, nil
+		}
+		return result, nil
+	})
+}
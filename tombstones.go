@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Deleting a page never rewrites a segment. Its ID joins the tombstones, a Roaring Bitmap kept in
+// tombstones.bin and in every indexSnapshot, which is subtracted from every result. The merger leaves
+// the postings of tombstoned pages out of the segment it writes and the next full rebuild drops them
+// altogether. A modified page is deleted and indexed again under a new ID.
+//
+// page_sources.txt maps pages back to the ocr.*.txt files they were read from, one "pageID path" line
+// per page with the path relative to -dir, so that the watcher can find the pages of a file or a
+// document directory that was removed or changed. A later line for a path supersedes the earlier ones.
+const (
+	tombstonesFile  = "tombstones.bin"
+	pageSourcesFile = "page_sources.txt"
+)
+
+// pageSources maps the path of every live page, relative to -dir, to its page ID; guarded by cacheMutex
+var pageSources map[string]int
+
+// sourcePath returns path relative to -dir, as page_sources.txt records it
+func sourcePath(path string) string {
+	rel, err := filepath.Rel(*cfigs.String(kDir), path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// isOCRFile reports whether path names the OCR text of a page
+func isOCRFile(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, "ocr.") && strings.HasSuffix(name, ".txt")
+}
+
+// writePageSource records that pageID was read from path
+func writePageSource(w *bufio.Writer, pageID int, path string) error {
+	_, err := w.WriteString(strconv.Itoa(pageID) + " " + sourcePath(path) + "\n")
+	return err
+}
+
+// loadTombstones reads tombstones.bin, which is missing until a page is first deleted
+func loadTombstones() (*roaring.Bitmap, error) {
+	deleted := roaring.New()
+	data, err := os.ReadFile(filepath.Join(*cfigs.String(kCacheDir), tombstonesFile))
+	if os.IsNotExist(err) {
+		return deleted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := deleted.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("decode tombstones: %w", err)
+	}
+	return deleted, nil
+}
+
+// saveTombstones replaces tombstones.bin with the tombstones of the current snapshot
+func saveTombstones() error {
+	idx := acquireIndex()
+	defer idx.release()
+	data, err := idx.deleted.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshal tombstones: %w", err)
+	}
+	path := filepath.Join(*cfigs.String(kCacheDir), tombstonesFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("write tombstones: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadPageSources reads page_sources.txt into the path of every page that isn't deleted. Caches built
+// before page_sources.txt existed have none, and their pages can only be removed by a full rebuild.
+func loadPageSources(deleted *roaring.Bitmap) (map[string]int, error) {
+	sources := make(map[string]int)
+	file, err := os.Open(filepath.Join(*cfigs.String(kCacheDir), pageSourcesFile))
+	if os.IsNotExist(err) {
+		return sources, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		idStr, path, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse page ID: %w", err)
+		}
+		if deleted.Contains(uint32(id)) {
+			continue
+		}
+		sources[path] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// deletePages tombstones every page read from path, an ocr.*.txt file or a document directory that was
+// removed from -dir
+func deletePages(path string) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	rel := sourcePath(path)
+	prefix := rel + string(filepath.Separator)
+	deleted := roaring.New()
+	for source, pageID := range pageSources {
+		if source == rel || strings.HasPrefix(source, prefix) {
+			deleted.Add(uint32(pageID))
+			delete(pageSources, source)
+		}
+	}
+	if deleted.IsEmpty() {
+		return nil
+	}
+	publishIndex(func(next *indexSnapshot) {
+		next.deleted.Or(deleted)
+	})
+	log.Printf("Deleted %d pages of %s", deleted.GetCardinality(), path)
+	return saveTombstones()
+}
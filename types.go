@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/andreimerlescu/gematria"
 	"github.com/andreimerlescu/textee"
 	"github.com/gorilla/websocket"
@@ -12,9 +14,11 @@ import (
 // Result struct to hold the output of processing each OCR file.
 type processResult struct {
 	pageID       int
+	path         string
 	pageData     *PageData
 	wordPostings []string
 	gemPostings  []string
+	posPostings  []string
 	err          error
 }
 
@@ -23,21 +27,21 @@ type PageData struct {
 	PageIdentifier      string
 	DocumentIdentifier  string
 	CoverPageIdentifier string
-}
-
-type SearchAnalysis struct {
-	Ors  map[uint]string
-	Ands []string
-	Nots []string
+	Metadata            map[string][]string `json:",omitempty"` // configured record.json fields, e.g. "agency" -> ["CIA"]
 }
 
 type SearchSession struct {
 	mu       sync.Mutex
+	ctx      context.Context    // cancelled once every client has left, see SearchManager.leave
+	cancel   context.CancelFunc // cancels ctx
+	Key      string             // sessionKey of Keyword and Options
 	Keyword  string
+	Options  SearchOptions                // matchers selected by the subscribe message
 	Channels map[string]chan string       // e.g., "exact/textee" -> channel
 	Clients  map[*websocket.Conn][]string // WebSocket conn -> subscribed channels
 	Done     chan struct{}                // Signals search completion
 	Results  map[string][]string          // Accumulates results for caching
+	Partial  bool                         // the search ran out of time or was cancelled, so Results are incomplete
 }
 
 type SearchResult struct {
@@ -54,10 +58,14 @@ type SearchManager struct {
 
 // MatchDetail captures the specifics of a match
 type MatchDetail struct {
-	Text       string            `json:"text"`     // The matched word from Textee.Gematrias
-	Gematria   gematria.Gematria `json:"gematria"` // The Gematria struct that matched
-	TexTeeTexT string            `json:"original"` // The full Textee.Input for context
-	Category   string            `json:"category"` // e.g., "exact/textee", "gematria/simple"
+	Text       string            `json:"text"`        // The matched page term, a substring from Textee.Gematrias
+	Query      string            `json:"query"`       // The query term that matched it
+	Gematria   gematria.Gematria `json:"gematria"`    // The Gematria of the matched page term
+	Category   string            `json:"category"`    // e.g., "exact/textee", "gematria/simple"
+	Snippet    string            `json:"snippet"`     // The window of Textee.Input around the match
+	Offset     int               `json:"offset"`      // Character offset of Snippet in Textee.Input
+	MatchStart int               `json:"match_start"` // Character offset of the match in Snippet, -1 when it couldn't be located
+	MatchEnd   int               `json:"match_end"`   // Character offset just past the match in Snippet, -1 when it couldn't be located
 }
 
 // SearchResults holds categorized results, hit counts, and match details
@@ -65,4 +73,15 @@ type SearchResults struct {
 	Categories map[string][]string      // e.g., "exact/textee" -> page IDs
 	HitCounts  map[string]int           // page ID -> total hits across categories
 	Matches    map[string][]MatchDetail // page ID -> list of match details
+	Pages      *roaring.Bitmap          // internal page IDs of every matching page, used for facet counts
+	Scores     map[string]float64       // page ID -> BM25 score plus category boost, when SearchOptions.BM25 is set
+	Plan       []PlanStep               // the steps the query planner ran, when SearchOptions.Explain is set
+	Tree       QueryNode                // the parsed query with its filters, when SearchOptions.Explain is set
+	Clauses    []ClauseTrace            // what every clause looked up and matched, when SearchOptions.Explain is set
+	Timings    []PhaseTiming            // the time spent parsing, evaluating and scoring, when SearchOptions.Explain is set
+	Partial    bool                     // the search ran out of time, so Pages, or Window when set, only holds the pages it confirmed until then
+	Total      uint64                   // pages, or documents when grouped, matching the query, when SearchOptions.Window is set
+	Window     []rankedPage             // the pages of the window in order, when SearchOptions.Window is set
+	Groups     []DocumentGroup          // the documents of the window in order, when SearchOptions.Window groups by document
+	NextCursor string                   // the cursor of the window that follows, empty after the last one
 }
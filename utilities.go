@@ -67,15 +67,47 @@ func FileAppender(filename string, mode int) (*bufio.Writer, *os.File, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open %s due to err: %v", filename, err)
 	}
+	if mode&os.O_APPEND != 0 {
+		// appends always land at the end, so start the position there for AppendToCache offsets
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			_ = file.Close()
+			return nil, nil, fmt.Errorf("failed to seek to the end of %s due to err: %v", filename, err)
+		}
+	}
 	writer := bufio.NewWriter(file)
 	return writer, file, nil
 }
 
-// ProcessOCRFile processes an OCR text file and returns PageData and postings.
-func ProcessOCRFile(path string, pageID int) (*PageData, []string, []string, error) {
+// readPageIdentifier returns the identifier in the page.######.json next to the ocr.######.txt at path
+func readPageIdentifier(path string) (string, error) {
+	// the page number is in the filename of the ocr.######.txt
+	var pageNumber int
+	_, err := fmt.Sscanf(filepath.Base(path), "ocr.%06d.txt", &pageNumber)
+	if err != nil {
+		fmt.Printf("Error parsing filename: %v\n", err)
+	}
+
+	var dataInPageJson = make(map[string]interface{})
+	pageJsonBytes, readErr := os.ReadFile(filepath.Join(filepath.Dir(path), fmt.Sprintf("page.%06d.json", pageNumber)))
+	if readErr != nil {
+		return "", readErr
+	}
+	jsonErr := json.Unmarshal(pageJsonBytes, &dataInPageJson)
+	if jsonErr != nil {
+		return "", jsonErr
+	}
+	pageIdentifier, ok := dataInPageJson["identifier"].(string)
+	if !ok {
+		return "", fmt.Errorf("no such field identifier in page.%06d.json", pageNumber)
+	}
+	return pageIdentifier, nil
+}
+
+// ProcessOCRFile processes an OCR text file and returns PageData along with its word, gematria and position postings.
+func ProcessOCRFile(path string, pageID int) (*PageData, []string, []string, []string, error) {
 	relPath := filepath.Dir(path)
 	if !strings.HasSuffix(relPath, "pages") {
-		return nil, nil, nil, nil // Skip if not in 'pages' directory
+		return nil, nil, nil, nil, nil // Skip if not in 'pages' directory
 	}
 
 	// record.json contains the document identifier
@@ -83,52 +115,36 @@ func ProcessOCRFile(path string, pageID int) (*PageData, []string, []string, err
 	var dataInRecordJson = make(map[string]interface{})
 	recordJsonBytes, readErr := os.ReadFile(filepath.Join(docDir, "record.json"))
 	if readErr != nil {
-		return nil, nil, nil, readErr
+		return nil, nil, nil, nil, readErr
 	}
 	jsonErr := json.Unmarshal(recordJsonBytes, &dataInRecordJson)
 	if jsonErr != nil {
-		return nil, nil, nil, jsonErr
+		return nil, nil, nil, nil, jsonErr
 	}
 	documentIdentifier, ok := dataInRecordJson["identifier"].(string)
 	if !ok {
-		return nil, nil, nil, errors.New("no such field identifier in record.json")
-	}
-
-	// the page number is in the filename of the ocr.######.txt
-	var pageNumber int
-	_, err := fmt.Sscanf(filepath.Base(path), "ocr.%06d.txt", &pageNumber)
-	if err != nil {
-		fmt.Printf("Error parsing filename: %v\n", err)
+		return nil, nil, nil, nil, errors.New("no such field identifier in record.json")
 	}
 
 	// page.######.json contains the page identifier
-	var dataInPageJson = make(map[string]interface{})
-	pageJsonBytes, readErr := os.ReadFile(filepath.Join(relPath, fmt.Sprintf("page.%06d.json", pageNumber)))
-	if readErr != nil {
-		return nil, nil, nil, readErr
-	}
-	jsonErr = json.Unmarshal(pageJsonBytes, &dataInPageJson)
-	if jsonErr != nil {
-		return nil, nil, nil, jsonErr
-	}
-	pageIdentifier, ok := dataInPageJson["identifier"].(string)
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("no such field identifier in page.%06d.json", pageNumber)
+	pageIdentifier, err := readPageIdentifier(path)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
 	// page.000001.json contains the cover page identifier
 	var dataInCoverPageJson = make(map[string]interface{})
 	coverPageJsonBytes, readErr := os.ReadFile(filepath.Join(relPath, "page.000001.json"))
 	if readErr != nil {
-		return nil, nil, nil, readErr
+		return nil, nil, nil, nil, readErr
 	}
 	jsonErr = json.Unmarshal(coverPageJsonBytes, &dataInCoverPageJson)
 	if jsonErr != nil {
-		return nil, nil, nil, jsonErr
+		return nil, nil, nil, nil, jsonErr
 	}
 	coverPageIdentifier, ok := dataInCoverPageJson["identifier"].(string)
 	if !ok {
-		return nil, nil, nil, errors.New("missing identifier field in page.000001.json")
+		return nil, nil, nil, nil, errors.New("missing identifier field in page.000001.json")
 	}
 
 	// gather the identifiers
@@ -136,18 +152,19 @@ func ProcessOCRFile(path string, pageID int) (*PageData, []string, []string, err
 		PageIdentifier:      pageIdentifier,
 		DocumentIdentifier:  documentIdentifier,
 		CoverPageIdentifier: coverPageIdentifier,
+		Metadata:            recordMetadata(dataInRecordJson),
 	}
 
 	// read the ocr full text file
 	content, err := os.ReadFile(path)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	// calculate textee data for result
 	text, err := textee.NewTextee(string(content))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 	pageData.Textee = text
 
@@ -159,31 +176,35 @@ func ProcessOCRFile(path string, pageID int) (*PageData, []string, []string, err
 
 	wordPostings := generateWordPostings(text, pageID)
 	gemPostings := generateGematriaPostings(text, pageID)
+	posPostings := generatePositionPostings(string(content), pageID)
 
-	return pageData, wordPostings, gemPostings, nil
+	return pageData, wordPostings, gemPostings, posPostings, nil
 }
 
-// AppendToCache appends PageData to the cache file and updates the index.
-func AppendToCache(cacheWriter *bufio.Writer, idxWriter *bufio.Writer, pageData *PageData, pageID int, cacheFile *os.File) error {
+// AppendToCache appends PageData to the cache file and updates the index, returning the [offset, length]
+// of the page in the cache file.
+func AppendToCache(cacheWriter *bufio.Writer, idxWriter *bufio.Writer, pageData *PageData, pageID int, cacheFile *os.File) ([2]int64, error) {
+	// the file position only advances when cacheWriter flushes, so count what is still buffered
 	offset, err := cacheFile.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return err
+		return [2]int64{}, err
 	}
+	offset += int64(cacheWriter.Buffered())
 	data, err := json.Marshal(pageData)
 	if err != nil {
-		return err
+		return [2]int64{}, err
 	}
 	i1, err := cacheWriter.Write(data)
 	if err != nil {
-		return err
+		return [2]int64{}, err
 	}
 	i2, err := cacheWriter.WriteString("\n")
 	if err != nil {
-		return err
+		return [2]int64{}, err
 	}
 	length := int64(i1 + i2)
 	_, err = idxWriter.WriteString(strconv.Itoa(pageID) + " " + strconv.FormatInt(offset, 10) + " " + strconv.FormatInt(length, 10) + "\n")
-	return err
+	return [2]int64{offset, length}, err
 }
 
 // generateWordPostings generates word postings for a given Textee and page ID.
@@ -2,9 +2,7 @@ package main
 
 import (
 	"log"
-	"os"
 	"path/filepath"
-	"regexp"
 	"sync"
 
 	"github.com/andreimerlescu/figs"
@@ -46,31 +44,47 @@ var (
 
 	// cacheIndexFile is the path to the cache index file ("cache_index.txt") mapping page IDs to their locations in cacheFile.
 	// Each line follows the format "pageID offset length":
-	//   - pageID: Integer ID (e.g., 0, 1, 2) corresponding to a page’s PageIdentifier.
+	//   - pageID: Integer ID (e.g., 0, 1, 2) corresponding to a page’s PageIdentifier, kept across rebuilds by page_ids.txt.
 	//   - offset: Byte position in cacheFile where the JSON line starts.
 	//   - length: Byte length of the JSON line in cacheFile.
 	// Example: "0 0 123" means page 0’s data starts at byte 0 and is 123 bytes long.
 	cacheIndexFile = "cache_index.txt"
 
 	// wordIndexFile is the path to the word index file ("word_index.bin"), a binary inverted index for word-based searches.
-	// Structure:
-	//   - Header (JSON): Maps words (e.g., "secret") to [offset, length] pairs, where offset is the byte position in the file’s body,
-	//                    and length is the size of the Roaring Bitmap.
-	//   - Body (binary): Roaring Bitmaps listing page IDs (e.g., [0, 5, 12]) where each word appears.
+	// It is an index container (see container.go) with three sections:
+	//   - DATA: Roaring Bitmaps listing page IDs (e.g., [0, 5, 12]) where each word appears.
+	//   - DICT: Every word (e.g., "secret") in ascending byte order with the [offset, length] pair of its bitmap,
+	//           so that prefix (assassinat*) and wildcard (commun?st) queries can binary search the vocabulary.
+	//   - FUZZ: The structures that shortlist the words each fuzzy algorithm can match, see fuzzyIndex.
 	// Used for fast word lookups and set operations during query processing.
 	wordIndexFile = "word_index.bin"
 
 	// gemIndexFile is the path to the gematria index file ("gematria_index.bin"), a binary index for gematria-based searches.
-	// Structure:
-	//   - Header (JSON): Maps gematria keys (e.g., "english_123", "simple_456") to [offset, length] pairs, where offset points to
-	//                    the bitmap in the file’s body, and length is the bitmap’s size.
-	//   - Body (binary): Roaring Bitmaps listing page IDs where each gematria value occurs.
+	// It is an index container (see container.go) with two sections:
+	//   - DATA: Roaring Bitmaps listing page IDs where each gematria value occurs.
+	//   - GEMD: One record per cipher and value (e.g., english 123) holding the cipher, the value and the
+	//           [offset, length] pair of its bitmap, see buildGematriaIndex.
 	// Enables matching words by their numerical gematria values (e.g., English, Simple, Jewish).
 	gemIndexFile = "gematria_index.bin"
 
-	// groupingRegex is a compiled regular expression to match parenthetical groupings in search queries (e.g., "(top secret or confidential)").
-	// It captures nested parentheses and their contents, used by AnalyzeQuery to identify OR conditions.
-	groupingRegex = regexp.MustCompile(`\((?:[^()]+|\([^()]*\))+\)`)
+	// positionIndexFile is the path to the positional index file ("position_index.bin") used by NEAR/n queries.
+	// It is an index container (see container.go) with two sections:
+	//   - DATA: One block of uvarints per word listing, for each page ID, the word offsets at which it occurs.
+	//   - DICT: Single words (e.g., "oswald") with the [offset, length] pairs of their position blocks.
+	// Built next to the word index so that proximity can be confirmed after a bitmap intersection.
+	positionIndexFile = "position_index.bin"
+
+	// fieldIndexFile is the path to the field index file ("field_index.bin") built by buildIndex from field_postings.txt.
+	// It has the same structure as wordIndexFile with keys of the form "field:value" (e.g., "doc:abc123", "cover:xyz")
+	// so that doc:, page:, cover: and metadata filters such as agency:cia can narrow a query before any page is scored.
+	fieldIndexFile = "field_index.bin"
+
+	// frequencyIndexFile is the path to the term frequency index file ("frequency_index.bin") used by sort=bm25.
+	// It is an index container (see container.go) with three sections:
+	//   - DATA: One block of uvarints per Textee substring listing, for each page ID, how often it occurs.
+	//   - DICT: The substrings (e.g., "oswald", "mexico city") with the [offset, length] pairs of their blocks.
+	//   - LENS: The length in words of every page, which BM25 normalizes term frequencies by.
+	frequencyIndexFile = "frequency_index.bin"
 
 	// searchManager is a global instance managing active search sessions and cached results.
 	// - activeSearches: Tracks ongoing searches by keyword, mapping to SearchSession structs with channels and WebSocket clients.
@@ -80,21 +94,16 @@ var (
 		cache:          make(map[string]*SearchResult),
 	}
 
-	// wordIndexHeader is the in-memory map of words to [offset, length] pairs from word_index.bin.
-	// Loaded at startup to avoid reading the file on every search request.
-	wordIndexHeader map[string][2]int64 // TODO cant use this because duplicates for the key are needed to be preserved for multiple page results
-
-	// wordIndexHandle is the file handle for word_index.bin, kept open for the lifetime of the application.
-	// Used to read bitmaps during search without reopening the file.
-	wordIndexHandle *os.File
-
 	// cacheIdToOffset is the in-memory map of page IDs to [offset, length] pairs from cache_index.txt.
-	// Loaded at startup to avoid reading the file on every search request.
+	// Loaded at startup to avoid reading the file on every search request, and extended by the watcher.
 	cacheIdToOffset map[int][2]int64
 
-	// cacheFileHandle is the file handle for apario-search-cache.jsonl, kept open for the lifetime of the application.
-	// Used to read PageData structs during search without reopening the file.
-	cacheFileHandle *os.File
+	// pageOffsetsMu guards cacheIdToOffset and cacheReader against the watcher adding pages during searches
+	pageOffsetsMu sync.RWMutex
+
+	// cacheReader reads apario-search-cache.jsonl, kept open until a reload replaces it and the reads
+	// in flight are done with it. Used to read PageData structs during search without reopening the file.
+	cacheReader *sharedRecordReader
 
 	// searchSemaphores provide per-IP limits on concurrent searches allowed and enforced with a semaphore instead of rate limiting alone
 	searchSemaphores     = make(map[string]sema.Semaphore)
@@ -102,13 +111,6 @@ var (
 
 	// systemSearchSemaphore is used for an application-wide limit on max concurrent searches allowed for all sessions
 	systemSearchSemaphore sema.Semaphore
-
-	// wordIndexGematrias maps gematria keys (e.g., "english_123") to the offset and length of their Roaring Bitmaps
-	// in gematria_index.bin, containing page IDs where the gematria value appears.
-	wordIndexGematrias map[string][2]int64
-
-	// gemIndexHandle is the file handle for gematria_index.bin, kept open for the lifetime of the application.
-	gemIndexHandle *os.File
 )
 
 const (
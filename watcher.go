@@ -6,12 +6,18 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/fsnotify/fsnotify"
 )
 
+// watchSettleDelay is how long an ocr.*.txt file must stay unchanged before it is re-indexed
+const watchSettleDelay = 2 * time.Second
+
 func checkDataChanges(ctx context.Context, dir string) {
 	// Create a new filesystem watcher
 	watcher, err := fsnotify.NewWatcher()
@@ -36,6 +42,12 @@ func checkDataChanges(ctx context.Context, dir string) {
 
 	log.Println("Started watching directory:", dir)
 
+	// Modified ocr.*.txt files are re-indexed together once they stopped changing for watchSettleDelay,
+	// since copying or editing one file raises several write events
+	modified := make(map[string]struct{})
+	settle := time.NewTimer(watchSettleDelay)
+	settle.Stop()
+
 	// Event handling loop
 	for {
 		select {
@@ -44,15 +56,39 @@ func checkDataChanges(ctx context.Context, dir string) {
 				log.Println("Watcher event channel closed")
 				return
 			}
-			// Handle new subdirectory creation
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
-					log.Println("New subdirectory detected:", event.Name)
-					// Process the new subdirectory and update the cache
-					processNewSubdirectory(event.Name)
-					// Add the new subdirectory to the watcher
-					watcher.Add(event.Name)
+			switch {
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				// A removed or renamed document directory or ocr.*.txt file, the new name of a rename
+				// arrives as a create
+				delete(modified, event.Name)
+				if err := deletePages(event.Name); err != nil {
+					errorLogger.Printf("Failed to delete the pages of %s: %v", event.Name, err)
 				}
+			case event.Op&fsnotify.Create == fsnotify.Create && isDir(event.Name):
+				// Handle new subdirectory creation
+				log.Println("New subdirectory detected:", event.Name)
+				// Process the new subdirectory and update the cache
+				if err := processNewSubdirectory(event.Name); err != nil {
+					errorLogger.Printf("Failed to index %s: %v", event.Name, err)
+				}
+				// Add the new subdirectory to the watcher
+				watcher.Add(event.Name)
+			case event.Op&(fsnotify.Create|fsnotify.Write) != 0 && isOCRFile(event.Name):
+				modified[event.Name] = struct{}{}
+				settle.Reset(watchSettleDelay)
+			}
+
+		case <-settle.C:
+			var paths []string
+			for path := range modified {
+				if _, err := os.Stat(path); err == nil {
+					paths = append(paths, path)
+				}
+			}
+			modified = make(map[string]struct{})
+			sort.Strings(paths)
+			if err := ingestPages(paths, "modified pages"); err != nil {
+				errorLogger.Printf("Failed to re-index %d modified pages: %v", len(paths), err)
 			}
 
 		case err, ok := <-watcher.Errors:
@@ -69,57 +105,161 @@ func checkDataChanges(ctx context.Context, dir string) {
 	}
 }
 
+// isDir reports whether path is an existing directory
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// processNewSubdirectory indexes every ocr.*.txt file of subdir, see ingestPages
 func processNewSubdirectory(subdir string) error {
-	// Determine the next available page ID
-	nextPageID, err := getNextPageID()
+	var paths []string
+	err := filepath.Walk(subdir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && isOCRFile(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	return ingestPages(paths, subdir)
+}
+
+// ingestPages appends the pages of the ocr.*.txt files at paths to the cache and writes their postings
+// into a new segment, which is searchable once it is published; the merger folds it into larger
+// segments later. A file that was indexed before is indexed under a new page ID and its previous page
+// is deleted in the same snapshot. source names the pages in the log.
+func ingestPages(paths []string, source string) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// Page IDs come from the registry
+	if pageIDs == nil {
+		registry, err := loadPageIDRegistry()
+		if err != nil {
+			return err
+		}
+		pageIDs = registry
+	}
+	index := acquireIndex()
+	defer index.release()
 
 	// Open files for appending
-	cacheWriter, cacheFile, err := FileAppender(filepath.Join(*cfigs.String(kCacheDir), cacheFile), os.O_APPEND|os.O_WRONLY)
+	cachePath := filepath.Join(*cfigs.String(kCacheDir), cacheFile)
+	cacheWriter, cacheFile, err := FileAppender(cachePath, os.O_APPEND|os.O_WRONLY)
 	if err != nil {
 		return err
 	}
 	defer cacheFile.Close()
 
-	idxWriter, idxFile, err := FileAppender(filepath.Join(*cfigs.String(kCacheDir), cacheIndexFile), os.O_APPEND|os.O_WRONLY)
+	idxPath := filepath.Join(*cfigs.String(kCacheDir), cacheIndexFile)
+	idxWriter, idxFile, err := FileAppender(idxPath, os.O_APPEND|os.O_WRONLY)
 	if err != nil {
 		return err
 	}
 	defer idxFile.Close()
 
-	wordWriter, wordFile, err := FileAppender(filepath.Join(*cfigs.String(kCacheDir), "word_postings.txt"), os.O_APPEND|os.O_WRONLY)
+	// The postings of the new pages go into the directory of a new segment
+	segmentID := nextSegmentID()
+	tmp, err := createSegmentDir(segmentID)
+	if err != nil {
+		return err
+	}
+	published := false
+	defer func() {
+		if !published {
+			_ = os.RemoveAll(tmp)
+		}
+	}()
+
+	wordWriter, wordFile, err := FileAppender(filepath.Join(tmp, "word_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return err
 	}
 	defer wordFile.Close()
 
-	gemWriter, gemFile, err := FileAppender(filepath.Join(*cfigs.String(kCacheDir), "gematria_postings.txt"), os.O_APPEND|os.O_WRONLY)
+	gemWriter, gemFile, err := FileAppender(filepath.Join(tmp, "gematria_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	if err != nil {
 		return err
 	}
 	defer gemFile.Close()
 
-	// Process the subdirectory
-	pageID := nextPageID
-	err = filepath.Walk(subdir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), "ocr.") || !strings.HasSuffix(info.Name(), ".txt") {
-			return nil
+	posWriter, posFile, err := FileAppender(filepath.Join(tmp, "position_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer posFile.Close()
+
+	fieldWriter, fieldFile, err := FileAppender(filepath.Join(tmp, "field_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer fieldFile.Close()
+
+	freqWriter, freqFile, err := FileAppender(filepath.Join(tmp, "frequency_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer freqFile.Close()
+
+	lengthWriter, lengthFile, err := FileAppender(filepath.Join(tmp, "length_postings.txt"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer lengthFile.Close()
+
+	sourcesWriter, sourcesFile, err := FileAppender(filepath.Join(*cfigs.String(kCacheDir), pageSourcesFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer sourcesFile.Close()
+
+	// Process the pages
+	pages := roaring.New()
+	replaced := roaring.New()
+	offsets := make(map[int][2]int64)
+	ingested := make(map[string]int)
+	for _, path := range paths {
+		if !strings.HasSuffix(filepath.Dir(path), "pages") {
+			continue // Skip if not in 'pages'
+		}
+		identifier, err := readPageIdentifier(path)
+		if err != nil {
+			return err
+		}
+		// A page keeps the ID of an earlier build unless that ID is already indexed, when the page was
+		// modified, or deleted
+		pageID, ok := pageIDs.lookup(identifier)
+		if !ok || index.allPageIDs.Contains(uint32(pageID)) || index.deleted.Contains(uint32(pageID)) || pages.Contains(uint32(pageID)) {
+			pageID = pageIDs.allocate(identifier)
 		}
 
-		pageData, wordPostings, gemPostings, err := ProcessOCRFile(path, pageID)
+		pageData, wordPostings, gemPostings, posPostings, err := ProcessOCRFile(path, pageID)
 		if err != nil {
 			return err
 		}
 		if pageData == nil {
-			return nil // Skip if not in 'pages'
+			continue // Skip if not in 'pages'
 		}
 
 		// Append to cache and index
-		if err := AppendToCache(cacheWriter, idxWriter, pageData, pageID, cacheFile); err != nil {
+		offsetLen, err := AppendToCache(cacheWriter, idxWriter, pageData, pageID, cacheFile)
+		if err != nil {
 			return err
 		}
+		offsets[pageID] = offsetLen
+		pages.Add(uint32(pageID))
+		if err := writePageSource(sourcesWriter, pageID, path); err != nil {
+			return err
+		}
+		ingested[sourcePath(path)] = pageID
+		if previous, ok := pageSources[sourcePath(path)]; ok {
+			replaced.Add(uint32(previous))
+		}
 
 		// Write postings
 		for _, posting := range wordPostings {
@@ -134,12 +274,32 @@ func processNewSubdirectory(subdir string) error {
 				return err
 			}
 		}
+		for _, posting := range posPostings {
+			_, err = posWriter.WriteString(posting + "\n")
+			if err != nil {
+				return err
+			}
+		}
+		for _, posting := range generateFieldPostings(pageData, pageID) {
+			_, err = fieldWriter.WriteString(posting + "\n")
+			if err != nil {
+				return err
+			}
+		}
+		for _, posting := range generateFrequencyPostings(pageData.Textee, pageID) {
+			_, err = freqWriter.WriteString(posting + "\n")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = lengthWriter.WriteString(generateLengthPosting(pageData.Textee, pageID) + "\n")
+		if err != nil {
+			return err
+		}
 
-		pageID++
+	}
+	if pages.IsEmpty() {
 		return nil
-	})
-	if err != nil {
-		return err
 	}
 
 	// Flush all writers
@@ -155,15 +315,82 @@ func processNewSubdirectory(subdir string) error {
 	if err = gemWriter.Flush(); err != nil {
 		return err
 	}
+	if err = posWriter.Flush(); err != nil {
+		return err
+	}
+	if err = fieldWriter.Flush(); err != nil {
+		return err
+	}
+	if err = freqWriter.Flush(); err != nil {
+		return err
+	}
+	if err = lengthWriter.Flush(); err != nil {
+		return err
+	}
+	if err = sourcesWriter.Flush(); err != nil {
+		return err
+	}
+	if err = pageIDs.save(); err != nil {
+		return err
+	}
 
-	// Rebuild the indexes
-	if err = buildIndex(filepath.Join(*cfigs.String(kCacheDir), "word_postings.txt"), wordIndexFile); err != nil {
+	// Build the indexes of the new segment only
+	if err = buildIndex(filepath.Join(tmp, "word_postings.txt"), filepath.Join(tmp, wordIndexFile), fuzzySection); err != nil {
+		return err
+	}
+	if err = buildGematriaIndex(filepath.Join(tmp, "gematria_postings.txt"), filepath.Join(tmp, gemIndexFile)); err != nil {
+		return err
+	}
+	if err = buildPositionIndex(filepath.Join(tmp, "position_postings.txt"), filepath.Join(tmp, positionIndexFile)); err != nil {
+		return err
+	}
+	if err = buildIndex(filepath.Join(tmp, "field_postings.txt"), filepath.Join(tmp, fieldIndexFile)); err != nil {
 		return err
 	}
-	if err = buildIndex(filepath.Join(*cfigs.String(kCacheDir), "gematria_postings.txt"), gemIndexFile); err != nil {
+	if err = buildFrequencyIndex(filepath.Join(tmp, "frequency_postings.txt"), filepath.Join(tmp, "length_postings.txt"), filepath.Join(tmp, frequencyIndexFile)); err != nil {
 		return err
 	}
+	for _, postings := range []string{"word_postings.txt", "gematria_postings.txt", "position_postings.txt", "field_postings.txt", "frequency_postings.txt", "length_postings.txt"} {
+		_ = os.Remove(filepath.Join(tmp, postings))
+	}
 
+	seg, err := finishSegment(segmentID, tmp, pages)
+	if err != nil {
+		return err
+	}
+	published = true
+
+	// The pages must be readable before any query can return them
+	pageOffsetsMu.Lock()
+	for id, offsetLen := range offsets {
+		cacheIdToOffset[id] = offsetLen
+	}
+	pageOffsetsMu.Unlock()
+	publishIndex(func(next *indexSnapshot) {
+		next.segments = append(next.segments, seg)
+		next.deleted.Or(replaced)
+	})
+	if pageSources == nil {
+		pageSources = make(map[string]int)
+	}
+	for path, id := range ingested {
+		pageSources[path] = id
+	}
+	requestSegmentMerge()
+	log.Printf("Indexed %d pages of %s into segment %d, replacing %d", pages.GetCardinality(), source, segmentID, replaced.GetCardinality())
+	if !replaced.IsEmpty() {
+		if err := saveTombstones(); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range []string{cachePath, idxPath} {
+		if _, err := os.Stat(path + ".sha256"); err == nil {
+			if err := generateChecksum(path); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
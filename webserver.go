@@ -18,6 +18,7 @@ import (
 // Start the server
 func webserver(ctx context.Context, port, dir string) {
 	go checkDataChanges(ctx, dir) // Start data change checker
+	go runSegmentMerger(ctx)      // Compact the segments the checker adds
 
 	var routeRateLimiter *limiter.Limiter
 	if *cfigs.Bool(kRateLimitEnabled) {
@@ -145,6 +146,7 @@ func webserver(ctx context.Context, port, dir string) {
 	r.NoRoute(middlewareNoRouteLinter())
 
 	r.GET("/search", handleSearch)
+	r.GET("/search/explain", handleSearchExplain)
 	r.GET("/ws/search", handleWebSocket)
 
 	srv := &http.Server{
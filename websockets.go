@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -25,15 +28,43 @@ func handleWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	for {
-		var msg struct {
-			Keyword  string   `json:"keyword"`
-			Channels []string `json:"channels"`
+	type subscribeMessage struct {
+		Keyword  string   `json:"keyword"`
+		Channels []string `json:"channels"`
+		Algos    []string `json:"algos"`   // omitted runs every fuzzy algorithm, [] runs none
+		Ciphers  []string `json:"ciphers"` // omitted runs every gematria cipher, [] runs none
+		Exact    *bool    `json:"exact"`   // omitted matches exactly
+		// Thresholds overrides the fuzzy thresholds by the names of their query parameters, e.g. {"jaro": 0.85}
+		Thresholds map[string]float64 `json:"thresholds"`
+	}
+
+	// messages are read on their own goroutine so that a client going away is noticed, and its
+	// searches cancelled, while it waits for one to complete
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan subscribeMessage)
+	go func() {
+		defer cancel()
+		for {
+			var msg subscribeMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				log.Println("WebSocket read error:", err)
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
 		}
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Println("WebSocket read error:", err)
-			break
+	}()
+
+	for {
+		var msg subscribeMessage
+		select {
+		case msg = <-messages:
+		case <-ctx.Done():
+			return
 		}
 
 		if msg.Keyword == "" || len(msg.Channels) == 0 {
@@ -41,17 +72,36 @@ func handleWebSocket(c *gin.Context) {
 			continue
 		}
 
-		subscribeToSearch(conn, msg.Keyword, msg.Channels)
+		if _, err := ParseQuery(msg.Keyword); err != nil {
+			var queryErr *QueryError
+			if errors.As(err, &queryErr) {
+				conn.WriteJSON(map[string]interface{}{"error": queryErr.Msg, "position": queryErr.Pos})
+			} else {
+				conn.WriteJSON(map[string]string{"error": err.Error()})
+			}
+			continue
+		}
+
+		opts, err := defaultSearchOptions().withMatchers(msg.Algos, msg.Ciphers, msg.Exact)
+		if err == nil {
+			opts, err = opts.withThresholds(msg.Thresholds)
+		}
+		if err != nil {
+			conn.WriteJSON(map[string]string{"error": err.Error()})
+			continue
+		}
+
+		subscribeToSearch(ctx, conn, msg.Keyword, opts, msg.Channels)
 	}
 }
 
-// Subscribe client to a search
-func subscribeToSearch(conn *websocket.Conn, keyword string, subChannels []string) {
+// Subscribe client to a search, leaving it when ctx is done before the search completes
+func subscribeToSearch(ctx context.Context, conn *websocket.Conn, keyword string, opts SearchOptions, subChannels []string) {
 	sm := searchManager
 
 	sm.mu.Lock()
 	// Check cached results first
-	if cached, exists := sm.cache[keyword]; exists && time.Since(cached.Timestamp) < time.Hour && !dataChanged {
+	if cached, exists := sm.cache[sessionKey(keyword, opts)]; exists && time.Since(cached.Timestamp) < time.Hour && !dataChanged {
 		sm.mu.Unlock()
 		for _, ch := range subChannels {
 			if results, ok := cached.Results[ch]; ok {
@@ -68,30 +118,42 @@ func subscribeToSearch(conn *websocket.Conn, keyword string, subChannels []strin
 	}
 	sm.mu.Unlock()
 
-	// Get or create search session
-	session := sm.getOrCreateSession(keyword)
-
-	// Register client
-	session.mu.Lock()
-	session.Clients[conn] = subChannels
-	session.mu.Unlock()
+	// Get or create search session and register client
+	session := sm.getOrCreateSession(keyword, opts, conn, subChannels)
 
-	// Stream results to this client
+	// Stream results to this client, one write to conn at a time
+	var writeMu sync.Mutex
+	var streaming sync.WaitGroup
 	for _, chName := range subChannels {
 		fullChName := fmt.Sprintf("/results/%s/%s", keyword, chName)
 		if ch, ok := session.Channels[chName]; ok {
+			streaming.Add(1)
 			go func(ch chan string, chName string) {
+				defer streaming.Done()
 				for pageID := range ch {
+					writeMu.Lock()
 					_ = conn.WriteJSON(map[string]interface{}{
 						"channel": chName,
 						"pageID":  pageID,
 					})
+					writeMu.Unlock()
 				}
 			}(ch, fullChName)
 		}
 	}
 
 	// Notify when search completes
-	<-session.Done
-	_ = conn.WriteJSON(map[string]string{"status": "completed"})
+	select {
+	case <-session.Done:
+	case <-ctx.Done():
+		sm.leave(session, conn)
+		streaming.Wait()
+		return
+	}
+	streaming.Wait()
+	status := map[string]interface{}{"status": "completed"}
+	if session.Partial {
+		status["partial"] = true
+	}
+	_ = conn.WriteJSON(status)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CategoryWeights is what sort=ranked scores a page by for every category it matched in, keyed by
+// category (exact/textee) or by a pattern ending in * (gematria/*, or * for every category). The most
+// specific entry wins: a category over the longest pattern that matches it. A category that nothing
+// matches weighs 1, so an empty table ranks by the number of categories a page matched in.
+type CategoryWeights map[string]float64
+
+// parseCategoryWeights reads a comma separated weight table such as
+// exact/textee=10,fuzzy/jaro-winkler=3,gematria/*=0.5
+func parseCategoryWeights(s string) (CategoryWeights, error) {
+	weights := make(CategoryWeights)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		category, value, found := strings.Cut(entry, "=")
+		category = strings.ToLower(strings.TrimSpace(category))
+		if !found || category == "" {
+			return nil, fmt.Errorf("invalid category weight %q, expected category=weight", entry)
+		}
+		if i := strings.Index(category, "*"); i >= 0 && i != len(category)-1 {
+			return nil, fmt.Errorf("invalid category weight %q, * may only end a category", entry)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) || weight < 0 {
+			return nil, fmt.Errorf("invalid category weight %q, expected a number of zero or more", entry)
+		}
+		weights[category] = weight
+	}
+	return weights, nil
+}
+
+// configuredCategoryWeights parses the weight table configured with kCategoryWeights
+func configuredCategoryWeights() (CategoryWeights, error) {
+	weights, err := parseCategoryWeights(*cfigs.String(kCategoryWeights))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", kCategoryWeights, err)
+	}
+	return weights, nil
+}
+
+// withOverrides returns the weights with the entries of overrides replacing those of the same key
+func (w CategoryWeights) withOverrides(overrides CategoryWeights) CategoryWeights {
+	merged := make(CategoryWeights, len(w)+len(overrides))
+	for key, weight := range w {
+		merged[key] = weight
+	}
+	for key, weight := range overrides {
+		merged[key] = weight
+	}
+	return merged
+}
+
+// weight returns what a match in category scores
+func (w CategoryWeights) weight(category string) float64 {
+	if weight, ok := w[category]; ok {
+		return weight
+	}
+	best, weight := -1, 1.0
+	for key, value := range w {
+		prefix, isPattern := strings.CutSuffix(key, "*")
+		if isPattern && strings.HasPrefix(category, prefix) && len(prefix) > best {
+			best, weight = len(prefix), value
+		}
+	}
+	return weight
+}
+
+// rankedPage is one page of a sort=ranked or sort=bm25 response
+type rankedPage struct {
+	ID        string             `json:"id"`
+	Score     float64            `json:"score"`
+	Breakdown map[string]float64 `json:"breakdown,omitempty"` // category -> what it added to Score, for sort=ranked
+	Matches   []MatchDetail      `json:"matches"`
+}